@@ -0,0 +1,386 @@
+package wal
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrArchiveFailed is returned if a segment could not be archived. Such a
+// segment is never deleted.
+var ErrArchiveFailed = errors.New("failed to archive WAL segment")
+
+// compressedSuffix is appended to the file name of gzip compressed segments,
+// e.g. "7.wal.gz". Such segments are sealed and can only be read.
+const compressedSuffix = ".gz"
+
+// An Archiver copies sealed segments to another storage (e.g. cold storage)
+// before they are deleted by WAL.TruncateFront(…), the retention rules or the
+// FullPolicyDeleteOldest. Use the WithArchiver(…) option to configure it.
+//
+// Segments are archived by a background goroutine, so the WAL keeps on
+// accepting writes while a segment is being archived. A segment is only
+// deleted or recycled after it was archived successfully.
+type Archiver interface {
+	// Archive copies the segment which can be read from r. The reader returns
+	// exactly SealedSegment.Size bytes. If Archive returns an error, the WAL
+	// retries archiving the segment as configured via the Configuration and
+	// does not delete the segment if archiving fails repeatedly.
+	Archive(s SealedSegment, r io.Reader) error
+}
+
+// SealedSegment describes a segment that is no longer written to.
+type SealedSegment struct {
+	Path        string // path of the segment file in the WAL directory
+	SegmentID   int    // ID of the segment, which is also used in its file name
+	FirstOffset uint32 // offset of the first entry in the segment
+	LastOffset  uint32 // offset of the last entry, or FirstOffset-1 if the segment is empty
+	Size        int64  // size of the segment contents in bytes
+	Checksum    uint32 // CRC32 (IEEE) checksum of the segment contents
+}
+
+// startArchiving starts archiving segments in the background.
+func (w *WAL) startArchiving() {
+	w.archiving = map[string][]chan<- error{}
+	w.archiveSignal = make(chan struct{}, 1)
+
+	w.background.Add(1)
+	go w.runArchiving()
+}
+
+// queuedSegment is a sealed segment which waits to be archived.
+type queuedSegment struct {
+	path    string
+	recycle bool // whether the segment may be recycled after it was archived
+}
+
+// queueArchiving schedules the sealed segment at the given path to be archived
+// and then discarded in the background. The returned channel receives the
+// result once the segment was discarded or archiving it failed. If the segment
+// was queued already, it is discarded as requested by the first caller.
+// The caller must ensure the WAL is write-locked before calling this function.
+func (w *WAL) queueArchiving(path string, recycle bool) <-chan error {
+	done := make(chan error, 1)
+	waiters, queued := w.archiving[path]
+	w.archiving[path] = append(waiters, done)
+	if queued {
+		return done
+	}
+
+	w.archiveQueue = append(w.archiveQueue, queuedSegment{path: path, recycle: recycle})
+
+	// Wake up the background goroutine unless it was already notified.
+	select {
+	case w.archiveSignal <- struct{}{}:
+	default:
+	}
+
+	return done
+}
+
+// isArchiving returns whether the segment at the given path is queued or
+// currently being archived.
+// The caller must ensure the WAL is write-locked before calling this function.
+func (w *WAL) isArchiving(path string) bool {
+	_, ok := w.archiving[path]
+	return ok
+}
+
+// runArchiving archives and then discards all queued segments until the WAL is
+// closed. Segments that are still queued when the WAL is closed are kept, so
+// they are archived when they are truncated again after the WAL was opened.
+func (w *WAL) runArchiving() {
+	defer w.background.Done()
+
+	for {
+		select {
+		case <-w.archiveSignal:
+		case <-w.closing:
+			w.cancelArchiving()
+			return
+		}
+
+		for {
+			w.mu.Lock()
+			if w.isClosed() || len(w.archiveQueue) == 0 {
+				w.mu.Unlock()
+				break
+			}
+
+			next := w.archiveQueue[0]
+			path := next.path
+			w.archiveQueue = w.archiveQueue[1:]
+			w.mu.Unlock()
+
+			// The segment is sealed, so we can archive it without holding
+			// the lock and the WAL can keep on writing in the meantime.
+			err := w.archiveSegment(path)
+
+			w.mu.Lock()
+			if err == nil && w.isClosed() {
+				err = errors.New("WAL is already closed")
+			} else if err == nil {
+				err = w.removeSegment(path, next.recycle)
+			}
+
+			waiters := w.archiving[path]
+			delete(w.archiving, path)
+			w.mu.Unlock()
+
+			if err != nil {
+				w.logger.Error("Failed to discard WAL segment",
+					zap.String("path", path),
+					zap.Error(err),
+				)
+			}
+
+			for _, done := range waiters {
+				done <- err
+			}
+		}
+	}
+}
+
+// cancelArchiving notifies all goroutines which still wait for segments to be
+// archived after the WAL was closed.
+func (w *WAL) cancelArchiving() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for path, waiters := range w.archiving {
+		for _, done := range waiters {
+			done <- errors.New("WAL is already closed")
+		}
+
+		delete(w.archiving, path)
+	}
+
+	w.archiveQueue = nil
+}
+
+// archiveSegment passes the segment at the given path to the Archiver and
+// retries as configured if it fails. It must be called without holding the
+// lock, since the Archiver might take a while.
+func (w *WAL) archiveSegment(path string) error {
+	s, err := w.sealedSegment(path)
+	if err != nil {
+		return fmt.Errorf("%w %q: %w", ErrArchiveFailed, path, err)
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = w.archiveAttempt(s)
+		if err == nil {
+			w.logger.Info("Archived WAL segment",
+				zap.String("path", path),
+				zap.Uint32("first_offset", s.FirstOffset),
+				zap.Uint32("last_offset", s.LastOffset),
+			)
+			return nil
+		}
+
+		if attempt >= w.conf.ArchiveRetries {
+			return fmt.Errorf("%w %q: %w", ErrArchiveFailed, path, err)
+		}
+
+		w.logger.Warn("Failed to archive WAL segment, retrying",
+			zap.String("path", path),
+			zap.Int("attempt", attempt+1),
+			zap.Duration("delay", w.conf.ArchiveRetryDelay),
+			zap.Error(err),
+		)
+
+		select {
+		case <-time.After(w.conf.ArchiveRetryDelay):
+		case <-w.closing:
+			return fmt.Errorf("%w %q: WAL is already closed", ErrArchiveFailed, path)
+		}
+	}
+}
+
+func (w *WAL) archiveAttempt(s SealedSegment) error {
+	f, err := w.openSegmentFile(s.Path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	return w.archiver.Archive(s, io.LimitReader(f, s.Size))
+}
+
+// sealedSegment reads the segment at the given path to determine its offsets
+// and checksum.
+func (w *WAL) sealedSegment(path string) (SealedSegment, error) {
+	id, err := parseSegmentID(path)
+	if err != nil {
+		return SealedSegment{}, err
+	}
+
+	info, err := w.inspectSegment(path, id)
+	if err != nil {
+		return SealedSegment{}, err
+	}
+
+	f, err := w.openSegmentFile(path)
+	if err != nil {
+		return SealedSegment{}, err
+	}
+
+	defer f.Close()
+
+	h := crc32.NewIEEE()
+	if _, err := io.CopyN(h, f, info.end); err != nil {
+		return SealedSegment{}, err
+	}
+
+	return SealedSegment{
+		Path:        path,
+		SegmentID:   id,
+		FirstOffset: info.firstOffset,
+		LastOffset:  info.lastOffset,
+		Size:        info.end,
+		Checksum:    h.Sum32(),
+	}, nil
+}
+
+// isCompressed returns whether the segment at the given path is compressed.
+func isCompressed(path string) bool {
+	return strings.HasSuffix(path, compressedSuffix)
+}
+
+// openSegmentFile opens the segment at the given path for reading and
+// transparently decompresses it if necessary.
+func (w *WAL) openSegmentFile(path string) (io.ReadCloser, error) {
+	f, err := w.fs.OpenFile(path, os.O_RDONLY, 0)
+	if errors.Is(err, os.ErrNotExist) && !isCompressed(path) {
+		// The segment might have been compressed concurrently (e.g. during
+		// WAL.Replay(…)), which removes the original segment file.
+		path += compressedSuffix
+		f, err = w.fs.OpenFile(path, os.O_RDONLY, 0)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !isCompressed(path) {
+		return f, nil
+	}
+
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("decompressing segment: %w", err)
+	}
+
+	return &gzipFile{Reader: r, f: f}, nil
+}
+
+// gzipFile closes both the gzip.Reader and the underlying file.
+type gzipFile struct {
+	*gzip.Reader
+	f File
+}
+
+func (g *gzipFile) Close() error {
+	err := g.Reader.Close()
+	if closeErr := g.f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// DirArchiver is an Archiver which copies segments into a directory. Since the
+// archived segment files keep their names, the archive directory can be opened
+// as a read-only WAL in order to restore archived entries:
+//
+//	archive, err := wal.Open(archiveDir, registry, logger, wal.ReadOnly())
+//	…
+//	err = archive.Replay(0, func(offset uint32, e wal.Entry) error { … })
+type DirArchiver struct {
+	Dir      string // the archive directory, which is created if it does not exist yet
+	Compress bool   // compress archived segments using gzip
+	FS       FS     // the file system of the archive directory, defaults to the OSFS
+}
+
+// Archive implements the Archiver interface.
+func (a *DirArchiver) Archive(s SealedSegment, r io.Reader) error {
+	fs := a.FS
+	if fs == nil {
+		fs = OSFS{}
+	}
+
+	if err := fs.MkdirAll(a.Dir); err != nil {
+		return err
+	}
+
+	name := filepath.Base(s.Path)
+	if a.Compress && !isCompressed(name) {
+		name += compressedSuffix
+	}
+
+	// Write to a temporary file first, so we never leave an incomplete
+	// segment in the archive.
+	path := filepath.Join(a.Dir, name)
+	tmp := path + ".tmp"
+	f, err := fs.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+
+	// The reader always returns the uncompressed segment.
+	err = a.write(f, s, r, isCompressed(name))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = fs.Rename(tmp, path)
+	}
+
+	if err != nil {
+		_ = fs.Remove(tmp)
+		return err
+	}
+
+	return fs.SyncDir(a.Dir)
+}
+
+func (*DirArchiver) write(f File, s SealedSegment, r io.Reader, compress bool) error {
+	var (
+		w  io.Writer = f
+		gz *gzip.Writer
+	)
+
+	if compress {
+		gz = gzip.NewWriter(f)
+		w = gz
+	}
+
+	h := crc32.NewIEEE()
+	n, err := io.Copy(io.MultiWriter(w, h), r)
+	if err != nil {
+		return err
+	}
+
+	if n != s.Size || h.Sum32() != s.Checksum {
+		return fmt.Errorf("archived segment does not match its checksum %08x", s.Checksum)
+	}
+
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return err
+		}
+	}
+
+	return f.Sync()
+}
@@ -0,0 +1,241 @@
+package wal_test
+
+import (
+	"errors"
+	"hash/crc32"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fgrosse/wal"
+	"github.com/fgrosse/wal/waltest"
+	"github.com/fgrosse/zaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL_Archiver(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		name := "uncompressed"
+		if compress {
+			name = "compressed"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			fs := waltest.NewMemFS()
+			logger := zaptest.Logger(t)
+			conf := wal.DefaultConfiguration()
+			conf.MaxSegmentSize = 60 // two entries per segment
+
+			archiver := &recordingArchiver{Archiver: &wal.DirArchiver{Dir: "/archive", Compress: compress, FS: fs}}
+			w, err := wal.New("/wal", conf, waltest.ExampleEntries, logger, wal.WithFS(fs), wal.WithArchiver(archiver))
+			require.NoError(t, err)
+
+			var expected []wal.Entry
+			for i := 1; i <= 7; i++ {
+				e := &waltest.ExampleEntry1{ID: uint32(i), Point: []float32{1, 2}}
+				expected = append(expected, e)
+
+				_, err := w.Write(e)
+				require.NoError(t, err)
+			}
+
+			content, err := fs.ReadFile("/wal/1.wal")
+			require.NoError(t, err)
+
+			require.NoError(t, w.TruncateFront(5))
+			require.NoError(t, w.Close())
+
+			require.Len(t, archiver.archived(), 2)
+			assert.Equal(t, wal.SealedSegment{
+				Path:        "/wal/1.wal",
+				SegmentID:   1,
+				FirstOffset: 1,
+				LastOffset:  2,
+				Size:        int64(len(content)),
+				Checksum:    crc32.ChecksumIEEE(content),
+			}, archiver.archived()[0])
+			assert.EqualValues(t, 3, archiver.archived()[1].FirstOffset)
+			assert.EqualValues(t, 4, archiver.archived()[1].LastOffset)
+
+			names, err := fs.List("/archive")
+			require.NoError(t, err)
+			if compress {
+				assert.Equal(t, []string{"1.wal.gz", "2.wal.gz"}, names)
+			} else {
+				assert.Equal(t, []string{"1.wal", "2.wal"}, names)
+			}
+
+			t.Log("The archive directory can be replayed as a read-only WAL")
+			archive, err := wal.Open("/archive", waltest.ExampleEntries, logger, wal.WithFS(fs), wal.ReadOnly())
+			require.NoError(t, err)
+			assert.EqualValues(t, 4, archive.Offset())
+
+			var actual []wal.Entry
+			err = archive.Replay(0, func(_ uint32, e wal.Entry) error {
+				actual = append(actual, e)
+				return nil
+			})
+			require.NoError(t, err)
+			assert.Equal(t, expected[:4], actual)
+		})
+	}
+}
+
+func TestWAL_Archiver_Retry(t *testing.T) {
+	fs := waltest.NewMemFS()
+	conf := wal.DefaultConfiguration()
+	conf.MaxSegmentSize = 60 // two entries per segment
+	conf.ArchiveRetries = 2
+	conf.ArchiveRetryDelay = 0
+
+	archiver := &recordingArchiver{failures: 2}
+	w, err := wal.New("/wal", conf, waltest.ExampleEntries, zaptest.Logger(t), wal.WithFS(fs), wal.WithArchiver(archiver))
+	require.NoError(t, err)
+
+	for i := 1; i <= 5; i++ {
+		_, err := w.Write(&waltest.ExampleEntry1{ID: uint32(i), Point: []float32{1, 2}})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, w.TruncateFront(3))
+	require.Len(t, archiver.archived(), 1)
+
+	t.Log("Segments must not be deleted if archiving fails repeatedly")
+	archiver.fail(3)
+	err = w.TruncateFront(5)
+	assert.ErrorIs(t, err, wal.ErrArchiveFailed)
+	assert.NoError(t, w.Err())
+
+	names, err := fs.List("/wal")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2.wal", "3.wal"}, names)
+
+	require.NoError(t, w.Close())
+}
+
+func TestWAL_Archiver_Background(t *testing.T) {
+	fs := waltest.NewMemFS()
+	conf := wal.DefaultConfiguration()
+	conf.MaxSegmentSize = 60 // two entries per segment
+
+	archiver := &recordingArchiver{blocked: make(chan struct{})}
+	w, err := wal.New("/wal", conf, waltest.ExampleEntries, zaptest.Logger(t), wal.WithFS(fs), wal.WithArchiver(archiver))
+	require.NoError(t, err)
+
+	for i := 1; i <= 5; i++ {
+		_, err := w.Write(&waltest.ExampleEntry1{ID: uint32(i), Point: []float32{1, 2}})
+		require.NoError(t, err)
+	}
+
+	truncated := make(chan error, 1)
+	go func() { truncated <- w.TruncateFront(5) }()
+
+	t.Log("The WAL must accept writes while segments are being archived")
+	for i := 6; i <= 9; i++ {
+		_, err := w.Write(&waltest.ExampleEntry1{ID: uint32(i), Point: []float32{1, 2}})
+		require.NoError(t, err)
+	}
+
+	names, err := fs.List("/wal")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.wal", "2.wal", "3.wal", "4.wal", "5.wal"}, names, "segments must only be deleted after they were archived")
+
+	close(archiver.blocked)
+	require.NoError(t, <-truncated)
+	assert.Len(t, archiver.archived(), 2)
+
+	names, err = fs.List("/wal")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"3.wal", "4.wal", "5.wal"}, names)
+
+	require.NoError(t, w.Close())
+}
+
+func TestWAL_Archiver_FullPolicyDeleteOldest(t *testing.T) {
+	fs := waltest.NewMemFS()
+	conf := wal.DefaultConfiguration()
+	conf.MaxSegmentSize = 60 // two entries per segment
+	conf.MaxSegments = 2
+	conf.FullPolicy = wal.FullPolicyDeleteOldest
+
+	archiver := &recordingArchiver{blocked: make(chan struct{})}
+	w, err := wal.New("/wal", conf, waltest.ExampleEntries, zaptest.Logger(t), wal.WithFS(fs), wal.WithArchiver(archiver))
+	require.NoError(t, err)
+
+	for i := 1; i <= 4; i++ {
+		_, err := w.Write(&waltest.ExampleEntry1{ID: uint32(i), Point: []float32{1, 2}})
+		require.NoError(t, err)
+	}
+
+	w.SetCheckpoint(2)
+
+	t.Log("Writes must be rejected instead of waiting for the Archiver")
+	_, err = w.Write(&waltest.ExampleEntry1{ID: 5, Point: []float32{1, 2}})
+	assert.ErrorIs(t, err, wal.ErrLogFull)
+	assert.NoError(t, w.Err())
+
+	close(archiver.blocked)
+	assert.Eventually(t, func() bool {
+		_, err := w.Write(&waltest.ExampleEntry1{ID: 5, Point: []float32{1, 2}})
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	names, err := fs.List("/wal")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2.wal", "3.wal"}, names)
+	assert.Len(t, archiver.archived(), 1)
+
+	require.NoError(t, w.Close())
+}
+
+// recordingArchiver is a wal.Archiver that records all archived segments and
+// optionally fails a given number of times or blocks until a channel is closed.
+type recordingArchiver struct {
+	wal.Archiver
+	blocked chan struct{}
+
+	mu       sync.Mutex
+	failures int
+	segments []wal.SealedSegment
+}
+
+func (a *recordingArchiver) Archive(s wal.SealedSegment, r io.Reader) error {
+	if a.blocked != nil {
+		<-a.blocked
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.failures > 0 {
+		a.failures--
+		return errors.New("archive is not available")
+	}
+
+	var err error
+	if a.Archiver != nil {
+		err = a.Archiver.Archive(s, r)
+	}
+
+	if err == nil {
+		a.segments = append(a.segments, s)
+	}
+
+	return err
+}
+
+func (a *recordingArchiver) fail(n int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.failures = n
+}
+
+func (a *recordingArchiver) archived() []wal.SealedSegment {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return append([]wal.SealedSegment(nil), a.segments...)
+}
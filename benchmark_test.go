@@ -1,8 +1,12 @@
 package wal_test
 
 import (
+	"bytes"
+	"compress/flate"
+	"fmt"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -14,6 +18,9 @@ import (
 
 var exampleBenchmarkEntries [1000]*waltest.ExampleEntry1
 
+// jsonBenchmarkEntries contain JSON-ish payloads which compress well.
+var jsonBenchmarkEntries [1000]*waltest.ExampleEntry2
+
 func init() {
 	seed := time.Now().UnixMilli()
 	rng := rand.New(rand.NewSource(seed))
@@ -23,6 +30,15 @@ func init() {
 			Point: []float32{rng.Float32() * 10, rng.Float32() * 10},
 		}
 	}
+
+	for i := range jsonBenchmarkEntries {
+		var name []byte
+		for j := 0; j < 20; j++ {
+			name = fmt.Appendf(name, `{"id":%d,"name":"user-%d","active":%t},`, i*20+j, rng.Intn(100), rng.Intn(2) == 0)
+		}
+
+		jsonBenchmarkEntries[i] = &waltest.ExampleEntry2{Name: string(name)}
+	}
 }
 
 func BenchmarkWAL_Write(b *testing.B) {
@@ -39,15 +55,158 @@ func BenchmarkWAL_Write(b *testing.B) {
 }
 
 func BenchmarkSegmentReader_SeekEnd(b *testing.B) {
-	for i := 0; i < b.N; i++ {
-		f, err := os.Open("testdata/segment.wal")
-		require.NoError(b, err)
-		b.Cleanup(func() { _ = f.Close() })
+	// Records of the legacy format must be read via their Entry, but they are
+	// read into a reused buffer.
+	b.Run("legacy", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			f, err := os.Open("testdata/segment.wal")
+			require.NoError(b, err)
+			b.Cleanup(func() { _ = f.Close() })
+
+			r, err := wal.NewSegmentReader(f, waltest.ExampleEntries)
+			require.NoError(b, err)
 
-		r, err := wal.NewSegmentReader(f, waltest.ExampleEntries)
+			_, err = r.SeekEnd()
+			require.NoError(b, err)
+		}
+	})
+
+	// Records which store their length are skipped without reading their
+	// payloads into memory.
+	fs := waltest.NewMemFS()
+	conf := wal.DefaultConfiguration()
+	conf.RecordLengths = true
+	w, err := wal.Open("/wal", waltest.ExampleEntries, zap.NewNop(), wal.WithFS(fs), wal.WithConfiguration(conf))
+	require.NoError(b, err)
+	for i := 0; i < 5000; i++ {
+		_, err := w.Write(jsonBenchmarkEntries[i%len(jsonBenchmarkEntries)])
 		require.NoError(b, err)
+	}
+	require.NoError(b, w.Close())
+
+	content, err := fs.ReadFile("/wal/1.wal")
+	require.NoError(b, err)
+
+	for _, verify := range []bool{false, true} {
+		name := "record-lengths"
+		if verify {
+			name = "record-lengths-verify"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(content)))
+			for i := 0; i < b.N; i++ {
+				r, err := wal.NewSegmentReader(bytes.NewReader(content), waltest.ExampleEntries)
+				require.NoError(b, err)
+				r.SetVerifyOnSeek(verify)
+
+				_, err = r.SeekEnd()
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+func BenchmarkWAL_Write_Compression(b *testing.B) {
+	codecs := []struct {
+		name  string
+		level int
+	}{
+		{name: "none"},
+		{name: "flate-best-speed", level: flate.BestSpeed},
+		{name: "flate-default", level: flate.DefaultCompression},
+		{name: "flate-best-compression", level: flate.BestCompression},
+	}
+
+	for _, c := range codecs {
+		b.Run(c.name, func(b *testing.B) {
+			// Use the MemFS, so we only benchmark the CPU overhead of the
+			// compression and not the disk.
+			fs := waltest.NewMemFS()
+			opts := []wal.Option{wal.WithFS(fs)}
+			if c.level != 0 {
+				codec, err := wal.NewFlateCodec(c.level)
+				require.NoError(b, err)
+				opts = append(opts, wal.WithCompression(codec))
+			}
+
+			w, err := wal.Open("/wal", waltest.ExampleEntries, zap.NewNop(), opts...)
+			require.NoError(b, err)
+
+			var payloadSize int
+			for _, e := range jsonBenchmarkEntries {
+				payloadSize += len(e.EncodePayload(nil))
+			}
+			b.SetBytes(int64(payloadSize / len(jsonBenchmarkEntries)))
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				e := jsonBenchmarkEntries[i%len(jsonBenchmarkEntries)]
+				_, _ = w.Write(e)
+			}
+
+			b.StopTimer()
+			require.NoError(b, w.Close())
+
+			b.ReportMetric(float64(segmentsSize(b, fs))/float64(b.N), "disk-B/entry")
+		})
+	}
+}
+
+func BenchmarkSegmentReader_Decode_Compression(b *testing.B) {
+	for _, compress := range []bool{false, true} {
+		name := "none"
+		if compress {
+			name = "flate-default"
+		}
 
-		_, err = r.SeekEnd()
+		b.Run(name, func(b *testing.B) {
+			fs := waltest.NewMemFS()
+			opts := []wal.Option{wal.WithFS(fs)}
+			if compress {
+				opts = append(opts, wal.WithCompression(new(wal.FlateCodec)))
+			}
+
+			w, err := wal.Open("/wal", waltest.ExampleEntries, zap.NewNop(), opts...)
+			require.NoError(b, err)
+			for _, e := range jsonBenchmarkEntries {
+				_, err := w.Write(e)
+				require.NoError(b, err)
+			}
+			require.NoError(b, w.Close())
+
+			content, err := fs.ReadFile("/wal/1.wal")
+			require.NoError(b, err)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r, err := wal.NewSegmentReader(bytes.NewReader(content), waltest.ExampleEntries)
+				require.NoError(b, err)
+
+				for r.ReadNext() {
+					_, err := r.Decode()
+					require.NoError(b, err)
+				}
+
+				require.NoError(b, r.Err())
+			}
+		})
+	}
+}
+
+// segmentsSize returns the total size of all segment files of the WAL.
+func segmentsSize(b *testing.B, fs *waltest.MemFS) int {
+	names, err := fs.List("/wal")
+	require.NoError(b, err)
+
+	var size int
+	for _, name := range names {
+		content, err := fs.ReadFile(filepath.Join("/wal", name))
 		require.NoError(b, err)
+		size += len(content)
 	}
+
+	return size
 }
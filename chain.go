@@ -0,0 +1,249 @@
+package wal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// ErrChainBroken is returned by WAL.Verify() if the hash chain of the WAL is
+// broken, i.e. because records have been modified, reordered or removed.
+var ErrChainBroken = errors.New("WAL hash chain is broken")
+
+// hashChain links each record to its predecessor by computing a SHA-256 (or
+// HMAC-SHA256 if a key is configured) over the hash of the previous record and
+// the contents of the record itself.
+type hashChain struct {
+	mac    hash.Hash
+	signed bool
+	head   [sha256.Size]byte // hash of the last record
+	synced [sha256.Size]byte // head as of the last successful sync
+}
+
+func newHashChain(key []byte) *hashChain {
+	if key == nil {
+		return &hashChain{mac: sha256.New()}
+	}
+
+	return &hashChain{mac: hmac.New(sha256.New, key), signed: true}
+}
+
+// link computes the hash of the record at the given offset, which follows the
+// current head of the chain. It does not modify the head.
+func (c *hashChain) link(offset uint32, rec record) [sha256.Size]byte {
+	rec.chained = true
+
+	var buf [4 + 1 + 2 + 1 + 4 + 1 + 8 + 2]byte
+	b := binary.BigEndian.AppendUint32(buf[:0], offset)
+	b = append(b, rec.flags())
+	b = rec.appendType(b)
+	b = append(b, byte(rec.codec))
+	b = binary.BigEndian.AppendUint32(b, uint32(rec.keyID))
+	b = rec.appendMetadataPrefix(b)
+
+	c.mac.Reset()
+	c.mac.Write(c.head[:])
+	c.mac.Write(b)
+	c.mac.Write(rec.headers)
+	c.mac.Write(rec.payload)
+
+	var sum [sha256.Size]byte
+	c.mac.Sum(sum[:0])
+	return sum
+}
+
+// ChainHead returns the offset and hash of the last record of the hash chain
+// that was synced to disk. Applications can store the head outside of the WAL
+// (e.g. in a database) and later pass it to WAL.Verify(…) via ExpectHead(…) in
+// order to detect that records have been removed from the end of the log or
+// that the entire log was rewritten. If hash chaining is disabled or nothing
+// was written yet, ChainHead returns zero values.
+func (w *WAL) ChainHead() (offset uint32, hash [sha256.Size]byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.chain == nil {
+		return 0, hash
+	}
+
+	return w.syncedOffset, w.chain.synced
+}
+
+// A VerifyOption passes a known state of the hash chain to WAL.Verify(…).
+type VerifyOption func(*chainVerifier)
+
+// ExpectHead makes WAL.Verify(…) check that the log still contains the record
+// at the given offset and that it has the given hash, as it was returned by
+// WAL.ChainHead() at an earlier point in time. Without it, records which have
+// been removed from the end of the log cannot be detected.
+func ExpectHead(offset uint32, hash [sha256.Size]byte) VerifyOption {
+	return func(v *chainVerifier) {
+		v.head = &chainPosition{offset: offset, hash: hash}
+	}
+}
+
+// ExpectAnchor makes WAL.Verify(…) check that the first segment of the log
+// starts right after the given offset and that its anchor matches the given
+// hash of the record at that offset. A chain which was never truncated starts
+// at offset zero with a zero hash. Without it, segments which have been
+// removed from the front of the log cannot be detected.
+func ExpectAnchor(offset uint32, hash [sha256.Size]byte) VerifyOption {
+	return func(v *chainVerifier) {
+		v.anchor = &chainPosition{offset: offset, hash: hash}
+	}
+}
+
+// chainPosition is the hash of the record at an offset of the hash chain.
+type chainPosition struct {
+	offset uint32
+	hash   [sha256.Size]byte
+}
+
+// chainVerifier keeps track of the hash chain across all segments that are
+// verified by WAL.Verify(…).
+type chainVerifier struct {
+	chain      *hashChain
+	nextOffset uint32 // offset of the next record that is expected
+	lastOffset uint32 // offset of the last record of the log
+	head       *chainPosition
+	anchor     *chainPosition
+	headFound  bool // whether the expected head was verified
+}
+
+// checkHead verifies the hash of the record at the given offset, if it is the
+// expected head of the chain.
+func (v *chainVerifier) checkHead(offset uint32, hash [sha256.Size]byte) error {
+	if v.head == nil || v.head.offset != offset {
+		return nil
+	}
+
+	if v.head.hash != hash {
+		return fmt.Errorf("%w: record at WAL offset %d does not match the expected head", ErrChainBroken, offset)
+	}
+
+	v.headFound = true
+	return nil
+}
+
+// Verify reads all segments of the WAL and checks that their hash chain is
+// intact. This proves that no records have been modified, reordered or
+// removed from the middle of the log since they have been written. By default,
+// the chain starts at the anchor of the first segment, so segments can still
+// be removed from the front of the log, e.g. via WAL.TruncateFront(…).
+//
+// Since the chain is read from the same files that are verified, removing
+// segments from the front or records from the end of the log, as well as
+// rewriting the entire log, can only be detected if the expected state of
+// the chain is passed via ExpectHead(…) and ExpectAnchor(…).
+//
+// If the hash chain was signed with a key, the same key must be passed to
+// WithHashChain(…) when opening the WAL that is verified. All segments must
+// have been written with the hash chain enabled. Otherwise, or if the chain is
+// broken, an error wrapping ErrChainBroken is returned.
+func (w *WAL) Verify(opts ...VerifyOption) error {
+	w.mu.Lock()
+	if !w.isClosed() {
+		w.sync() // make sure all written entries are visible to the segment reader
+	}
+	lastOffset := w.lastOffset
+	w.mu.Unlock()
+
+	segments, err := segmentFileNames(w.fs, w.path)
+	if err != nil {
+		return fmt.Errorf("checking existing segment files: %w", err)
+	}
+
+	v := &chainVerifier{chain: newHashChain(w.chainKey), lastOffset: lastOffset}
+	for _, opt := range opts {
+		opt(v)
+	}
+
+	for i, path := range segments {
+		if err := w.verifySegment(path, v, i == 0); err != nil {
+			return fmt.Errorf("verifying segment %q: %w", path, err)
+		}
+	}
+
+	if len(segments) > 0 && v.nextOffset != lastOffset+1 {
+		return fmt.Errorf("%w: log ends at offset %d instead of %d", ErrChainBroken, v.nextOffset-1, lastOffset)
+	}
+
+	switch {
+	case v.anchor != nil && len(segments) == 0 && v.anchor.offset != lastOffset:
+		return fmt.Errorf("%w: log does not contain any segments", ErrChainBroken)
+	case v.head == nil || v.headFound:
+		return nil
+	case v.head.offset == 0 && v.head.hash == [sha256.Size]byte{}:
+		return nil // the chain was empty
+	case v.head.offset > lastOffset:
+		return fmt.Errorf("%w: log ends at offset %d before the expected head at offset %d", ErrChainBroken, lastOffset, v.head.offset)
+	default:
+		return fmt.Errorf("%w: expected head at offset %d is not part of the log anymore", ErrChainBroken, v.head.offset)
+	}
+}
+
+// verifySegment verifies the hash chain of a single segment and advances the
+// verifier to the first offset that is expected in the following segment.
+func (w *WAL) verifySegment(path string, v *chainVerifier, first bool) error {
+	f, err := w.openSegmentFile(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	r, err := NewSegmentReader(f, w.registry)
+	if err != nil {
+		return err
+	}
+
+	r.raw = true // the chain can be verified without decoding the entries
+	r.SetReuseEntries(true)
+
+	h, ok := r.Header()
+	switch {
+	case !ok || !h.Chained:
+		return fmt.Errorf("%w: segment is not hash chained", ErrChainBroken)
+	case h.Signed != v.chain.signed:
+		return fmt.Errorf("%w: segment was signed with a key: %t, but verifying with a key: %t", ErrChainBroken, h.Signed, v.chain.signed)
+	case first && v.anchor != nil && (h.FirstOffset != v.anchor.offset+1 || h.Anchor != v.anchor.hash):
+		return fmt.Errorf("%w: log does not start after the expected anchor at offset %d", ErrChainBroken, v.anchor.offset)
+	case first:
+		v.chain.head = h.Anchor
+		if err := v.checkHead(h.FirstOffset-1, h.Anchor); err != nil {
+			return err
+		}
+	case h.FirstOffset != v.nextOffset:
+		return fmt.Errorf("%w: segment starts at offset %d instead of %d", ErrChainBroken, h.FirstOffset, v.nextOffset)
+	case h.Anchor != v.chain.head:
+		return fmt.Errorf("%w: anchor does not match the last record of the previous segment", ErrChainBroken)
+	}
+
+	v.nextOffset = h.FirstOffset
+	for v.nextOffset <= v.lastOffset && r.ReadNext() {
+		if r.Err() != nil {
+			break
+		}
+
+		rec := r.record()
+		if !rec.chained {
+			return fmt.Errorf("%w: record at WAL offset %d is not hash chained", ErrChainBroken, r.Offset())
+		}
+
+		if !r.validChecksum() || v.chain.link(r.Offset(), rec) != rec.hash {
+			return fmt.Errorf("%w: record at WAL offset %d was modified", ErrChainBroken, r.Offset())
+		}
+
+		if err := v.checkHead(r.Offset(), rec.hash); err != nil {
+			return err
+		}
+
+		v.chain.head = rec.hash
+		v.nextOffset++
+	}
+
+	return r.Err()
+}
@@ -0,0 +1,202 @@
+package wal_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"testing"
+
+	"github.com/fgrosse/wal"
+	"github.com/fgrosse/wal/waltest"
+	"github.com/fgrosse/zaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL_Verify(t *testing.T) {
+	for _, key := range [][]byte{nil, []byte("secret")} {
+		name := "sha256"
+		if key != nil {
+			name = "hmac"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			fs := waltest.NewMemFS()
+			logger := zaptest.Logger(t)
+			conf := wal.DefaultConfiguration()
+			conf.MaxSegmentSize = 200
+
+			open := func(opts ...wal.Option) *wal.WAL {
+				opts = append([]wal.Option{wal.WithFS(fs), wal.WithConfiguration(conf)}, opts...)
+				w, err := wal.Open("/wal", waltest.ExampleEntries, logger, opts...)
+				require.NoError(t, err)
+				return w
+			}
+
+			w := open(wal.WithHashChain(key))
+			for i := 1; i <= 5; i++ {
+				_, err := w.Write(&waltest.ExampleEntry2{Name: fmt.Sprintf("entry-%03d-xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx", i)})
+				require.NoError(t, err)
+			}
+
+			require.NoError(t, w.Verify())
+			require.NoError(t, w.Close())
+
+			t.Log("The chain should continue after the WAL was opened again")
+			w = open(wal.WithHashChain(key))
+			for i := 6; i <= 10; i++ {
+				_, err := w.Write(&waltest.ExampleEntry2{Name: fmt.Sprintf("entry-%03d-xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx", i)})
+				require.NoError(t, err)
+			}
+
+			require.NoError(t, w.Verify())
+
+			t.Log("Removing segments from the front should not break the chain")
+			require.NoError(t, w.TruncateFront(4))
+			require.NoError(t, w.Verify())
+			require.NoError(t, w.Close())
+
+			names, err := fs.List("/wal")
+			require.NoError(t, err)
+			require.Equal(t, []string{"2.wal", "3.wal", "4.wal", "5.wal"}, names)
+
+			t.Log("The chain cannot be verified with the wrong key")
+			r := open(wal.ReadOnly(), wal.WithHashChain([]byte("wrong")))
+			assert.ErrorIs(t, r.Verify(), wal.ErrChainBroken)
+
+			t.Log("Modifying a record should break the chain")
+			original, err := fs.ReadFile("/wal/4.wal")
+			require.NoError(t, err)
+			require.NoError(t, fs.WriteFile("/wal/4.wal", modifyRecord(t, original, "entry-007", "entry-070")))
+			r = open(wal.ReadOnly(), wal.WithHashChain(key))
+			assert.ErrorIs(t, r.Verify(), wal.ErrChainBroken)
+
+			t.Log("Removing a segment in the middle should break the chain")
+			require.NoError(t, fs.WriteFile("/wal/4.wal", original))
+			r = open(wal.ReadOnly(), wal.WithHashChain(key))
+			require.NoError(t, r.Verify())
+			require.NoError(t, fs.Remove("/wal/3.wal"))
+			r = open(wal.ReadOnly(), wal.WithHashChain(key))
+			assert.ErrorIs(t, r.Verify(), wal.ErrChainBroken)
+		})
+	}
+}
+
+func TestWAL_Verify_ExpectedHead(t *testing.T) {
+	fs := waltest.NewMemFS()
+	logger := zaptest.Logger(t)
+	conf := wal.DefaultConfiguration()
+	conf.MaxSegmentSize = 200
+
+	open := func(dir string, opts ...wal.Option) *wal.WAL {
+		opts = append([]wal.Option{wal.WithFS(fs), wal.WithConfiguration(conf), wal.WithHashChain(nil)}, opts...)
+		w, err := wal.Open(dir, waltest.ExampleEntries, logger, opts...)
+		require.NoError(t, err)
+		return w
+	}
+
+	write := func(dir, prefix string) (uint32, [32]byte) {
+		w := open(dir)
+		for i := 1; i <= 6; i++ {
+			_, err := w.Write(&waltest.ExampleEntry2{Name: fmt.Sprintf("%s-%03d-xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx", prefix, i)})
+			require.NoError(t, err)
+		}
+
+		offset, head := w.ChainHead()
+		require.NoError(t, w.Close())
+		return offset, head
+	}
+
+	offset, head := write("/wal", "entry")
+	assert.EqualValues(t, 6, offset)
+	expected := []wal.VerifyOption{wal.ExpectHead(offset, head), wal.ExpectAnchor(0, [32]byte{})}
+
+	names, err := fs.List("/wal")
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.wal", "2.wal", "3.wal"}, names)
+
+	w := open("/wal", wal.ReadOnly())
+	require.NoError(t, w.Verify(expected...))
+
+	t.Log("A head with another hash should break the chain")
+	assert.ErrorIs(t, w.Verify(wal.ExpectHead(offset, [32]byte{1})), wal.ErrChainBroken)
+
+	t.Log("Removing the last record should only be detected with the expected head")
+	original, err := fs.ReadFile("/wal/3.wal")
+	require.NoError(t, err)
+	last := bytes.Index(original, []byte("entry-006")) - 3 - 47 // payload prefix and record header
+	require.NoError(t, fs.WriteFile("/wal/3.wal", original[:last]))
+	w = open("/wal", wal.ReadOnly())
+	require.NoError(t, w.Verify())
+	assert.ErrorIs(t, w.Verify(expected...), wal.ErrChainBroken)
+
+	t.Log("Removing the last segment should only be detected with the expected head")
+	require.NoError(t, fs.Remove("/wal/3.wal"))
+	w = open("/wal", wal.ReadOnly())
+	require.NoError(t, w.Verify())
+	assert.ErrorIs(t, w.Verify(expected...), wal.ErrChainBroken)
+	require.NoError(t, fs.WriteFile("/wal/3.wal", original))
+
+	t.Log("Removing the first segment should only be detected with the expected anchor")
+	first, err := fs.ReadFile("/wal/1.wal")
+	require.NoError(t, err)
+	require.NoError(t, fs.Remove("/wal/1.wal"))
+	w = open("/wal", wal.ReadOnly())
+	require.NoError(t, w.Verify())
+	require.NoError(t, w.Verify(wal.ExpectHead(offset, head)))
+	assert.ErrorIs(t, w.Verify(expected...), wal.ErrChainBroken)
+	require.NoError(t, fs.WriteFile("/wal/1.wal", first))
+
+	t.Log("Rewriting the entire log should be detected with the expected head")
+	write("/rewritten", "forged")
+	w = open("/rewritten", wal.ReadOnly())
+	require.NoError(t, w.Verify(wal.ExpectAnchor(0, [32]byte{})))
+	assert.ErrorIs(t, w.Verify(expected...), wal.ErrChainBroken)
+}
+
+func TestWAL_Verify_Unchained(t *testing.T) {
+	fs := waltest.NewMemFS()
+	logger := zaptest.Logger(t)
+
+	w, err := wal.Open("/wal", waltest.ExampleEntries, logger, wal.WithFS(fs))
+	require.NoError(t, err)
+	_, err = w.Write(&waltest.ExampleEntry2{Name: "unchained"})
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	t.Log("Enabling the hash chain should start a new segment")
+	w, err = wal.Open("/wal", waltest.ExampleEntries, logger, wal.WithFS(fs), wal.WithHashChain(nil))
+	require.NoError(t, err)
+	_, err = w.Write(&waltest.ExampleEntry2{Name: "chained"})
+	require.NoError(t, err)
+
+	names, err := fs.List("/wal")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.wal", "2.wal"}, names)
+
+	assert.ErrorIs(t, w.Verify(), wal.ErrChainBroken, "the first segment is not chained")
+	require.NoError(t, w.TruncateFront(2))
+	assert.NoError(t, w.Verify())
+	require.NoError(t, w.Close())
+}
+
+// modifyRecord replaces old with new in the name of a chained ExampleEntry2
+// and updates the checksum of the record, as an attacker would do.
+func modifyRecord(t *testing.T, segment []byte, old, new string) []byte {
+	result := bytes.Replace(segment, []byte(old), []byte(new), 1)
+	require.NotEqual(t, segment, result)
+
+	// The payload starts with 1B Test flag + 2B name length and the record
+	// header consists of 4B offset + 1B 0xFF + 4B CRC + 1B flags + 1B type +
+	// 4B length + 32B hash.
+	payloadStart := bytes.Index(result, []byte(new)) - 3
+	start := payloadStart - 47
+	require.EqualValues(t, 0xFF, result[start+4])
+
+	length := int(binary.BigEndian.Uint32(result[start+11:]))
+	payload := result[payloadStart : payloadStart+length]
+	binary.BigEndian.PutUint32(result[start+5:], crc32.ChecksumIEEE(payload))
+
+	return result
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"strconv"
+	"strings"
+)
+
+// generator writes formatted Go source code.
+type generator struct {
+	buf bytes.Buffer
+}
+
+func (g *generator) printf(format string, args ...any) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+func (g *generator) source() ([]byte, error) {
+	src, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("formatting generated code: %w\n%s", err, g.buf.Bytes())
+	}
+
+	return src, nil
+}
+
+// testFileName returns the name of the generated test file for the given
+// output file.
+func testFileName(output string) string {
+	return strings.TrimSuffix(output, ".go") + "_test.go"
+}
+
+// generateEntries generates the Entry implementations of all annotated
+// structs of the package.
+func generateEntries(p *pkg) ([]byte, error) {
+	g := new(generator)
+	g.printf("// Code generated by walgen. DO NOT EDIT.\n\n")
+	g.printf("package %s\n\n", p.name)
+	g.printf("import (\n")
+	g.printf("%q\n%q\n%q\n%q\n\n", "encoding/binary", "fmt", "io", "math")
+	g.printf("%q\n", "github.com/fgrosse/wal")
+	g.printf(")\n\n")
+
+	for _, e := range p.entries {
+		g.entry(e)
+	}
+
+	g.printf("%s", helpers)
+	return g.source()
+}
+
+func (g *generator) entry(e entry) {
+	g.printf("var (\n")
+	g.printf("_ wal.Entry = (*%s)(nil)\n", e.name)
+	g.printf("_ wal.EntryEncoder = (*%s)(nil)\n", e.name)
+	g.printf(")\n\n")
+
+	g.printf("// Type implements the wal.Entry interface.\n")
+	g.printf("func (*%s) Type() wal.EntryType { return %s }\n\n", e.name, e.entryType)
+
+	g.printf("// EncodePayload implements the wal.Entry interface. It panics if a string or\n")
+	g.printf("// slice is longer than math.MaxUint32.\n")
+	g.printf("func (e *%s) EncodePayload(b []byte) []byte {\n", e.name)
+	g.printf("b, err := e.TryEncodePayload(b)\n")
+	g.printf("if err != nil {\npanic(err)\n}\n\n")
+	g.printf("return b\n")
+	g.printf("}\n\n")
+
+	g.encode(e)
+	g.read(e)
+	g.decode(e)
+}
+
+func (g *generator) encode(e entry) {
+	variable := false
+	for _, f := range e.fields {
+		variable = variable || f.slice || f.elem.variable()
+	}
+
+	g.printf("// TryEncodePayload implements the wal.EntryEncoder interface.\n")
+	g.printf("func (e *%s) TryEncodePayload(b []byte) ([]byte, error) {\n", e.name)
+	if variable {
+		g.printf("var err error\n")
+	}
+
+	g.printf("b = b[:0]\n")
+	for _, f := range e.fields {
+		name := e.name + "." + f.name
+		if !f.slice {
+			g.encodeValue(name, f, "e."+f.name)
+			continue
+		}
+
+		g.printf("if b, err = walgenAppendLen(b, %q, len(e.%s)); err != nil {\nreturn b, err\n}\n", name, f.name)
+		g.printf("for _, v := range e.%s {\n", f.name)
+		g.encodeValue(name, f, "v")
+		g.printf("}\n")
+	}
+
+	g.printf("\nreturn b, nil\n")
+	g.printf("}\n\n")
+}
+
+func (g *generator) encodeValue(name string, f field, v string) {
+	switch t := f.elem.name; t {
+	case "bool":
+		g.printf("b = walgenAppendBool(b, %s)\n", convert(t, f.goType, v))
+	case "int8", "uint8", "byte":
+		g.printf("b = append(b, %s)\n", convert("uint8", f.goType, v))
+	case "int16", "uint16":
+		g.printf("b = binary.BigEndian.AppendUint16(b, %s)\n", convert("uint16", f.goType, v))
+	case "int32", "uint32", "rune":
+		g.printf("b = binary.BigEndian.AppendUint32(b, %s)\n", convert("uint32", f.goType, v))
+	case "float32":
+		g.printf("b = binary.BigEndian.AppendUint32(b, math.Float32bits(%s))\n", convert(t, f.goType, v))
+	case "int64", "uint64", "int", "uint":
+		g.printf("b = binary.BigEndian.AppendUint64(b, %s)\n", convert("uint64", f.goType, v))
+	case "float64":
+		g.printf("b = binary.BigEndian.AppendUint64(b, math.Float64bits(%s))\n", convert(t, f.goType, v))
+	case "string", "[]byte":
+		g.printf("if b, err = walgenAppendBytes(b, %q, %s); err != nil {\nreturn b, err\n}\n", name, convert(t, f.goType, v))
+	}
+}
+
+func (g *generator) read(e entry) {
+	g.printf("// ReadPayload implements the wal.Entry interface.\n")
+	g.printf("func (e *%s) ReadPayload(r io.Reader) ([]byte, error) {\n", e.name)
+	g.printf("return e.AppendPayload(nil, r)\n")
+	g.printf("}\n\n")
+
+	g.printf("// AppendPayload implements the wal.PayloadAppender interface.\n")
+	g.printf("func (*%s) AppendPayload(dst []byte, r io.Reader) ([]byte, error) {\n", e.name)
+	g.printf("rd := walgenReader{r: r, b: dst}\n")
+
+	// Consecutive fields of a fixed size are read at once.
+	var fixed []string
+	var fixedSize int
+	flush := func() {
+		if fixedSize > 0 {
+			g.printf("rd.read(%d) // %s\n", fixedSize, strings.Join(fixed, ", "))
+		}
+		fixed, fixedSize = nil, 0
+	}
+
+	for _, f := range e.fields {
+		switch {
+		case !f.slice && !f.elem.variable():
+			fixed = append(fixed, f.name)
+			fixedSize += f.elem.size
+		case !f.slice:
+			flush()
+			g.printf("rd.read(uint64(rd.uint32())) // %s\n", f.name)
+		case !f.elem.variable():
+			flush()
+			g.printf("rd.read(uint64(rd.uint32()) * %d) // %s\n", f.elem.size, f.name)
+		default:
+			flush()
+			g.printf("for n := rd.uint32(); n > 0 && rd.err == nil; n-- { // %s\n", f.name)
+			g.printf("rd.read(uint64(rd.uint32()))\n")
+			g.printf("}\n")
+		}
+	}
+
+	flush()
+	g.printf("\nreturn rd.b, rd.err\n")
+	g.printf("}\n\n")
+}
+
+func (g *generator) decode(e entry) {
+	g.printf("// DecodePayload implements the wal.Entry interface.\n")
+	g.printf("func (e *%s) DecodePayload(b []byte) error {\n", e.name)
+	g.printf("d := walgenDecoder{b: b}\n")
+	for _, f := range e.fields {
+		if !f.slice {
+			g.printf("e.%s = %s\n", f.name, decodeValue(f))
+			continue
+		}
+
+		minSize := f.elem.size
+		if f.elem.variable() {
+			minSize = 4 // length prefix
+		}
+
+		g.printf("e.%s = nil\n", f.name)
+		g.printf("if n := d.count(%d); n > 0 {\n", minSize)
+		g.printf("e.%s = make([]%s, n)\n", f.name, f.goType)
+		g.printf("for i := range e.%s {\n", f.name)
+		g.printf("e.%s[i] = %s\n", f.name, decodeValue(f))
+		g.printf("}\n")
+		g.printf("}\n")
+	}
+
+	g.printf("\nreturn d.finish()\n")
+	g.printf("}\n\n")
+}
+
+func decodeValue(f field) string {
+	switch t := f.elem.name; t {
+	case "bool":
+		return convert(f.goType, t, "d.bool()")
+	case "int8", "uint8", "byte":
+		return convert(f.goType, "uint8", "d.uint8()")
+	case "int16", "uint16":
+		return convert(f.goType, "uint16", "d.uint16()")
+	case "int32", "uint32", "rune":
+		return convert(f.goType, "uint32", "d.uint32()")
+	case "float32":
+		return convert(f.goType, t, "math.Float32frombits(d.uint32())")
+	case "int64", "uint64", "int", "uint":
+		return convert(f.goType, "uint64", "d.uint64()")
+	case "float64":
+		return convert(f.goType, t, "math.Float64frombits(d.uint64())")
+	case "string":
+		return convert(f.goType, t, "d.string()")
+	case "[]byte":
+		return convert(f.goType, t, "d.bytes()")
+	}
+
+	panic("unsupported type " + f.elem.name)
+}
+
+// convert returns the Go expression that converts v of type from to the type
+// to, omitting the conversion if both types are identical.
+func convert(to, from, v string) string {
+	if to == from || (to == "byte" && from == "uint8") || (to == "uint8" && from == "byte") {
+		return v
+	}
+
+	if strings.HasPrefix(to, "[]") {
+		to = "(" + to + ")"
+	}
+
+	return to + "(" + v + ")"
+}
+
+// generateTests generates round-trip tests for all annotated structs of the
+// package.
+func generateTests(p *pkg) ([]byte, error) {
+	g := new(generator)
+	g.printf("// Code generated by walgen. DO NOT EDIT.\n\n")
+	g.printf("package %s\n\n", p.name)
+	g.printf("import (\n")
+	g.printf("%q\n%q\n%q\n\n", "bytes", "reflect", "testing")
+	g.printf("%q\n", "github.com/fgrosse/wal")
+	g.printf(")\n\n")
+
+	for _, e := range p.entries {
+		g.printf("func TestWalgen_%s(t *testing.T) {\n", e.name)
+		g.printf("newEntry := func() wal.Entry { return new(%s) }\n", e.name)
+		g.printf("walgenTestEntry(t, newEntry(), newEntry)\n")
+		g.printf("walgenTestEntry(t, &%s{\n", e.name)
+		for i, f := range e.fields {
+			g.printf("%s: %s,\n", f.name, sampleValue(f, i+1))
+		}
+		g.printf("}, newEntry)\n")
+		g.printf("}\n\n")
+	}
+
+	g.printf("%s", testHelpers)
+	return g.source()
+}
+
+// sampleValue returns a Go expression that creates a non-zero value for the
+// field. Each value depends on i, so different fields get different values.
+func sampleValue(f field, i int) string {
+	if !f.slice {
+		return sampleElem(f, i)
+	}
+
+	return fmt.Sprintf("[]%s{%s, %s}", f.goType, sampleElem(f, i), sampleElem(f, i+1))
+}
+
+func sampleElem(f field, i int) string {
+	var v string
+	switch t := f.elem.name; t {
+	case "bool":
+		v = strconv.FormatBool(i%2 == 1)
+	case "uint8", "byte", "uint16", "uint32", "uint64", "uint":
+		v = strconv.Itoa(i)
+	case "int8", "int16", "int32", "rune", "int64", "int":
+		v = strconv.Itoa(-i)
+	case "float32", "float64":
+		v = strconv.Itoa(-i) + ".5"
+	case "string":
+		v = strconv.Quote(f.name + strconv.Itoa(i))
+	case "[]byte":
+		v = "[]byte(" + strconv.Quote(f.name+strconv.Itoa(i)) + ")"
+		if f.goType == t {
+			return v
+		}
+	}
+
+	if f.goType == f.elem.name {
+		return v
+	}
+
+	return convert(f.goType, "", v)
+}
+
+const helpers = `// walgenAppendBool appends the encoding of v to b.
+func walgenAppendBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 1)
+	}
+
+	return append(b, 0)
+}
+
+// walgenAppendLen appends the length of a string or slice to b.
+func walgenAppendLen(b []byte, field string, n int) ([]byte, error) {
+	if uint64(n) > math.MaxUint32 {
+		return b, fmt.Errorf("length of %s exceeds %d", field, uint32(math.MaxUint32))
+	}
+
+	return binary.BigEndian.AppendUint32(b, uint32(n)), nil
+}
+
+// walgenAppendBytes appends a string or byte slice that is prefixed by its
+// length to b.
+func walgenAppendBytes[T string | []byte](b []byte, field string, v T) ([]byte, error) {
+	b, err := walgenAppendLen(b, field, len(v))
+	if err != nil {
+		return b, err
+	}
+
+	return append(b, v...), nil
+}
+
+// walgenChunkSize is the maximum number of bytes that the walgenReader reads
+// at once. Since the lengths in a corrupted payload can be garbage, we do not
+// allocate the entire buffer upfront.
+const walgenChunkSize = 32 * 1024
+
+// walgenReader reads an encoded payload from an io.Reader.
+type walgenReader struct {
+	r   io.Reader
+	b   []byte
+	err error
+}
+
+// read appends the next n bytes of the reader to the payload and returns them.
+func (rd *walgenReader) read(n uint64) []byte {
+	start := len(rd.b)
+	for n > 0 && rd.err == nil {
+		chunk := n
+		if chunk > walgenChunkSize {
+			chunk = walgenChunkSize
+		}
+
+		i := len(rd.b)
+		rd.b = append(rd.b, make([]byte, chunk)...)
+		if _, err := io.ReadFull(rd.r, rd.b[i:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			rd.err = err
+		}
+
+		n -= chunk
+	}
+
+	if rd.err != nil {
+		return nil
+	}
+
+	return rd.b[start:]
+}
+
+func (rd *walgenReader) uint32() uint32 {
+	b := rd.read(4)
+	if b == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint32(b)
+}
+
+// walgenDecoder decodes a payload. Once the payload turns out to be too short
+// or invalid, all further values are decoded as zero values and finish()
+// returns the error.
+type walgenDecoder struct {
+	b   []byte
+	err error
+}
+
+// next returns the next n bytes of the payload.
+func (d *walgenDecoder) next(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if uint64(len(d.b)) < n {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+
+	b := d.b[:n:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *walgenDecoder) bool() bool {
+	switch v := d.uint8(); v {
+	case 0, 1:
+		return v == 1
+	default:
+		d.err = fmt.Errorf("invalid bool value %d", v)
+		return false
+	}
+}
+
+func (d *walgenDecoder) uint8() uint8 {
+	if b := d.next(1); b != nil {
+		return b[0]
+	}
+
+	return 0
+}
+
+func (d *walgenDecoder) uint16() uint16 {
+	if b := d.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+
+	return 0
+}
+
+func (d *walgenDecoder) uint32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+
+	return 0
+}
+
+func (d *walgenDecoder) uint64() uint64 {
+	if b := d.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+
+	return 0
+}
+
+func (d *walgenDecoder) string() string {
+	return string(d.next(uint64(d.uint32())))
+}
+
+func (d *walgenDecoder) bytes() []byte {
+	b := d.next(uint64(d.uint32()))
+	if len(b) == 0 {
+		return nil
+	}
+
+	return append([]byte(nil), b...)
+}
+
+// count decodes the number of elements of a slice. Since each element is
+// encoded with at least minSize bytes, a corrupted count is detected before
+// the slice is allocated.
+func (d *walgenDecoder) count(minSize uint64) int {
+	n := uint64(d.uint32())
+	if d.err == nil && n*minSize > uint64(len(d.b)) {
+		d.err = io.ErrUnexpectedEOF
+	}
+
+	if d.err != nil {
+		return 0
+	}
+
+	return int(n)
+}
+
+// finish returns the first decoding error or an error if the payload was not
+// decoded entirely.
+func (d *walgenDecoder) finish() error {
+	if d.err == nil && len(d.b) > 0 {
+		return fmt.Errorf("payload has %d unexpected trailing bytes", len(d.b))
+	}
+
+	return d.err
+}
+`
+
+const testHelpers = `// walgenTestEntry checks that the entry survives a round trip through its
+// encoding and that truncated or extended payloads are rejected.
+func walgenTestEntry(t *testing.T, e wal.Entry, newEntry func() wal.Entry) {
+	t.Helper()
+
+	payload := e.EncodePayload([]byte("buffer that is reused"))
+	read, err := newEntry().ReadPayload(bytes.NewReader(append(payload, "next entry"...)))
+	if err != nil {
+		t.Fatalf("reading payload: %v", err)
+	}
+
+	if !bytes.Equal(read, payload) {
+		t.Fatalf("ReadPayload returned %x instead of %x", read, payload)
+	}
+
+	appended, err := newEntry().(wal.PayloadAppender).AppendPayload([]byte("prefix"), bytes.NewReader(payload))
+	if err != nil {
+		t.Fatalf("appending payload: %v", err)
+	}
+
+	if !bytes.Equal(appended, append([]byte("prefix"), payload...)) {
+		t.Fatalf("AppendPayload returned %x instead of the prefixed %x", appended, payload)
+	}
+
+	decoded := newEntry()
+	if err := decoded.DecodePayload(read); err != nil {
+		t.Fatalf("decoding payload: %v", err)
+	}
+
+	if !reflect.DeepEqual(decoded, e) {
+		t.Fatalf("decoded entry %+v does not match original entry %+v", decoded, e)
+	}
+
+	if decoded.Type() != e.Type() {
+		t.Fatalf("decoded entry has type %d instead of %d", decoded.Type(), e.Type())
+	}
+
+	for i := range payload {
+		if _, err := newEntry().ReadPayload(bytes.NewReader(payload[:i])); err == nil {
+			t.Errorf("reading payload truncated to %d of %d bytes should fail", i, len(payload))
+		}
+
+		if err := newEntry().DecodePayload(payload[:i]); err == nil {
+			t.Errorf("decoding payload truncated to %d of %d bytes should fail", i, len(payload))
+		}
+	}
+
+	if err := newEntry().DecodePayload(append(payload, 0)); err == nil {
+		t.Errorf("decoding payload with trailing bytes should fail")
+	}
+}
+`
@@ -0,0 +1,466 @@
+// Code generated by walgen. DO NOT EDIT.
+
+package example
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/fgrosse/wal"
+)
+
+var (
+	_ wal.Entry        = (*UserCreated)(nil)
+	_ wal.EntryEncoder = (*UserCreated)(nil)
+)
+
+// Type implements the wal.Entry interface.
+func (*UserCreated) Type() wal.EntryType { return UserCreatedType }
+
+// EncodePayload implements the wal.Entry interface. It panics if a string or
+// slice is longer than math.MaxUint32.
+func (e *UserCreated) EncodePayload(b []byte) []byte {
+	b, err := e.TryEncodePayload(b)
+	if err != nil {
+		panic(err)
+	}
+
+	return b
+}
+
+// TryEncodePayload implements the wal.EntryEncoder interface.
+func (e *UserCreated) TryEncodePayload(b []byte) ([]byte, error) {
+	var err error
+	b = b[:0]
+	b = binary.BigEndian.AppendUint64(b, e.ID)
+	if b, err = walgenAppendBytes(b, "UserCreated.Name", e.Name); err != nil {
+		return b, err
+	}
+	b = walgenAppendBool(b, e.Admin)
+	if b, err = walgenAppendLen(b, "UserCreated.Tags", len(e.Tags)); err != nil {
+		return b, err
+	}
+	for _, v := range e.Tags {
+		if b, err = walgenAppendBytes(b, "UserCreated.Tags", v); err != nil {
+			return b, err
+		}
+	}
+	if b, err = walgenAppendBytes(b, "UserCreated.Avatar", e.Avatar); err != nil {
+		return b, err
+	}
+	b = append(b, uint8(e.Status))
+	if b, err = walgenAppendLen(b, "UserCreated.Labels", len(e.Labels)); err != nil {
+		return b, err
+	}
+	for _, v := range e.Labels {
+		if b, err = walgenAppendBytes(b, "UserCreated.Labels", string(v)); err != nil {
+			return b, err
+		}
+	}
+	if b, err = walgenAppendLen(b, "UserCreated.Sessions", len(e.Sessions)); err != nil {
+		return b, err
+	}
+	for _, v := range e.Sessions {
+		if b, err = walgenAppendBytes(b, "UserCreated.Sessions", v); err != nil {
+			return b, err
+		}
+	}
+
+	return b, nil
+}
+
+// ReadPayload implements the wal.Entry interface.
+func (e *UserCreated) ReadPayload(r io.Reader) ([]byte, error) {
+	return e.AppendPayload(nil, r)
+}
+
+// AppendPayload implements the wal.PayloadAppender interface.
+func (*UserCreated) AppendPayload(dst []byte, r io.Reader) ([]byte, error) {
+	rd := walgenReader{r: r, b: dst}
+	rd.read(8)                                          // ID
+	rd.read(uint64(rd.uint32()))                        // Name
+	rd.read(1)                                          // Admin
+	for n := rd.uint32(); n > 0 && rd.err == nil; n-- { // Tags
+		rd.read(uint64(rd.uint32()))
+	}
+	rd.read(uint64(rd.uint32()))                        // Avatar
+	rd.read(1)                                          // Status
+	for n := rd.uint32(); n > 0 && rd.err == nil; n-- { // Labels
+		rd.read(uint64(rd.uint32()))
+	}
+	for n := rd.uint32(); n > 0 && rd.err == nil; n-- { // Sessions
+		rd.read(uint64(rd.uint32()))
+	}
+
+	return rd.b, rd.err
+}
+
+// DecodePayload implements the wal.Entry interface.
+func (e *UserCreated) DecodePayload(b []byte) error {
+	d := walgenDecoder{b: b}
+	e.ID = d.uint64()
+	e.Name = d.string()
+	e.Admin = d.bool()
+	e.Tags = nil
+	if n := d.count(4); n > 0 {
+		e.Tags = make([]string, n)
+		for i := range e.Tags {
+			e.Tags[i] = d.string()
+		}
+	}
+	e.Avatar = d.bytes()
+	e.Status = Status(d.uint8())
+	e.Labels = nil
+	if n := d.count(4); n > 0 {
+		e.Labels = make([]Label, n)
+		for i := range e.Labels {
+			e.Labels[i] = Label(d.string())
+		}
+	}
+	e.Sessions = nil
+	if n := d.count(4); n > 0 {
+		e.Sessions = make([][]byte, n)
+		for i := range e.Sessions {
+			e.Sessions[i] = d.bytes()
+		}
+	}
+
+	return d.finish()
+}
+
+var (
+	_ wal.Entry        = (*Measurement)(nil)
+	_ wal.EntryEncoder = (*Measurement)(nil)
+)
+
+// Type implements the wal.Entry interface.
+func (*Measurement) Type() wal.EntryType { return MeasurementType }
+
+// EncodePayload implements the wal.Entry interface. It panics if a string or
+// slice is longer than math.MaxUint32.
+func (e *Measurement) EncodePayload(b []byte) []byte {
+	b, err := e.TryEncodePayload(b)
+	if err != nil {
+		panic(err)
+	}
+
+	return b
+}
+
+// TryEncodePayload implements the wal.EntryEncoder interface.
+func (e *Measurement) TryEncodePayload(b []byte) ([]byte, error) {
+	var err error
+	b = b[:0]
+	b = binary.BigEndian.AppendUint32(b, uint32(e.Sensor))
+	b = binary.BigEndian.AppendUint64(b, math.Float64bits(e.Temperature))
+	if b, err = walgenAppendLen(b, "Measurement.Points", len(e.Points)); err != nil {
+		return b, err
+	}
+	for _, v := range e.Points {
+		b = binary.BigEndian.AppendUint32(b, math.Float32bits(v))
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(e.Offset))
+	b = binary.BigEndian.AppendUint16(b, uint16(e.Gap))
+	b = append(b, uint8(e.Delta))
+	if b, err = walgenAppendLen(b, "Measurement.Raw", len(e.Raw)); err != nil {
+		return b, err
+	}
+	for _, v := range e.Raw {
+		b = binary.BigEndian.AppendUint16(b, v)
+	}
+	if b, err = walgenAppendLen(b, "Measurement.Flags", len(e.Flags)); err != nil {
+		return b, err
+	}
+	for _, v := range e.Flags {
+		b = walgenAppendBool(b, v)
+	}
+	b = binary.BigEndian.AppendUint64(b, uint64(e.Counter))
+	b = binary.BigEndian.AppendUint32(b, uint32(e.Rune))
+	b = append(b, e.Small)
+
+	return b, nil
+}
+
+// ReadPayload implements the wal.Entry interface.
+func (e *Measurement) ReadPayload(r io.Reader) ([]byte, error) {
+	return e.AppendPayload(nil, r)
+}
+
+// AppendPayload implements the wal.PayloadAppender interface.
+func (*Measurement) AppendPayload(dst []byte, r io.Reader) ([]byte, error) {
+	rd := walgenReader{r: r, b: dst}
+	rd.read(12)                      // Sensor, Temperature
+	rd.read(uint64(rd.uint32()) * 4) // Points
+	rd.read(5)                       // Offset, Gap, Delta
+	rd.read(uint64(rd.uint32()) * 2) // Raw
+	rd.read(uint64(rd.uint32()) * 1) // Flags
+	rd.read(13)                      // Counter, Rune, Small
+
+	return rd.b, rd.err
+}
+
+// DecodePayload implements the wal.Entry interface.
+func (e *Measurement) DecodePayload(b []byte) error {
+	d := walgenDecoder{b: b}
+	e.Sensor = int32(d.uint32())
+	e.Temperature = math.Float64frombits(d.uint64())
+	e.Points = nil
+	if n := d.count(4); n > 0 {
+		e.Points = make([]float32, n)
+		for i := range e.Points {
+			e.Points[i] = math.Float32frombits(d.uint32())
+		}
+	}
+	e.Offset = int16(d.uint16())
+	e.Gap = int16(d.uint16())
+	e.Delta = int8(d.uint8())
+	e.Raw = nil
+	if n := d.count(2); n > 0 {
+		e.Raw = make([]uint16, n)
+		for i := range e.Raw {
+			e.Raw[i] = d.uint16()
+		}
+	}
+	e.Flags = nil
+	if n := d.count(1); n > 0 {
+		e.Flags = make([]bool, n)
+		for i := range e.Flags {
+			e.Flags[i] = d.bool()
+		}
+	}
+	e.Counter = uint(d.uint64())
+	e.Rune = rune(d.uint32())
+	e.Small = d.uint8()
+
+	return d.finish()
+}
+
+var (
+	_ wal.Entry        = (*Heartbeat)(nil)
+	_ wal.EntryEncoder = (*Heartbeat)(nil)
+)
+
+// Type implements the wal.Entry interface.
+func (*Heartbeat) Type() wal.EntryType { return 10 }
+
+// EncodePayload implements the wal.Entry interface. It panics if a string or
+// slice is longer than math.MaxUint32.
+func (e *Heartbeat) EncodePayload(b []byte) []byte {
+	b, err := e.TryEncodePayload(b)
+	if err != nil {
+		panic(err)
+	}
+
+	return b
+}
+
+// TryEncodePayload implements the wal.EntryEncoder interface.
+func (e *Heartbeat) TryEncodePayload(b []byte) ([]byte, error) {
+	b = b[:0]
+
+	return b, nil
+}
+
+// ReadPayload implements the wal.Entry interface.
+func (e *Heartbeat) ReadPayload(r io.Reader) ([]byte, error) {
+	return e.AppendPayload(nil, r)
+}
+
+// AppendPayload implements the wal.PayloadAppender interface.
+func (*Heartbeat) AppendPayload(dst []byte, r io.Reader) ([]byte, error) {
+	rd := walgenReader{r: r, b: dst}
+
+	return rd.b, rd.err
+}
+
+// DecodePayload implements the wal.Entry interface.
+func (e *Heartbeat) DecodePayload(b []byte) error {
+	d := walgenDecoder{b: b}
+
+	return d.finish()
+}
+
+// walgenAppendBool appends the encoding of v to b.
+func walgenAppendBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 1)
+	}
+
+	return append(b, 0)
+}
+
+// walgenAppendLen appends the length of a string or slice to b.
+func walgenAppendLen(b []byte, field string, n int) ([]byte, error) {
+	if uint64(n) > math.MaxUint32 {
+		return b, fmt.Errorf("length of %s exceeds %d", field, uint32(math.MaxUint32))
+	}
+
+	return binary.BigEndian.AppendUint32(b, uint32(n)), nil
+}
+
+// walgenAppendBytes appends a string or byte slice that is prefixed by its
+// length to b.
+func walgenAppendBytes[T string | []byte](b []byte, field string, v T) ([]byte, error) {
+	b, err := walgenAppendLen(b, field, len(v))
+	if err != nil {
+		return b, err
+	}
+
+	return append(b, v...), nil
+}
+
+// walgenChunkSize is the maximum number of bytes that the walgenReader reads
+// at once. Since the lengths in a corrupted payload can be garbage, we do not
+// allocate the entire buffer upfront.
+const walgenChunkSize = 32 * 1024
+
+// walgenReader reads an encoded payload from an io.Reader.
+type walgenReader struct {
+	r   io.Reader
+	b   []byte
+	err error
+}
+
+// read appends the next n bytes of the reader to the payload and returns them.
+func (rd *walgenReader) read(n uint64) []byte {
+	start := len(rd.b)
+	for n > 0 && rd.err == nil {
+		chunk := n
+		if chunk > walgenChunkSize {
+			chunk = walgenChunkSize
+		}
+
+		i := len(rd.b)
+		rd.b = append(rd.b, make([]byte, chunk)...)
+		if _, err := io.ReadFull(rd.r, rd.b[i:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			rd.err = err
+		}
+
+		n -= chunk
+	}
+
+	if rd.err != nil {
+		return nil
+	}
+
+	return rd.b[start:]
+}
+
+func (rd *walgenReader) uint32() uint32 {
+	b := rd.read(4)
+	if b == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint32(b)
+}
+
+// walgenDecoder decodes a payload. Once the payload turns out to be too short
+// or invalid, all further values are decoded as zero values and finish()
+// returns the error.
+type walgenDecoder struct {
+	b   []byte
+	err error
+}
+
+// next returns the next n bytes of the payload.
+func (d *walgenDecoder) next(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if uint64(len(d.b)) < n {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+
+	b := d.b[:n:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *walgenDecoder) bool() bool {
+	switch v := d.uint8(); v {
+	case 0, 1:
+		return v == 1
+	default:
+		d.err = fmt.Errorf("invalid bool value %d", v)
+		return false
+	}
+}
+
+func (d *walgenDecoder) uint8() uint8 {
+	if b := d.next(1); b != nil {
+		return b[0]
+	}
+
+	return 0
+}
+
+func (d *walgenDecoder) uint16() uint16 {
+	if b := d.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+
+	return 0
+}
+
+func (d *walgenDecoder) uint32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+
+	return 0
+}
+
+func (d *walgenDecoder) uint64() uint64 {
+	if b := d.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+
+	return 0
+}
+
+func (d *walgenDecoder) string() string {
+	return string(d.next(uint64(d.uint32())))
+}
+
+func (d *walgenDecoder) bytes() []byte {
+	b := d.next(uint64(d.uint32()))
+	if len(b) == 0 {
+		return nil
+	}
+
+	return append([]byte(nil), b...)
+}
+
+// count decodes the number of elements of a slice. Since each element is
+// encoded with at least minSize bytes, a corrupted count is detected before
+// the slice is allocated.
+func (d *walgenDecoder) count(minSize uint64) int {
+	n := uint64(d.uint32())
+	if d.err == nil && n*minSize > uint64(len(d.b)) {
+		d.err = io.ErrUnexpectedEOF
+	}
+
+	if d.err != nil {
+		return 0
+	}
+
+	return int(n)
+}
+
+// finish returns the first decoding error or an error if the payload was not
+// decoded entirely.
+func (d *walgenDecoder) finish() error {
+	if d.err == nil && len(d.b) > 0 {
+		return fmt.Errorf("payload has %d unexpected trailing bytes", len(d.b))
+	}
+
+	return d.err
+}
@@ -0,0 +1,102 @@
+// Code generated by walgen. DO NOT EDIT.
+
+package example
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/fgrosse/wal"
+)
+
+func TestWalgen_UserCreated(t *testing.T) {
+	newEntry := func() wal.Entry { return new(UserCreated) }
+	walgenTestEntry(t, newEntry(), newEntry)
+	walgenTestEntry(t, &UserCreated{
+		ID:       1,
+		Name:     "Name2",
+		Admin:    true,
+		Tags:     []string{"Tags4", "Tags5"},
+		Avatar:   []byte("Avatar5"),
+		Status:   Status(6),
+		Labels:   []Label{Label("Labels7"), Label("Labels8")},
+		Sessions: [][]byte{[]byte("Sessions8"), []byte("Sessions9")},
+	}, newEntry)
+}
+
+func TestWalgen_Measurement(t *testing.T) {
+	newEntry := func() wal.Entry { return new(Measurement) }
+	walgenTestEntry(t, newEntry(), newEntry)
+	walgenTestEntry(t, &Measurement{
+		Sensor:      -1,
+		Temperature: -2.5,
+		Points:      []float32{-3.5, -4.5},
+		Offset:      -4,
+		Gap:         -5,
+		Delta:       -6,
+		Raw:         []uint16{7, 8},
+		Flags:       []bool{false, true},
+		Counter:     9,
+		Rune:        -10,
+		Small:       11,
+	}, newEntry)
+}
+
+func TestWalgen_Heartbeat(t *testing.T) {
+	newEntry := func() wal.Entry { return new(Heartbeat) }
+	walgenTestEntry(t, newEntry(), newEntry)
+	walgenTestEntry(t, &Heartbeat{}, newEntry)
+}
+
+// walgenTestEntry checks that the entry survives a round trip through its
+// encoding and that truncated or extended payloads are rejected.
+func walgenTestEntry(t *testing.T, e wal.Entry, newEntry func() wal.Entry) {
+	t.Helper()
+
+	payload := e.EncodePayload([]byte("buffer that is reused"))
+	read, err := newEntry().ReadPayload(bytes.NewReader(append(payload, "next entry"...)))
+	if err != nil {
+		t.Fatalf("reading payload: %v", err)
+	}
+
+	if !bytes.Equal(read, payload) {
+		t.Fatalf("ReadPayload returned %x instead of %x", read, payload)
+	}
+
+	appended, err := newEntry().(wal.PayloadAppender).AppendPayload([]byte("prefix"), bytes.NewReader(payload))
+	if err != nil {
+		t.Fatalf("appending payload: %v", err)
+	}
+
+	if !bytes.Equal(appended, append([]byte("prefix"), payload...)) {
+		t.Fatalf("AppendPayload returned %x instead of the prefixed %x", appended, payload)
+	}
+
+	decoded := newEntry()
+	if err := decoded.DecodePayload(read); err != nil {
+		t.Fatalf("decoding payload: %v", err)
+	}
+
+	if !reflect.DeepEqual(decoded, e) {
+		t.Fatalf("decoded entry %+v does not match original entry %+v", decoded, e)
+	}
+
+	if decoded.Type() != e.Type() {
+		t.Fatalf("decoded entry has type %d instead of %d", decoded.Type(), e.Type())
+	}
+
+	for i := range payload {
+		if _, err := newEntry().ReadPayload(bytes.NewReader(payload[:i])); err == nil {
+			t.Errorf("reading payload truncated to %d of %d bytes should fail", i, len(payload))
+		}
+
+		if err := newEntry().DecodePayload(payload[:i]); err == nil {
+			t.Errorf("decoding payload truncated to %d of %d bytes should fail", i, len(payload))
+		}
+	}
+
+	if err := newEntry().DecodePayload(append(payload, 0)); err == nil {
+		t.Errorf("decoding payload with trailing bytes should fail")
+	}
+}
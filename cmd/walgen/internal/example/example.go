@@ -0,0 +1,53 @@
+// Package example contains annotated structs that are used to test the code
+// generated by walgen.
+package example
+
+//go:generate go run github.com/fgrosse/wal/cmd/walgen
+
+// Status is a custom type whose values are encoded as uint8.
+type Status uint8
+
+// Label is a custom string type.
+type Label string
+
+// Constants for the example entries.
+const (
+	UserCreatedType = iota + 1
+	MeasurementType
+)
+
+// UserCreated is an entry with fields of variable length.
+//
+//walgen:entry UserCreatedType
+type UserCreated struct {
+	ID       uint64
+	Name     string
+	Admin    bool
+	Tags     []string
+	Avatar   []byte
+	Status   Status  `wal:"uint8"`
+	Labels   []Label `wal:"string"`
+	Sessions [][]byte
+	Cache    map[string]string `wal:"-"`
+}
+
+// Measurement is an entry with numeric fields.
+//
+//walgen:entry MeasurementType
+type Measurement struct {
+	Sensor      int32
+	Temperature float64
+	Points      []float32
+	Offset, Gap int16
+	Delta       int8
+	Raw         []uint16
+	Flags       []bool
+	Counter     uint
+	Rune        rune
+	Small       byte
+}
+
+// Heartbeat is an entry without any fields.
+//
+//walgen:entry 10
+type Heartbeat struct{}
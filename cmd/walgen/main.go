@@ -0,0 +1,82 @@
+// Command walgen generates wal.Entry implementations for annotated Go structs.
+//
+// Each struct that should become a WAL entry is annotated with a
+// "//walgen:entry" comment that specifies its wal.EntryType:
+//
+//	//walgen:entry UserCreatedType
+//	type UserCreated struct {
+//		ID     uint64
+//		Name   string
+//		Tags   []string
+//		Status Status `wal:"uint8"`
+//		cache  []byte `wal:"-"`
+//	}
+//
+// Running walgen in the package directory (e.g. via go generate) writes the
+// Type, EncodePayload, TryEncodePayload, ReadPayload, AppendPayload and
+// DecodePayload methods of all annotated structs into a single file.
+// Additionally, it writes a test file that checks the encoding of each struct
+// via a round trip and verifies that truncated payloads are rejected:
+//
+//	//go:generate go run github.com/fgrosse/wal/cmd/walgen
+//
+// The following field types are supported: bool, all integer types except
+// uintptr, float32, float64, string, []byte and slices of those types. Fields
+// of other types are either skipped via the `wal:"-"` tag or, if their
+// underlying type is supported, annotated with it (e.g. `wal:"uint8"`).
+//
+// All values are encoded in big endian byte order. The types int and uint are
+// always encoded with 8 bytes. Strings, byte slices and slices are prefixed
+// with their length (4B).
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	dir := flag.String("dir", ".", "directory of the Go package that contains the annotated structs")
+	output := flag.String("output", "entries_walgen.go", "name of the generated file in the package directory")
+	noTests := flag.Bool("no-tests", false, "do not generate round-trip tests")
+	flag.Parse()
+
+	if err := run(*dir, *output, !*noTests); err != nil {
+		fmt.Fprintln(os.Stderr, "walgen:", err)
+		os.Exit(1)
+	}
+}
+
+func run(dir, output string, tests bool) error {
+	pkg, err := parsePackage(dir, output)
+	if err != nil {
+		return err
+	}
+
+	if len(pkg.entries) == 0 {
+		return fmt.Errorf("no structs with a //walgen:entry annotation found in %q", dir)
+	}
+
+	src, err := generateEntries(pkg)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, output)
+	if err := os.WriteFile(path, src, 0644); err != nil {
+		return err
+	}
+
+	if !tests {
+		return nil
+	}
+
+	src, err = generateTests(pkg)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(testFileName(path), src, 0644)
+}
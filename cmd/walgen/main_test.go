@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	src, err := os.ReadFile("internal/example/example.go")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "example.go"), src, 0666))
+
+	require.NoError(t, run(dir, "entries_walgen.go", true))
+
+	t.Log("The generated code in internal/example must be up to date")
+	for _, name := range []string{"entries_walgen.go", "entries_walgen_test.go"} {
+		expected, err := os.ReadFile(filepath.Join("internal/example", name))
+		require.NoError(t, err)
+		actual, err := os.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		assert.Equal(t, string(expected), string(actual), "run go generate ./... to update %s", name)
+	}
+}
+
+func TestRun_Errors(t *testing.T) {
+	cases := map[string]struct {
+		src string
+		err string
+	}{
+		"no entries": {
+			src: "type Foo struct{}",
+			err: "no structs with a //walgen:entry annotation found",
+		},
+		"missing entry type": {
+			src: "//walgen:entry\ntype Foo struct{}",
+			err: "annotation of Foo is missing the entry type",
+		},
+		"no struct": {
+			src: "//walgen:entry 1\ntype Foo int",
+			err: "Foo must be a non-generic struct",
+		},
+		"unsupported type": {
+			src: "//walgen:entry 1\ntype Foo struct{ Bar map[string]int }",
+			err: "Foo: field Bar has unsupported type map[string]int",
+		},
+		"unsupported tag": {
+			src: "type Status int\n//walgen:entry 1\ntype Foo struct{ Bar Status `wal:\"uint128\"` }",
+			err: "Foo: field Bar has unsupported type Status",
+		},
+		"embedded field": {
+			src: "type Bar struct{}\n//walgen:entry 1\ntype Foo struct{ Bar }",
+			err: "Foo: embedded fields are not supported",
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			src := "package test\n\n" + c.src + "\n"
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "test.go"), []byte(src), 0666))
+
+			err := run(dir, "entries_walgen.go", true)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), c.err)
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// annotation marks a struct for which walgen generates an Entry
+// implementation. It is followed by the wal.EntryType of the struct.
+const annotation = "//walgen:entry"
+
+// pkg contains all annotated structs of a single Go package.
+type pkg struct {
+	name    string
+	entries []entry
+}
+
+// entry is an annotated struct.
+type entry struct {
+	name      string
+	entryType string // Go expression of the wal.EntryType
+	fields    []field
+}
+
+// field is a single encoded field of an entry.
+type field struct {
+	name   string
+	slice  bool   // whether the field is a slice of elem
+	goType string // Go type of the field, or of its elements if it is a slice
+	elem   basicType
+}
+
+// basicType is a type that walgen knows how to encode.
+type basicType struct {
+	name string
+	size int // encoded size in bytes or 0 if the size is variable
+}
+
+func (t basicType) variable() bool { return t.size == 0 }
+
+var basicTypes = map[string]basicType{}
+
+func init() {
+	for _, t := range []basicType{
+		{"bool", 1}, {"int8", 1}, {"uint8", 1}, {"byte", 1},
+		{"int16", 2}, {"uint16", 2},
+		{"int32", 4}, {"uint32", 4}, {"rune", 4}, {"float32", 4},
+		{"int64", 8}, {"uint64", 8}, {"int", 8}, {"uint", 8}, {"float64", 8},
+		{"string", 0}, {"[]byte", 0},
+	} {
+		basicTypes[t.name] = t
+	}
+}
+
+// parsePackage parses all non-test Go files in dir, except the generated
+// output file, and returns their annotated structs.
+func parsePackage(dir, output string) (*pkg, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || filepath.Ext(name) != ".go" || strings.HasSuffix(name, "_test.go") || name == output {
+			continue
+		}
+
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	p := new(pkg)
+	fset := token.NewFileSet()
+	for _, name := range names {
+		f, err := parser.ParseFile(fset, filepath.Join(dir, name), nil, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+
+		if p.name == "" {
+			p.name = f.Name.Name
+		}
+
+		entries, err := parseEntries(fset, f)
+		if err != nil {
+			return nil, err
+		}
+
+		p.entries = append(p.entries, entries...)
+	}
+
+	return p, nil
+}
+
+func parseEntries(fset *token.FileSet, f *ast.File) ([]entry, error) {
+	var entries []entry
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+
+		for _, spec := range gen.Specs {
+			spec := spec.(*ast.TypeSpec)
+			doc := spec.Doc
+			if doc == nil && len(gen.Specs) == 1 {
+				doc = gen.Doc
+			}
+
+			typ, ok := entryType(doc)
+			if !ok {
+				continue
+			}
+
+			pos := fset.Position(spec.Pos())
+			if typ == "" {
+				return nil, fmt.Errorf("%s: %s annotation of %s is missing the entry type", pos, annotation, spec.Name.Name)
+			}
+
+			st, ok := spec.Type.(*ast.StructType)
+			if !ok || spec.TypeParams != nil {
+				return nil, fmt.Errorf("%s: %s must be a non-generic struct", pos, spec.Name.Name)
+			}
+
+			fields, err := parseFields(st)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", pos, spec.Name.Name, err)
+			}
+
+			entries = append(entries, entry{name: spec.Name.Name, entryType: typ, fields: fields})
+		}
+	}
+
+	return entries, nil
+}
+
+// entryType returns the entry type of the annotation in the given comments.
+func entryType(doc *ast.CommentGroup) (string, bool) {
+	if doc == nil {
+		return "", false
+	}
+
+	for _, c := range doc.List {
+		if c.Text == annotation || strings.HasPrefix(c.Text, annotation+" ") {
+			return strings.TrimSpace(strings.TrimPrefix(c.Text, annotation)), true
+		}
+	}
+
+	return "", false
+}
+
+func parseFields(st *ast.StructType) ([]field, error) {
+	var fields []field
+	for _, f := range st.Fields.List {
+		var tag string
+		if f.Tag != nil {
+			value, err := strconv.Unquote(f.Tag.Value)
+			if err != nil {
+				return nil, err
+			}
+
+			tag = reflect.StructTag(value).Get("wal")
+		}
+
+		if tag == "-" {
+			continue
+		}
+
+		if len(f.Names) == 0 {
+			return nil, fmt.Errorf("embedded fields are not supported")
+		}
+
+		goType, slice := types.ExprString(f.Type), false
+		if elem, ok := f.Type.(*ast.ArrayType); ok && elem.Len == nil && goType != "[]byte" {
+			goType, slice = types.ExprString(elem.Elt), true
+		}
+
+		name := goType
+		if tag != "" {
+			name = tag
+		}
+
+		elem, ok := basicTypes[name]
+		if !ok {
+			return nil, fmt.Errorf("field %s has unsupported type %s", f.Names[0].Name, types.ExprString(f.Type))
+		}
+
+		for _, n := range f.Names {
+			if n.Name == "_" {
+				continue
+			}
+
+			fields = append(fields, field{name: n.Name, slice: slice, goType: goType, elem: elem})
+		}
+	}
+
+	return fields, nil
+}
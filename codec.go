@@ -0,0 +1,134 @@
+package wal
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// CodecID identifies the Codec that was used to compress the payload of an
+// entry. It is stored together with each compressed record.
+type CodecID uint8
+
+// IDs of the built-in codecs. Custom Codec implementations must use an ID of
+// 128 or higher.
+const (
+	CodecFlate CodecID = 1
+)
+
+// minCustomCodecID is the smallest CodecID of a custom Codec. The IDs below
+// are reserved for the built-in codecs and 0 marks uncompressed records.
+const minCustomCodecID CodecID = 128
+
+// A Codec compresses and decompresses entry payloads. Use the WithCompression(…)
+// option to enable compression when writing entries. The WAL supports the
+// FlateCodec by default. Custom codecs must also be registered at the
+// EntryRegistry via EntryRegistry.RegisterCodec(…), so compressed entries can
+// be decoded again.
+type Codec interface {
+	// ID returns the unique ID of the codec.
+	ID() CodecID
+
+	// Compress appends the compressed src to dst and returns the result.
+	Compress(dst, src []byte) ([]byte, error)
+
+	// Decompress appends the decompressed src to dst and returns the result.
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+// FlateCodec is a Codec which uses the DEFLATE compression algorithm from the
+// compress/flate package. The zero value uses flate.DefaultCompression.
+type FlateCodec struct {
+	level   *int      // nil means flate.DefaultCompression
+	writers sync.Pool // *flate.Writer
+	readers sync.Pool // io.ReadCloser implementing flate.Resetter
+}
+
+// NewFlateCodec creates a new FlateCodec with the given compression level
+// (see compress/flate).
+func NewFlateCodec(level int) (*FlateCodec, error) {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return nil, fmt.Errorf("invalid flate compression level %d", level)
+	}
+
+	return &FlateCodec{level: &level}, nil
+}
+
+// ID implements the Codec interface.
+func (*FlateCodec) ID() CodecID {
+	return CodecFlate
+}
+
+// Compress implements the Codec interface.
+func (c *FlateCodec) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+
+	fw, ok := c.writers.Get().(*flate.Writer)
+	if ok {
+		fw.Reset(buf)
+	} else {
+		level := flate.DefaultCompression
+		if c.level != nil {
+			level = *c.level
+		}
+
+		var err error
+		fw, err = flate.NewWriter(buf, level)
+		if err != nil {
+			return dst, err
+		}
+	}
+
+	defer c.writers.Put(fw)
+
+	if _, err := fw.Write(src); err != nil {
+		return dst, err
+	}
+
+	if err := fw.Close(); err != nil {
+		return dst, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Decompress implements the Codec interface.
+func (c *FlateCodec) Decompress(dst, src []byte) ([]byte, error) {
+	fr, ok := c.readers.Get().(io.ReadCloser)
+	if ok {
+		if err := fr.(flate.Resetter).Reset(bytes.NewReader(src), nil); err != nil {
+			return dst, err
+		}
+	} else {
+		fr = flate.NewReader(bytes.NewReader(src))
+	}
+
+	defer c.readers.Put(fr)
+
+	buf := bytes.NewBuffer(dst)
+	if _, err := buf.ReadFrom(fr); err != nil {
+		return dst, fmt.Errorf("decompressing payload: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// defaultFlateCodec is used to decompress entries that have been compressed
+// using the FlateCodec with any compression level.
+var defaultFlateCodec = new(FlateCodec)
+
+// checkCodecID returns an error if the Codec uses a CodecID that is reserved
+// for uncompressed records or the built-in codecs.
+func checkCodecID(c Codec) error {
+	if _, ok := c.(*FlateCodec); ok {
+		return nil
+	}
+
+	if c.ID() < minCustomCodecID {
+		return fmt.Errorf("invalid CodecID %d: custom codecs must use an ID of %d or higher", c.ID(), minCustomCodecID)
+	}
+
+	return nil
+}
@@ -0,0 +1,212 @@
+package wal_test
+
+import (
+	"compress/flate"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fgrosse/wal"
+	"github.com/fgrosse/wal/waltest"
+	"github.com/fgrosse/zaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlateCodec(t *testing.T) {
+	payload := []byte(strings.Repeat(`{"name":"foo","value":42},`, 100))
+
+	for _, level := range []int{flate.NoCompression, flate.BestSpeed, flate.DefaultCompression, flate.BestCompression} {
+		c, err := wal.NewFlateCodec(level)
+		require.NoError(t, err)
+		assert.Equal(t, wal.CodecFlate, c.ID())
+
+		compressed, err := c.Compress([]byte("prefix"), payload)
+		require.NoError(t, err)
+		assert.Equal(t, "prefix", string(compressed[:6]), "compressed data should be appended to dst")
+
+		decompressed, err := c.Decompress(nil, compressed[6:])
+		require.NoError(t, err)
+		assert.Equal(t, payload, decompressed)
+
+		if level != flate.NoCompression {
+			assert.Less(t, len(compressed), len(payload)/5)
+		}
+	}
+
+	_, err := wal.NewFlateCodec(42)
+	assert.EqualError(t, err, "invalid flate compression level 42")
+
+	_, err = new(wal.FlateCodec).Decompress(nil, []byte("garbage"))
+	assert.Error(t, err)
+}
+
+func TestWAL_Compression(t *testing.T) {
+	fs := waltest.NewMemFS()
+	logger := zaptest.Logger(t)
+	conf := wal.DefaultConfiguration()
+	conf.CompressionThreshold = 100
+	codec, err := wal.NewFlateCodec(flate.BestSpeed)
+	require.NoError(t, err)
+
+	w, err := wal.New("/wal", conf, waltest.ExampleEntries, logger, wal.WithFS(fs), wal.WithCompression(codec))
+	require.NoError(t, err)
+
+	var (
+		expected []wal.Entry
+		size     int
+	)
+
+	for i := 0; i < 10; i++ {
+		entries := []wal.Entry{
+			&waltest.ExampleEntry1{ID: uint32(i), Point: []float32{1, 2}}, // below threshold
+			&waltest.ExampleEntry2{Test: true, Name: strings.Repeat(fmt.Sprintf(`{"id":%d},`, i), 100)},
+		}
+
+		for _, e := range entries {
+			_, err := w.Write(e)
+			require.NoError(t, err)
+
+			expected = append(expected, e)
+			size += 4 + 1 + 4 + len(e.EncodePayload(nil))
+		}
+	}
+
+	require.NoError(t, w.Close())
+
+	content, err := fs.ReadFile("/wal/1.wal")
+	require.NoError(t, err)
+	assert.Less(t, len(content), size/5, "entries should have been compressed")
+
+	t.Log("Compressed entries should be decompressed transparently")
+	w, err = wal.Open("/wal", waltest.ExampleEntries, logger, wal.WithFS(fs))
+	require.NoError(t, err)
+	assert.EqualValues(t, 20, w.Offset())
+
+	var actual []wal.Entry
+	err = w.Replay(0, func(_ uint32, e wal.Entry) error {
+		actual = append(actual, e)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+	require.NoError(t, w.Close())
+}
+
+func TestWAL_Compression_CustomCodec(t *testing.T) {
+	fs := waltest.NewMemFS()
+	logger := zaptest.Logger(t)
+	registry := wal.NewEntryRegistry(
+		func() wal.Entry { return new(waltest.ExampleEntry1) },
+		func() wal.Entry { return new(waltest.ExampleEntry2) },
+	)
+
+	codec := &customCodec{FlateCodec: new(wal.FlateCodec)}
+	_, err := wal.Open("/wal", registry, logger, wal.WithFS(fs), wal.WithCompression(codec))
+	assert.EqualError(t, err, "compression codec must be registered at the EntryRegistry: unknown WAL codec 200")
+
+	require.NoError(t, registry.RegisterCodec(codec))
+	assert.Error(t, registry.RegisterCodec(codec), "codecs must only be registered once")
+	assert.Error(t, registry.RegisterCodec(new(wal.FlateCodec)), "built-in codecs must not be registered")
+
+	w, err := wal.Open("/wal", registry, logger, wal.WithFS(fs), wal.WithCompression(codec))
+	require.NoError(t, err)
+
+	e := &waltest.ExampleEntry2{Name: strings.Repeat("foo", 1000)}
+	_, err = w.Write(e)
+	require.NoError(t, err)
+
+	err = w.Replay(0, func(_ uint32, actual wal.Entry) error {
+		assert.Equal(t, e, actual)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, codec.decompressed)
+	require.NoError(t, w.Close())
+}
+
+func TestWAL_Compression_ReservedCodecID(t *testing.T) {
+	fs := waltest.NewMemFS()
+	logger := zaptest.Logger(t)
+	registry := wal.NewEntryRegistry(func() wal.Entry { return new(waltest.ExampleEntry1) })
+
+	for _, id := range []wal.CodecID{0, wal.CodecFlate, 127} {
+		codec := &reservedCodec{FlateCodec: new(wal.FlateCodec), id: id}
+		assert.Error(t, registry.RegisterCodec(codec), "CodecID %d is reserved", id)
+
+		_, err := wal.Open("/wal", registry, logger, wal.WithFS(fs), wal.WithCompression(codec))
+		assert.Error(t, err, "CodecID %d is reserved", id)
+	}
+
+	t.Log("CodecID 0 would mark compressed records as uncompressed")
+	err := registry.RegisterCodec(&reservedCodec{FlateCodec: new(wal.FlateCodec)})
+	assert.EqualError(t, err, "invalid CodecID 0: custom codecs must use an ID of 128 or higher")
+
+	_, err = wal.Open("/wal", registry, logger, wal.WithFS(fs), wal.WithCompression(&reservedCodec{FlateCodec: new(wal.FlateCodec)}))
+	assert.EqualError(t, err, "invalid compression codec: invalid CodecID 0: custom codecs must use an ID of 128 or higher")
+}
+
+// reservedCodec is a wal.Codec which uses a CodecID that is reserved for the
+// WAL itself.
+type reservedCodec struct {
+	*wal.FlateCodec
+	id wal.CodecID
+}
+
+func (c *reservedCodec) ID() wal.CodecID {
+	return c.id
+}
+
+// customCodec is a wal.Codec with a custom CodecID.
+type customCodec struct {
+	*wal.FlateCodec
+	decompressed int
+}
+
+func (*customCodec) ID() wal.CodecID {
+	return 200
+}
+
+func (c *customCodec) Decompress(dst, src []byte) ([]byte, error) {
+	c.decompressed++
+	return c.FlateCodec.Decompress(dst, src)
+}
+
+func TestWAL_Compression_LegacySegment(t *testing.T) {
+	fs := waltest.NewMemFS()
+	logger := zaptest.Logger(t)
+	require.NoError(t, fs.MkdirAll("/wal"))
+
+	t.Log("Write a legacy segment without header")
+	f, err := fs.OpenFile("/wal/1.wal", os.O_CREATE|os.O_WRONLY, 0666)
+	require.NoError(t, err)
+	e1 := &waltest.ExampleEntry1{ID: 1, Point: []float32{1, 2}}
+	payload := e1.EncodePayload(nil)
+	sw := wal.NewSegmentWriter(f)
+	require.NoError(t, sw.Write(1, e1.Type(), crc32.ChecksumIEEE(payload), payload))
+	require.NoError(t, sw.Close())
+
+	w, err := wal.Open("/wal", waltest.ExampleEntries, logger, wal.WithFS(fs), wal.WithCompression(new(wal.FlateCodec)))
+	require.NoError(t, err)
+
+	t.Log("Compressed entries cannot be written to legacy segments")
+	e2 := &waltest.ExampleEntry2{Name: strings.Repeat("foo", 1000)}
+	offset, err := w.Write(e2)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, offset)
+
+	names, err := fs.List("/wal")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.wal", "2.wal"}, names)
+
+	var actual []wal.Entry
+	err = w.Replay(0, func(_ uint32, e wal.Entry) error {
+		actual = append(actual, e)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []wal.Entry{e1, e2}, actual)
+	require.NoError(t, w.Close())
+}
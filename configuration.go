@@ -9,9 +9,13 @@ import (
 // Default configuration options. You can use the DefaultConfiguration() function
 // to create a Configuration instance that uses these constants.
 const (
-	DefaultWriteBufferSize  = 16 * 1024
-	DefaultMaxSegmentSize   = 10 * 1024 * 1024
-	DefaultEntryPayloadSize = 128 // TODO: no clue if this a good default and if a *default* here makes sense generally
+	DefaultWriteBufferSize      = 16 * 1024
+	DefaultMaxSegmentSize       = 10 * 1024 * 1024
+	DefaultEntryPayloadSize     = 128 // TODO: no clue if this a good default and if a *default* here makes sense generally
+	DefaultRetentionInterval    = time.Minute
+	DefaultArchiveRetries       = 3
+	DefaultArchiveRetryDelay    = time.Second
+	DefaultCompressionThreshold = 256
 )
 
 // Configuration contains all settings of a write-ahead log.
@@ -23,6 +27,92 @@ type Configuration struct {
 	// SyncDelay is the duration to wait for syncing writes to disk. The default
 	// value 0 will cause every write to be synced immediately.
 	SyncDelay time.Duration
+
+	// PreallocateSegments enables allocating the disk space of new segment
+	// files up to the MaxSegmentSize when they are created. This way, each
+	// fsync does not also have to persist updated file size metadata, which
+	// improves write throughput.
+	PreallocateSegments bool
+
+	// RecycleSegments is the number of segment files that the WAL keeps in a
+	// pool for reuse. Instead of creating a new file for each new segment, the
+	// WAL takes a file from this pool and truncating the WAL via
+	// WAL.TruncateFront(…) returns segment files to the pool instead of
+	// deleting them. This saves file system metadata operations. Segments
+	// that are deleted by the FullPolicyDeleteOldest are never recycled,
+	// since the pool would keep on using their disk space. The default value
+	// 0 disables segment recycling.
+	RecycleSegments int
+
+	// MaxSegments is the maximum number of segment files the WAL may use.
+	// MaxTotalSize is the maximum total size of all segment files in bytes.
+	// Both quotas are checked before a new segment is created. The default
+	// value 0 means that the WAL is not limited.
+	MaxSegments  int
+	MaxTotalSize int
+
+	// MinFreeSpace is the number of bytes that must remain free on the disk
+	// after creating a new segment of MaxSegmentSize. This quota is only
+	// checked if the FS implements the FreeSpaceFS interface. The default
+	// value 0 disables the check.
+	MinFreeSpace int
+
+	// FullPolicy defines what happens when the WAL reaches one of its quotas.
+	// By default, writes are rejected with ErrLogFull.
+	FullPolicy FullPolicy
+
+	// RetentionMaxSize, RetentionMaxSegments and RetentionMaxAge define which
+	// old segments the WAL deletes automatically. The WAL keeps at most
+	// RetentionMaxSize bytes in at most RetentionMaxSegments segment files and
+	// deletes all segments whose newest entry is older than RetentionMaxAge.
+	// The age of a segment is determined by the timestamp of its last record,
+	// if RecordTimestamps is enabled. Otherwise, or if the segment has no
+	// timestamped records, the modification time of the segment file is used
+	// instead, which is reset when a segment is compressed, copied or
+	// restored. Segments are only deleted if all their entries are at or
+	// before the checkpoint (see WAL.SetCheckpoint(…)). The default value 0
+	// disables the corresponding retention rule.
+	RetentionMaxSize     int
+	RetentionMaxSegments int
+	RetentionMaxAge      time.Duration
+
+	// RetentionInterval is the interval at which a background goroutine
+	// enforces the retention rules. It is only started if at least one
+	// retention rule is enabled.
+	RetentionInterval time.Duration
+
+	// ArchiveRetries is the number of times the WAL retries to archive a
+	// segment if the Archiver returned an error. Between two attempts, the WAL
+	// waits for ArchiveRetryDelay. Segments are archived in the background,
+	// so the WAL keeps on accepting writes in the meantime.
+	ArchiveRetries    int
+	ArchiveRetryDelay time.Duration
+
+	// CompressionThreshold is the minimum size of an entry payload in bytes
+	// that is compressed, if compression was enabled using the
+	// WithCompression(…) option. Smaller payloads are written uncompressed
+	// since compressing them usually does not pay off.
+	CompressionThreshold int
+
+	// CompressSegments enables compressing sealed segments with gzip in the
+	// background. Once the WAL rolls over to a new segment, the previous
+	// segment (e.g. "7.wal") is replaced by a compressed copy ("7.wal.gz").
+	// Compressed segments are read transparently but never recycled.
+	CompressSegments bool
+
+	// RecordTimestamps enables storing the time at which each record was
+	// written in its metadata. The timestamp can be read via
+	// SegmentReader.Timestamp() without decoding the entry. Timestamps never
+	// decrease, even if the wall clock is turned back.
+	RecordTimestamps bool
+
+	// RecordLengths enables storing the length of the payload with every
+	// record, even if the record has no other metadata. This costs five
+	// additional bytes per record but allows readers to skip entries whose
+	// EntryType they do not know (see RawEntry). Additionally, the payloads of
+	// such records are skipped without reading them into memory when the WAL
+	// is opened or replayed from a later offset.
+	RecordLengths bool
 }
 
 // MarshalLogObject implements the zapcore.ObjectMarshaler interface.
@@ -31,6 +121,22 @@ func (c Configuration) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 	enc.AddInt("max_segment_bytes", c.MaxSegmentSize)
 	enc.AddInt("entry_payload_bytes", c.EntryPayloadSize)
 	enc.AddDuration("sync_delay", c.SyncDelay)
+	enc.AddBool("preallocate_segments", c.PreallocateSegments)
+	enc.AddInt("recycle_segments", c.RecycleSegments)
+	enc.AddInt("max_segments", c.MaxSegments)
+	enc.AddInt("max_total_bytes", c.MaxTotalSize)
+	enc.AddInt("min_free_bytes", c.MinFreeSpace)
+	enc.AddString("full_policy", c.FullPolicy.String())
+	enc.AddInt("retention_max_bytes", c.RetentionMaxSize)
+	enc.AddInt("retention_max_segments", c.RetentionMaxSegments)
+	enc.AddDuration("retention_max_age", c.RetentionMaxAge)
+	enc.AddDuration("retention_interval", c.RetentionInterval)
+	enc.AddInt("archive_retries", c.ArchiveRetries)
+	enc.AddDuration("archive_retry_delay", c.ArchiveRetryDelay)
+	enc.AddInt("compression_threshold_bytes", c.CompressionThreshold)
+	enc.AddBool("compress_segments", c.CompressSegments)
+	enc.AddBool("record_timestamps", c.RecordTimestamps)
+	enc.AddBool("record_lengths", c.RecordLengths)
 
 	return nil
 }
@@ -39,9 +145,13 @@ func (c Configuration) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 // default WAL parameters.
 func DefaultConfiguration() Configuration {
 	return Configuration{
-		WriteBufferSize:  DefaultWriteBufferSize,
-		MaxSegmentSize:   DefaultMaxSegmentSize,
-		EntryPayloadSize: DefaultEntryPayloadSize,
-		SyncDelay:        0, // sync every write to disk immediately
+		WriteBufferSize:      DefaultWriteBufferSize,
+		MaxSegmentSize:       DefaultMaxSegmentSize,
+		EntryPayloadSize:     DefaultEntryPayloadSize,
+		SyncDelay:            0, // sync every write to disk immediately
+		RetentionInterval:    DefaultRetentionInterval,
+		ArchiveRetries:       DefaultArchiveRetries,
+		ArchiveRetryDelay:    DefaultArchiveRetryDelay,
+		CompressionThreshold: DefaultCompressionThreshold,
 	}
 }
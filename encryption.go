@@ -0,0 +1,207 @@
+package wal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrAuthenticationFailed is returned by SegmentReader.Decode() if an encrypted
+// entry could not be authenticated, i.e. because it was decrypted with the
+// wrong key or because it was tampered with.
+var ErrAuthenticationFailed = errors.New("WAL entry authentication failed")
+
+// ErrUnknownKey is returned by SegmentReader.Decode() if the key which is
+// needed to decrypt an entry is not known by the KeyProvider or if no
+// KeyProvider was configured at all.
+var ErrUnknownKey = errors.New("unknown WAL encryption key")
+
+// KeyID identifies a key of a KeyProvider. The ID of the key which was used to
+// encrypt an entry is stored together with each encrypted record, so entries
+// remain readable after the current key was rotated.
+type KeyID uint32
+
+// A KeyProvider supplies the keys to encrypt and decrypt entries using AES-GCM.
+// Use the WithEncryption(…) option to enable encryption when writing entries.
+//
+// Each key must be 16, 24 or 32 bytes long to select AES-128, AES-192 or
+// AES-256. The key of a given KeyID must never change.
+type KeyProvider interface {
+	// CurrentKey returns the key which is used to encrypt new entries and its
+	// ID.
+	CurrentKey() (KeyID, []byte, error)
+
+	// Key returns the key with the given ID. The returned error should wrap
+	// ErrUnknownKey if the key does not exist.
+	Key(id KeyID) ([]byte, error)
+}
+
+// KeyRing is a KeyProvider which keeps all keys in memory. The key that was
+// added last is used to encrypt new entries. To rotate keys, simply add a new
+// key while keeping the old keys in the ring as long as there are segments
+// which have been encrypted with them.
+type KeyRing struct {
+	mu      sync.RWMutex
+	keys    map[KeyID][]byte
+	current KeyID
+}
+
+// NewKeyRing creates a new and empty KeyRing.
+func NewKeyRing() *KeyRing {
+	return &KeyRing{keys: map[KeyID][]byte{}}
+}
+
+// Add adds a key to the ring and uses it to encrypt all new entries. An error
+// is returned if the key has an invalid size or if the ID was already used.
+func (k *KeyRing) Add(id KeyID, key []byte) error {
+	if _, err := aes.NewCipher(key); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if _, ok := k.keys[id]; ok {
+		return fmt.Errorf("key ID %d was already added to the KeyRing", id)
+	}
+
+	k.keys[id] = append([]byte(nil), key...)
+	k.current = id
+
+	return nil
+}
+
+// CurrentKey implements the KeyProvider interface.
+func (k *KeyRing) CurrentKey() (KeyID, []byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	key, ok := k.keys[k.current]
+	if !ok {
+		return 0, nil, errors.New("KeyRing does not contain any keys")
+	}
+
+	return k.current, key, nil
+}
+
+// Key implements the KeyProvider interface.
+func (k *KeyRing) Key(id KeyID) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %d", ErrUnknownKey, id)
+	}
+
+	return key, nil
+}
+
+// encryption encrypts and decrypts record payloads with AES-GCM. The payload
+// of an encrypted record consists of a random nonce, followed by the sealed
+// payload which includes the authentication tag. The offset, entry type, codec
+// and metadata of the record are authenticated as additional data, so an
+// encrypted payload cannot be moved to another record without being detected.
+type encryption struct {
+	keys KeyProvider
+
+	mu      sync.Mutex
+	ciphers map[KeyID]cipher.AEAD // keys never change, so we can cache their ciphers
+}
+
+func newEncryption(keys KeyProvider) *encryption {
+	return &encryption{
+		keys:    keys,
+		ciphers: map[KeyID]cipher.AEAD{},
+	}
+}
+
+// seal appends the encrypted payload of the record at the given offset to dst
+// using the current key and returns the result together with the ID of the key.
+func (e *encryption) seal(dst []byte, offset uint32, rec record) ([]byte, KeyID, error) {
+	id, key, err := e.keys.CurrentKey()
+	if err != nil {
+		return dst, 0, err
+	}
+
+	aead, err := e.cipher(id, key)
+	if err != nil {
+		return dst, 0, err
+	}
+
+	start := len(dst)
+	dst = append(dst, make([]byte, aead.NonceSize())...)
+	nonce := dst[start:]
+	if _, err := rand.Read(nonce); err != nil {
+		return dst[:start], 0, fmt.Errorf("generating nonce: %w", err)
+	}
+
+	return aead.Seal(dst, nonce, rec.payload, additionalData(offset, rec)), id, nil
+}
+
+// open appends the decrypted payload of the record at the given offset to dst
+// and returns the result.
+func (e *encryption) open(dst []byte, offset uint32, rec record) ([]byte, error) {
+	key, err := e.keys.Key(rec.keyID)
+	if err != nil {
+		return dst, err
+	}
+
+	aead, err := e.cipher(rec.keyID, key)
+	if err != nil {
+		return dst, err
+	}
+
+	if len(rec.payload) < aead.NonceSize() {
+		return dst, ErrAuthenticationFailed
+	}
+
+	nonce, ciphertext := rec.payload[:aead.NonceSize()], rec.payload[aead.NonceSize():]
+	dst, err = aead.Open(dst, nonce, ciphertext, additionalData(offset, rec))
+	if err != nil {
+		return dst, ErrAuthenticationFailed
+	}
+
+	return dst, nil
+}
+
+func (e *encryption) cipher(id KeyID, key []byte) (cipher.AEAD, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if aead, ok := e.ciphers[id]; ok {
+		return aead, nil
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key %d: %w", id, err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	e.ciphers[id] = aead
+	return aead, nil
+}
+
+// additionalData returns the fields of the record at the given offset which are
+// authenticated but not encrypted. The flags determine which of the optional
+// metadata fields follow, so the encoding is unambiguous.
+func additionalData(offset uint32, rec record) []byte {
+	const flags = recordFlagWideType | recordFlagVersion | recordFlagTimestamp | recordFlagHeaders
+
+	b := make([]byte, 0, 4+1+2+1+1+8+2+len(rec.headers))
+	b = binary.BigEndian.AppendUint32(b, offset)
+	b = append(b, rec.flags()&flags)
+	b = rec.appendType(b)
+	b = append(b, byte(rec.codec))
+	b = rec.appendMetadataPrefix(b)
+	return append(b, rec.headers...)
+}
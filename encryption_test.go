@@ -0,0 +1,156 @@
+package wal_test
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fgrosse/wal"
+	"github.com/fgrosse/wal/waltest"
+	"github.com/fgrosse/zaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyRing(t *testing.T) {
+	keys := wal.NewKeyRing()
+
+	_, _, err := keys.CurrentKey()
+	assert.Error(t, err)
+
+	assert.Error(t, keys.Add(1, []byte("too short")))
+	require.NoError(t, keys.Add(1, bytes.Repeat([]byte{1}, 16)))
+	require.NoError(t, keys.Add(2, bytes.Repeat([]byte{2}, 32)))
+	assert.Error(t, keys.Add(1, bytes.Repeat([]byte{3}, 16)), "key IDs must be unique")
+
+	id, key, err := keys.CurrentKey()
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, id)
+	assert.Equal(t, bytes.Repeat([]byte{2}, 32), key)
+
+	key, err = keys.Key(1)
+	require.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{1}, 16), key)
+
+	_, err = keys.Key(3)
+	assert.ErrorIs(t, err, wal.ErrUnknownKey)
+}
+
+func TestWAL_Encryption(t *testing.T) {
+	fs := waltest.NewMemFS()
+	logger := zaptest.Logger(t)
+	keys := wal.NewKeyRing()
+	require.NoError(t, keys.Add(1, bytes.Repeat([]byte{1}, 32)))
+
+	codec := new(wal.FlateCodec)
+	w, err := wal.Open("/wal", waltest.ExampleEntries, logger, wal.WithFS(fs), wal.WithEncryption(keys), wal.WithCompression(codec))
+	require.NoError(t, err)
+
+	secret := strings.Repeat("top secret ", 50)
+	expected := []wal.Entry{
+		&waltest.ExampleEntry1{ID: 1, Point: []float32{1, 2}},
+		&waltest.ExampleEntry2{Name: secret}, // compressed and encrypted
+	}
+
+	for _, e := range expected {
+		_, err := w.Write(e)
+		require.NoError(t, err)
+	}
+
+	t.Log("Rotating the key")
+	require.NoError(t, keys.Add(2, bytes.Repeat([]byte{2}, 32)))
+	e := &waltest.ExampleEntry2{Name: "also secret"}
+	expected = append(expected, e)
+	_, err = w.Write(e)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	content, err := fs.ReadFile("/wal/1.wal")
+	require.NoError(t, err)
+	assert.NotContains(t, string(content), "secret")
+
+	replay := func(opts ...wal.Option) ([]wal.Entry, error) {
+		opts = append(opts, wal.WithFS(fs), wal.ReadOnly())
+		w, err := wal.Open("/wal", waltest.ExampleEntries, logger, opts...)
+		require.NoError(t, err)
+
+		var actual []wal.Entry
+		err = w.Replay(0, func(_ uint32, e wal.Entry) error {
+			actual = append(actual, e)
+			return nil
+		})
+		return actual, err
+	}
+
+	t.Log("Entries of old keys should remain readable")
+	actual, err := replay(wal.WithEncryption(keys))
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+
+	t.Log("Entries cannot be decrypted without the KeyProvider")
+	_, err = replay()
+	assert.ErrorIs(t, err, wal.ErrUnknownKey)
+
+	t.Log("Entries cannot be decrypted if a key is missing")
+	incomplete := wal.NewKeyRing()
+	require.NoError(t, incomplete.Add(2, bytes.Repeat([]byte{2}, 32)))
+	_, err = replay(wal.WithEncryption(incomplete))
+	assert.ErrorIs(t, err, wal.ErrUnknownKey)
+
+	t.Log("Entries which are decrypted with the wrong key should fail authentication")
+	wrong := wal.NewKeyRing()
+	require.NoError(t, wrong.Add(1, bytes.Repeat([]byte{3}, 32)))
+	_, err = replay(wal.WithEncryption(wrong))
+	assert.ErrorIs(t, err, wal.ErrAuthenticationFailed)
+}
+
+func TestWAL_Encryption_MovedPayload(t *testing.T) {
+	fs := waltest.NewMemFS()
+	logger := zaptest.Logger(t)
+	keys := wal.NewKeyRing()
+	require.NoError(t, keys.Add(1, bytes.Repeat([]byte{1}, 32)))
+
+	w, err := wal.Open("/wal", waltest.ExampleEntries, logger, wal.WithFS(fs), wal.WithEncryption(keys))
+	require.NoError(t, err)
+
+	for _, name := range []string{"secret A", "secret B"} {
+		_, err := w.Write(&waltest.ExampleEntry2{Name: name})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, w.Close())
+
+	t.Log("Swapping the encrypted records while keeping their offsets")
+	content, err := fs.ReadFile("/wal/1.wal")
+	require.NoError(t, err)
+
+	// Both records have the same size. Only the offset and the marker of the
+	// extended record format are kept in place, so the checksums of the
+	// records remain valid.
+	first := bytes.Index(content, []byte{0, 0, 0, 1, 0xFF})
+	second := bytes.Index(content, []byte{0, 0, 0, 2, 0xFF})
+	require.True(t, first > 0 && second-first == len(content)-second)
+	swapped := append([]byte(nil), content...)
+	copy(swapped[first+5:second], content[second+5:])
+	copy(swapped[second+5:], content[first+5:second])
+
+	f, err := fs.OpenFile("/wal/1.wal", os.O_WRONLY|os.O_TRUNC, 0666)
+	require.NoError(t, err)
+	_, err = f.Write(swapped)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	w, err = wal.Open("/wal", waltest.ExampleEntries, logger, wal.WithFS(fs), wal.WithEncryption(keys), wal.ReadOnly())
+	require.NoError(t, err)
+
+	err = w.Replay(0, func(uint32, wal.Entry) error { return nil })
+	assert.ErrorIs(t, err, wal.ErrAuthenticationFailed, "a payload that was moved to another offset must not be decrypted")
+}
+
+func TestWAL_Encryption_InvalidKey(t *testing.T) {
+	logger := zaptest.Logger(t)
+
+	_, err := wal.Open("/wal", waltest.ExampleEntries, logger, wal.WithFS(waltest.NewMemFS()), wal.WithEncryption(wal.NewKeyRing()))
+	assert.Error(t, err)
+}
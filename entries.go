@@ -0,0 +1,274 @@
+package wal
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// JSONEntry is an Entry whose payload is the JSON encoding of its Value. Use
+// JSONEntryConstructor(…) to register it at an EntryRegistry:
+//
+//	registry.Register(wal.JSONEntryConstructor[UserCreated](1))
+//	…
+//	_, err = w.Write(wal.NewJSONEntry(1, UserCreated{Name: "Alice"}))
+//
+// The EntryType must be unique within the EntryRegistry.
+type JSONEntry[T any] struct {
+	EntryType EntryType
+	Value     T
+}
+
+// NewJSONEntry creates a new JSONEntry with the given type and value.
+func NewJSONEntry[T any](typ EntryType, value T) *JSONEntry[T] {
+	return &JSONEntry[T]{EntryType: typ, Value: value}
+}
+
+// JSONEntryConstructor returns an EntryConstructor which creates a JSONEntry
+// of the given type.
+func JSONEntryConstructor[T any](typ EntryType) EntryConstructor {
+	return func() Entry { return &JSONEntry[T]{EntryType: typ} }
+}
+
+// Type implements the Entry interface.
+func (e *JSONEntry[T]) Type() EntryType { return e.EntryType }
+
+// EncodePayload implements the Entry interface. It panics if the value cannot
+// be encoded. WAL.Write(…) uses TryEncodePayload(…) instead, which returns an
+// error.
+func (e *JSONEntry[T]) EncodePayload(b []byte) []byte {
+	return mustEncode(e.TryEncodePayload(b))
+}
+
+// TryEncodePayload implements the EntryEncoder interface.
+func (e *JSONEntry[T]) TryEncodePayload(b []byte) ([]byte, error) {
+	b, err := encodeFramed(b, func(buf *bytes.Buffer) error {
+		return json.NewEncoder(buf).Encode(e.Value)
+	})
+	if err != nil {
+		return b, fmt.Errorf("encoding %T as JSON: %w", e.Value, err)
+	}
+
+	// Strip the trailing newline, which is added by the json.Encoder.
+	b = b[:len(b)-1]
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+// ReadPayload implements the Entry interface.
+func (*JSONEntry[T]) ReadPayload(r io.Reader) ([]byte, error) {
+	return appendFramed(nil, r)
+}
+
+// AppendPayload implements the PayloadAppender interface.
+func (*JSONEntry[T]) AppendPayload(dst []byte, r io.Reader) ([]byte, error) {
+	return appendFramed(dst, r)
+}
+
+// DecodePayload implements the Entry interface.
+func (e *JSONEntry[T]) DecodePayload(b []byte) error {
+	data, err := framedData(b)
+	if err != nil {
+		return err
+	}
+
+	// Reset the value, since json.Unmarshal(…) merges into existing maps and
+	// keeps fields which are not part of the payload.
+	var zero T
+	e.Value = zero
+	return json.Unmarshal(data, &e.Value)
+}
+
+// GobEntry is an Entry whose payload is the gob encoding of its Value. Since
+// each entry is encoded independently, its payload always contains the type
+// information of T. Use GobEntryConstructor(…) to register it at an
+// EntryRegistry.
+type GobEntry[T any] struct {
+	EntryType EntryType
+	Value     T
+}
+
+// NewGobEntry creates a new GobEntry with the given type and value.
+func NewGobEntry[T any](typ EntryType, value T) *GobEntry[T] {
+	return &GobEntry[T]{EntryType: typ, Value: value}
+}
+
+// GobEntryConstructor returns an EntryConstructor which creates a GobEntry of
+// the given type.
+func GobEntryConstructor[T any](typ EntryType) EntryConstructor {
+	return func() Entry { return &GobEntry[T]{EntryType: typ} }
+}
+
+// Type implements the Entry interface.
+func (e *GobEntry[T]) Type() EntryType { return e.EntryType }
+
+// EncodePayload implements the Entry interface. It panics if the value cannot
+// be encoded. WAL.Write(…) uses TryEncodePayload(…) instead, which returns an
+// error.
+func (e *GobEntry[T]) EncodePayload(b []byte) []byte {
+	return mustEncode(e.TryEncodePayload(b))
+}
+
+// TryEncodePayload implements the EntryEncoder interface.
+func (e *GobEntry[T]) TryEncodePayload(b []byte) ([]byte, error) {
+	b, err := encodeFramed(b, func(buf *bytes.Buffer) error {
+		return gob.NewEncoder(buf).Encode(&e.Value)
+	})
+	if err != nil {
+		return b, fmt.Errorf("encoding %T as gob: %w", e.Value, err)
+	}
+
+	return b, nil
+}
+
+// ReadPayload implements the Entry interface.
+func (*GobEntry[T]) ReadPayload(r io.Reader) ([]byte, error) {
+	return appendFramed(nil, r)
+}
+
+// AppendPayload implements the PayloadAppender interface.
+func (*GobEntry[T]) AppendPayload(dst []byte, r io.Reader) ([]byte, error) {
+	return appendFramed(dst, r)
+}
+
+// DecodePayload implements the Entry interface.
+func (e *GobEntry[T]) DecodePayload(b []byte) error {
+	data, err := framedData(b)
+	if err != nil {
+		return err
+	}
+
+	// Reset the value, since gob does not transmit zero values, which would
+	// otherwise keep the values of a previously decoded payload.
+	var zero T
+	e.Value = zero
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(&e.Value)
+}
+
+// binaryMarshaler is the constraint of the BinaryMarshalerEntry. It allows to
+// call the methods of *T, while the entry can hold a T.
+type binaryMarshaler[T any] interface {
+	*T
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}
+
+// BinaryMarshalerEntry is an Entry whose payload is the binary encoding of its
+// Value, which must implement the encoding.BinaryMarshaler and
+// encoding.BinaryUnmarshaler interfaces (e.g. a time.Time or a protobuf-style
+// generated type). Use BinaryMarshalerEntryConstructor(…) to register it at an
+// EntryRegistry:
+//
+//	registry.Register(wal.BinaryMarshalerEntryConstructor[time.Time](1))
+//	…
+//	_, err = w.Write(wal.NewBinaryMarshalerEntry(1, time.Now()))
+type BinaryMarshalerEntry[T any, PT binaryMarshaler[T]] struct {
+	EntryType EntryType
+	Value     T
+}
+
+// NewBinaryMarshalerEntry creates a new BinaryMarshalerEntry with the given
+// type and value.
+func NewBinaryMarshalerEntry[T any, PT binaryMarshaler[T]](typ EntryType, value T) *BinaryMarshalerEntry[T, PT] {
+	return &BinaryMarshalerEntry[T, PT]{EntryType: typ, Value: value}
+}
+
+// BinaryMarshalerEntryConstructor returns an EntryConstructor which creates a
+// BinaryMarshalerEntry of the given type.
+func BinaryMarshalerEntryConstructor[T any, PT binaryMarshaler[T]](typ EntryType) EntryConstructor {
+	return func() Entry { return &BinaryMarshalerEntry[T, PT]{EntryType: typ} }
+}
+
+// Type implements the Entry interface.
+func (e *BinaryMarshalerEntry[T, PT]) Type() EntryType { return e.EntryType }
+
+// EncodePayload implements the Entry interface. It panics if the value cannot
+// be encoded. WAL.Write(…) uses TryEncodePayload(…) instead, which returns an
+// error.
+func (e *BinaryMarshalerEntry[T, PT]) EncodePayload(b []byte) []byte {
+	return mustEncode(e.TryEncodePayload(b))
+}
+
+// TryEncodePayload implements the EntryEncoder interface.
+func (e *BinaryMarshalerEntry[T, PT]) TryEncodePayload(b []byte) ([]byte, error) {
+	b, err := encodeFramed(b, func(buf *bytes.Buffer) error {
+		data, err := PT(&e.Value).MarshalBinary()
+		buf.Write(data)
+		return err
+	})
+	if err != nil {
+		return b, fmt.Errorf("encoding %T: %w", e.Value, err)
+	}
+
+	return b, nil
+}
+
+// ReadPayload implements the Entry interface.
+func (*BinaryMarshalerEntry[T, PT]) ReadPayload(r io.Reader) ([]byte, error) {
+	return appendFramed(nil, r)
+}
+
+// AppendPayload implements the PayloadAppender interface.
+func (*BinaryMarshalerEntry[T, PT]) AppendPayload(dst []byte, r io.Reader) ([]byte, error) {
+	return appendFramed(dst, r)
+}
+
+// DecodePayload implements the Entry interface.
+func (e *BinaryMarshalerEntry[T, PT]) DecodePayload(b []byte) error {
+	data, err := framedData(b)
+	if err != nil {
+		return err
+	}
+
+	return PT(&e.Value).UnmarshalBinary(data)
+}
+
+// encodeFramed encodes a payload into b which is prefixed by its length (4B).
+// The buffer that is passed to encode already contains the length prefix.
+func encodeFramed(b []byte, encode func(*bytes.Buffer) error) ([]byte, error) {
+	buf := bytes.NewBuffer(b[:0])
+	buf.Write([]byte{0, 0, 0, 0})
+	if err := encode(buf); err != nil {
+		return b, err
+	}
+
+	b = buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+// appendFramed reads a payload that was encoded by encodeFramed(…), including
+// its length prefix, and appends it to dst.
+func appendFramed(dst []byte, r io.Reader) ([]byte, error) {
+	start := len(dst)
+	dst, err := readLength(dst, r, 4)
+	if err != nil {
+		return dst[:start], err
+	}
+
+	return readLength(dst, r, int(binary.BigEndian.Uint32(dst[start:])))
+}
+
+// framedData returns the data of a payload that was encoded by encodeFramed(…).
+func framedData(b []byte) ([]byte, error) {
+	if len(b) < 4 || int(binary.BigEndian.Uint32(b)) != len(b)-4 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return b[4:], nil
+}
+
+// mustEncode panics if an Entry could not be encoded by EncodePayload(…).
+func mustEncode(b []byte, err error) []byte {
+	if err != nil {
+		panic(err)
+	}
+
+	return b
+}
@@ -0,0 +1,74 @@
+package wal_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fgrosse/wal"
+	"github.com/fgrosse/wal/waltest"
+	"github.com/fgrosse/zaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type userCreated struct {
+	Name  string
+	Email string
+	Tags  []string
+}
+
+const (
+	userCreatedJSON wal.EntryType = iota + 1
+	userCreatedGob
+	timestampEntry
+)
+
+func TestEntryAdapters(t *testing.T) {
+	registry := wal.NewEntryRegistry(
+		wal.JSONEntryConstructor[userCreated](userCreatedJSON),
+		wal.GobEntryConstructor[userCreated](userCreatedGob),
+		wal.BinaryMarshalerEntryConstructor[time.Time](timestampEntry),
+	)
+
+	fs := waltest.NewMemFS()
+	logger := zaptest.Logger(t)
+	w, err := wal.Open("/wal", registry, logger, wal.WithFS(fs))
+	require.NoError(t, err)
+
+	user := userCreated{Name: "Alice", Email: "alice@example.com", Tags: []string{"admin"}}
+	now := time.Date(2023, 4, 5, 6, 7, 8, 9, time.UTC)
+	expected := []wal.Entry{
+		wal.NewJSONEntry(userCreatedJSON, user),
+		wal.NewGobEntry(userCreatedGob, user),
+		wal.NewBinaryMarshalerEntry(timestampEntry, now),
+	}
+
+	for _, e := range expected {
+		_, err := w.Write(e)
+		require.NoError(t, err)
+	}
+
+	t.Log("Entries that cannot be encoded should be rejected")
+	_, err = w.Write(wal.NewJSONEntry(userCreatedJSON, make(chan int)))
+	assert.Error(t, err)
+	assert.Panics(t, func() {
+		wal.NewJSONEntry(userCreatedJSON, make(chan int)).EncodePayload(nil)
+	})
+
+	require.NoError(t, w.Close())
+
+	w, err = wal.Open("/wal", registry, logger, wal.WithFS(fs), wal.ReadOnly())
+	require.NoError(t, err)
+
+	var actual []wal.Entry
+	err = w.Replay(0, func(_ uint32, e wal.Entry) error {
+		actual = append(actual, e)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+
+	content, err := fs.ReadFile("/wal/1.wal")
+	require.NoError(t, err)
+	assert.Contains(t, string(content), `{"Name":"Alice","Email":"alice@example.com","Tags":["admin"]}`)
+}
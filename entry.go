@@ -25,5 +25,53 @@ type Entry interface {
 }
 
 // EntryType is used to distinguish different types of messages that we write
-// to the WAL.
-type EntryType uint8
+// to the WAL. Types up to 254 are stored with a single byte, so records of
+// older versions of this package remain readable. Larger types are stored in
+// the extended record format, which requires segments with a SegmentHeader.
+// Use an EntryNamespace to reserve a range of EntryTypes for a sub-system.
+type EntryType uint16
+
+// EntryEncoder is an optional interface for Entry implementations whose
+// encoding can fail, e.g. because it relies on a generic encoding package. If
+// an Entry implements this interface, WAL.Write(…) calls TryEncodePayload(…)
+// instead of EncodePayload(…) and returns its error.
+type EntryEncoder interface {
+	// TryEncodePayload works like Entry.EncodePayload(…) but returns an error
+	// if the entry cannot be encoded.
+	TryEncodePayload([]byte) ([]byte, error)
+}
+
+// PayloadAppender is an optional interface for Entry implementations which can
+// read their payload into an existing buffer. If the SegmentReader reuses its
+// entries (see SegmentReader.SetReuseEntries(…)), it calls AppendPayload(…)
+// instead of ReadPayload(…), so reading a record does not allocate.
+type PayloadAppender interface {
+	// AppendPayload works like Entry.ReadPayload(…) but appends the payload
+	// to dst and returns the extended buffer.
+	AppendPayload(dst []byte, r io.Reader) ([]byte, error)
+}
+
+// EntryVersion is the schema version of an Entry. Entries which do not
+// implement the VersionedEntry interface have the version zero.
+type EntryVersion uint8
+
+// VersionedEntry is an optional interface for Entry implementations whose
+// encoding evolves over time. Each version of the same EntryType is usually a
+// separate Go type, which is registered at the EntryRegistry. The version is
+// stored with each record, so the SegmentReader can decode it with the Entry
+// of the same version. An Upcaster can then convert the decoded Entry into the
+// current version (see EntryRegistry.RegisterUpcaster(…)).
+type VersionedEntry interface {
+	Entry
+	Version() EntryVersion
+}
+
+// entryVersion returns the version of the Entry or zero if it is not a
+// VersionedEntry.
+func entryVersion(e Entry) EntryVersion {
+	if v, ok := e.(VersionedEntry); ok {
+		return v.Version()
+	}
+
+	return 0
+}
@@ -1,12 +1,40 @@
 package wal
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrRegistryFrozen is returned when registering anything at an EntryRegistry
+// after EntryRegistry.Freeze() was called.
+var ErrRegistryFrozen = errors.New("EntryRegistry is frozen")
 
 // The EntryRegistry keeps track of all known Entry implementations.
 // This is necessary in order to instantiate the correct types when loading WAL
 // segments.
+//
+// It is safe to register entries while the registry is used concurrently,
+// e.g. by a SegmentReader. Once all entries have been registered, the registry
+// can be made immutable via EntryRegistry.Freeze(), which also removes the
+// locking overhead when entries are read.
 type EntryRegistry struct {
-	constructors map[EntryType]EntryConstructor
+	mu           sync.RWMutex
+	frozen       atomic.Bool // once frozen, the registry is read without locking
+	constructors map[entryKey]EntryConstructor
+	current      map[EntryType]EntryVersion // the latest registered version of each type
+	names        map[EntryType]string
+	upcasters    map[entryKey]Upcaster
+	namespaces   []*EntryNamespace
+	codecs       map[CodecID]Codec
+}
+
+// entryKey identifies a specific version of an EntryType.
+type entryKey struct {
+	typ     EntryType
+	version EntryVersion
 }
 
 // EntryConstructor is the constructor function of a specific Entry implementation.
@@ -18,7 +46,7 @@ type EntryConstructor func() Entry
 //
 // Alternatively, you can register the constructor functions using EntryRegistry.Register(…).
 func NewEntryRegistry(constructors ...EntryConstructor) *EntryRegistry {
-	r := &EntryRegistry{constructors: map[EntryType]EntryConstructor{}}
+	r := new(EntryRegistry)
 	for _, newEntry := range constructors {
 		err := r.Register(newEntry)
 		if err != nil {
@@ -30,30 +58,457 @@ func NewEntryRegistry(constructors ...EntryConstructor) *EntryRegistry {
 }
 
 // Register an EntryConstructor function. Each Entry will be registered with
-// the EntryType that is returned by the corresponding Entry.Type().
+// the EntryType that is returned by the corresponding Entry.Type() and, if it
+// is a VersionedEntry, with its version. This way, multiple versions of the
+// same EntryType can be registered.
 //
 // An error is returned if this constructor was already registered; i.e. a
 // constructor was already registered that creates an Entry with the same
-// EntryType as this constructor's Entry.
+// EntryType and version as this constructor's Entry.
 func (r *EntryRegistry) Register(constructor EntryConstructor) error {
+	return r.register(nil, "", constructor)
+}
+
+// RegisterNamed registers an EntryConstructor function like
+// EntryRegistry.Register(…) and additionally assigns a human-readable name to
+// its EntryType, e.g. "user_created". The name can be used by tools to display
+// entries (see EntryRegistry.Lookup(…)). All versions of an EntryType share the
+// same name and each name must be unique within the registry.
+func (r *EntryRegistry) RegisterNamed(name string, constructor EntryConstructor) error {
+	if name == "" {
+		return errors.New("entry name must not be empty")
+	}
+
+	return r.register(nil, name, constructor)
+}
+
+// register registers the constructor within the given namespace, which is
+// nil if the constructor is registered directly at the EntryRegistry.
+func (r *EntryRegistry) register(ns *EntryNamespace, name string, constructor EntryConstructor) error {
 	entry := constructor()
-	typ := entry.Type()
-	if existing, ok := r.constructors[typ]; ok {
-		return fmt.Errorf(`EntryType %d was already registered to type "%T"`, typ, existing())
+	key := entryKey{typ: entry.Type(), version: entryVersion(entry)}
+
+	if err := r.lock(); err != nil {
+		return err
+	}
+
+	defer r.mu.Unlock()
+
+	if owner := r.namespace(key.typ); owner != ns {
+		if owner == nil {
+			return fmt.Errorf("EntryType %d is outside of namespace %q", key.typ, ns.name)
+		}
+
+		return fmt.Errorf("EntryType %d is reserved for namespace %q", key.typ, owner.name)
+	}
+
+	if existing, ok := r.constructors[key]; ok {
+		if key.version == 0 {
+			return fmt.Errorf(`EntryType %d was already registered to type "%T"`, key.typ, existing())
+		}
+
+		return fmt.Errorf(`EntryType %d version %d was already registered to type "%T"`, key.typ, key.version, existing())
+	}
+
+	if name != "" {
+		if existing, ok := r.names[key.typ]; ok && existing != name {
+			return fmt.Errorf("EntryType %d was already registered with name %q", key.typ, existing)
+		}
+
+		for typ, existing := range r.names {
+			if existing == name && typ != key.typ {
+				return fmt.Errorf("entry name %q was already registered for EntryType %d", name, typ)
+			}
+		}
+	}
+
+	if r.constructors == nil {
+		r.constructors = map[entryKey]EntryConstructor{}
+		r.current = map[EntryType]EntryVersion{}
+		r.names = map[EntryType]string{}
+	}
+
+	r.constructors[key] = constructor
+	if current, ok := r.current[key.typ]; !ok || key.version > current {
+		r.current[key.typ] = key.version
+	}
+
+	if name != "" {
+		r.names[key.typ] = name
 	}
 
-	r.constructors[typ] = constructor
 	return nil
 }
 
+// Freeze makes the registry immutable. All further attempts to register
+// entries, upcasters, codecs or namespaces fail with ErrRegistryFrozen. Since
+// a frozen registry cannot change anymore, it is read without any locking.
+func (r *EntryRegistry) Freeze() {
+	r.mu.Lock()
+	r.frozen.Store(true)
+	r.mu.Unlock()
+}
+
+// lock write-locks the registry. If the registry is frozen, it is not locked
+// and ErrRegistryFrozen is returned instead.
+func (r *EntryRegistry) lock() error {
+	r.mu.Lock()
+	if r.frozen.Load() {
+		r.mu.Unlock()
+		return ErrRegistryFrozen
+	}
+
+	return nil
+}
+
+// EntryInfo describes an Entry that is registered at an EntryRegistry.
+type EntryInfo struct {
+	Type      EntryType
+	Version   EntryVersion
+	Name      string // the name of the EntryType or empty if it was registered without name
+	Namespace string // the name of the namespace of the EntryType or empty
+}
+
+// Types returns all registered entries, sorted by their EntryType and version.
+func (r *EntryRegistry) Types() []EntryInfo {
+	if !r.frozen.Load() {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+	}
+
+	types := make([]EntryInfo, 0, len(r.constructors))
+	for key := range r.constructors {
+		types = append(types, r.info(key))
+	}
+
+	sort.Slice(types, func(i, j int) bool {
+		if types[i].Type != types[j].Type {
+			return types[i].Type < types[j].Type
+		}
+
+		return types[i].Version < types[j].Version
+	})
+
+	return types
+}
+
+// Lookup returns the latest registered version of the EntryType. The boolean
+// return value is false if the EntryType was not registered.
+func (r *EntryRegistry) Lookup(typ EntryType) (EntryInfo, bool) {
+	if !r.frozen.Load() {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+	}
+
+	version, ok := r.current[typ]
+	if !ok {
+		return EntryInfo{}, false
+	}
+
+	return r.info(entryKey{typ: typ, version: version}), true
+}
+
+// LookupName returns the latest registered version of the EntryType with the
+// given name (see EntryRegistry.RegisterNamed(…)). The boolean return value is
+// false if no EntryType was registered with this name.
+func (r *EntryRegistry) LookupName(name string) (EntryInfo, bool) {
+	if !r.frozen.Load() {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+	}
+
+	for typ, n := range r.names {
+		if n == name {
+			return r.info(entryKey{typ: typ, version: r.current[typ]}), true
+		}
+	}
+
+	return EntryInfo{}, false
+}
+
+// info returns the EntryInfo of a registered entry.
+// The caller must ensure the registry is read-locked before calling this function.
+func (r *EntryRegistry) info(key entryKey) EntryInfo {
+	info := EntryInfo{Type: key.typ, Version: key.version, Name: r.names[key.typ]}
+	if ns := r.namespace(key.typ); ns != nil {
+		info.Namespace = ns.name
+	}
+
+	return info
+}
+
 // New instantiates a new Entry implementation that was previously registered
-// for the requested EntryType. An error is returned if no Entry was registered
-// for this type.
+// for the requested EntryType. If multiple versions of the EntryType have been
+// registered, the Entry of the latest version is returned. An error is
+// returned if no Entry was registered for this type.
 func (r *EntryRegistry) New(typ EntryType) (Entry, error) {
-	newEntry, ok := r.constructors[typ]
+	version, ok := r.currentVersion(typ)
 	if !ok {
 		return nil, fmt.Errorf("unknown WAL entry type %d", typ)
 	}
 
+	return r.NewVersion(typ, version)
+}
+
+// currentVersion returns the latest registered version of the EntryType.
+func (r *EntryRegistry) currentVersion(typ EntryType) (EntryVersion, bool) {
+	if !r.frozen.Load() {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+	}
+
+	version, ok := r.current[typ]
+	return version, ok
+}
+
+// NewVersion instantiates a new Entry implementation that was previously
+// registered for the requested EntryType and version. An error is returned if
+// no Entry was registered for this type and version.
+func (r *EntryRegistry) NewVersion(typ EntryType, version EntryVersion) (Entry, error) {
+	newEntry, ok := r.constructor(entryKey{typ: typ, version: version})
+	if !ok {
+		return nil, unknownEntryError(typ, version)
+	}
+
 	return newEntry(), nil
 }
+
+// unknownEntryError returns the error for an EntryType and version which is
+// not registered.
+func unknownEntryError(typ EntryType, version EntryVersion) error {
+	if version == 0 {
+		return fmt.Errorf("unknown WAL entry type %d", typ)
+	}
+
+	return fmt.Errorf("unknown WAL entry type %d version %d", typ, version)
+}
+
+// constructor returns the constructor of the given EntryType and version.
+func (r *EntryRegistry) constructor(key entryKey) (EntryConstructor, bool) {
+	if !r.frozen.Load() {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+	}
+
+	newEntry, ok := r.constructors[key]
+	return newEntry, ok
+}
+
+// An EntryNamespace reserves a range of EntryTypes of an EntryRegistry for a
+// sub-system, e.g. a library which writes its own entries into the WAL of an
+// application. Once a namespace is created, entries whose type is within its
+// range can only be registered via the namespace, so independent sub-systems
+// cannot accidentally use the same EntryType.
+type EntryNamespace struct {
+	name        string
+	first, last EntryType
+	registry    *EntryRegistry
+}
+
+// Namespace reserves the EntryTypes from first to last (inclusive) for the
+// namespace with the given name. An error is returned if the range overlaps
+// with another namespace or with an EntryType that was already registered
+// outside of this namespace, or if the name is already taken.
+func (r *EntryRegistry) Namespace(name string, first, last EntryType) (*EntryNamespace, error) {
+	if first > last {
+		return nil, fmt.Errorf("invalid range of namespace %q: first EntryType %d is larger than last EntryType %d", name, first, last)
+	}
+
+	if err := r.lock(); err != nil {
+		return nil, err
+	}
+
+	defer r.mu.Unlock()
+
+	for _, ns := range r.namespaces {
+		if ns.name == name {
+			return nil, fmt.Errorf("namespace %q was already registered", name)
+		}
+
+		if first <= ns.last && ns.first <= last {
+			return nil, fmt.Errorf("EntryTypes %d to %d of namespace %q overlap with namespace %q", first, last, name, ns.name)
+		}
+	}
+
+	for key := range r.constructors {
+		if key.typ >= first && key.typ <= last {
+			return nil, fmt.Errorf("EntryType %d of namespace %q was already registered", key.typ, name)
+		}
+	}
+
+	ns := &EntryNamespace{name: name, first: first, last: last, registry: r}
+	r.namespaces = append(r.namespaces, ns)
+	return ns, nil
+}
+
+// namespace returns the namespace which reserved the given EntryType or nil.
+// The caller must ensure the registry is read-locked before calling this function.
+func (r *EntryRegistry) namespace(typ EntryType) *EntryNamespace {
+	for _, ns := range r.namespaces {
+		if ns.Contains(typ) {
+			return ns
+		}
+	}
+
+	return nil
+}
+
+// Name returns the name of the namespace.
+func (ns *EntryNamespace) Name() string {
+	return ns.name
+}
+
+// Contains returns whether the EntryType is reserved for this namespace.
+func (ns *EntryNamespace) Contains(typ EntryType) bool {
+	return typ >= ns.first && typ <= ns.last
+}
+
+// Type returns the EntryType at index i of the namespace, i.e. the index is
+// relative to the first EntryType of the namespace. This allows a sub-system to
+// number its entries independently of where its namespace starts. It panics if
+// the index is outside of the namespace.
+func (ns *EntryNamespace) Type(i int) EntryType {
+	if i < 0 || i > int(ns.last-ns.first) {
+		panic(fmt.Errorf("index %d is outside of namespace %q", i, ns.name))
+	}
+
+	return ns.first + EntryType(i)
+}
+
+// Register an EntryConstructor function within the namespace. The EntryType
+// of the Entry must be within the range of the namespace. Otherwise, it works
+// like EntryRegistry.Register(…).
+func (ns *EntryNamespace) Register(constructor EntryConstructor) error {
+	return ns.registry.register(ns, "", constructor)
+}
+
+// RegisterNamed registers an EntryConstructor function within the namespace
+// like EntryNamespace.Register(…) and assigns a name to its EntryType. The name
+// is qualified by the name of the namespace, e.g. the name "invoice_created" of
+// the namespace "billing" becomes "billing.invoice_created".
+func (ns *EntryNamespace) RegisterNamed(name string, constructor EntryConstructor) error {
+	if name == "" {
+		return errors.New("entry name must not be empty")
+	}
+
+	return ns.registry.register(ns, ns.name+"."+name, constructor)
+}
+
+// An Upcaster converts a decoded Entry of an older version into an Entry of a
+// newer version of the same EntryType, e.g. by filling new fields with default
+// values. It is registered via EntryRegistry.RegisterUpcaster(…).
+type Upcaster func(Entry) (Entry, error)
+
+// RegisterUpcaster registers an Upcaster which converts entries of the given
+// type and version into a newer version. Upcasters form a chain: when an old
+// Entry is replayed, each Upcaster that is registered for the version of the
+// Entry is applied until the Entry has a version without an Upcaster, which
+// usually is the current version of the EntryType.
+//
+// An error is returned if an Upcaster was already registered for this type and
+// version.
+func (r *EntryRegistry) RegisterUpcaster(typ EntryType, from EntryVersion, upcaster Upcaster) error {
+	if err := r.lock(); err != nil {
+		return err
+	}
+
+	defer r.mu.Unlock()
+
+	key := entryKey{typ: typ, version: from}
+	if _, ok := r.upcasters[key]; ok {
+		return fmt.Errorf("upcaster for EntryType %d version %d was already registered", typ, from)
+	}
+
+	if r.upcasters == nil {
+		r.upcasters = map[entryKey]Upcaster{}
+	}
+
+	r.upcasters[key] = upcaster
+	return nil
+}
+
+// Upcast applies the chain of registered Upcasters to the Entry and returns
+// the Entry of the resulting version. If no Upcaster is registered for the
+// version of the Entry, it is returned unchanged.
+func (r *EntryRegistry) Upcast(e Entry) (Entry, error) {
+	for {
+		typ, version := e.Type(), entryVersion(e)
+		upcast, ok := r.upcaster(entryKey{typ: typ, version: version})
+		if !ok {
+			return e, nil
+		}
+
+		next, err := upcast(e)
+		if err != nil {
+			return nil, fmt.Errorf("upcasting EntryType %d version %d: %w", typ, version, err)
+		}
+
+		if next == nil || next.Type() != typ || entryVersion(next) <= version {
+			return nil, fmt.Errorf("upcaster of EntryType %d version %d must return a newer version of the same EntryType", typ, version)
+		}
+
+		e = next
+	}
+}
+
+// upcaster returns the Upcaster of the given EntryType and version.
+func (r *EntryRegistry) upcaster(key entryKey) (Upcaster, bool) {
+	if !r.frozen.Load() {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+	}
+
+	upcast, ok := r.upcasters[key]
+	return upcast, ok
+}
+
+// RegisterCodec registers a custom Codec, so compressed entries can be decoded.
+// The built-in FlateCodec does not need to be registered. An error is
+// returned if a codec with the same CodecID was already registered or if the
+// CodecID is below 128.
+func (r *EntryRegistry) RegisterCodec(c Codec) error {
+	if err := r.lock(); err != nil {
+		return err
+	}
+
+	defer r.mu.Unlock()
+
+	existing, ok := r.codecs[c.ID()]
+	if c.ID() == CodecFlate {
+		existing, ok = defaultFlateCodec, true
+	}
+
+	if ok {
+		return fmt.Errorf(`CodecID %d was already registered to type "%T"`, c.ID(), existing)
+	}
+
+	if err := checkCodecID(c); err != nil {
+		return err
+	}
+
+	if r.codecs == nil {
+		r.codecs = map[CodecID]Codec{}
+	}
+
+	r.codecs[c.ID()] = c
+	return nil
+}
+
+// codec returns the Codec with the given ID.
+func (r *EntryRegistry) codec(id CodecID) (Codec, error) {
+	if id == CodecFlate {
+		return defaultFlateCodec, nil
+	}
+
+	if !r.frozen.Load() {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+	}
+
+	c, ok := r.codecs[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown WAL codec %d", id)
+	}
+
+	return c, nil
+}
@@ -1,10 +1,14 @@
 package wal_test
 
 import (
+	"errors"
+	"os"
+	"strings"
 	"testing"
 
 	"github.com/fgrosse/wal"
 	"github.com/fgrosse/wal/waltest"
+	"github.com/fgrosse/zaptest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -54,3 +58,310 @@ func TestNewEntryRegistryNew(t *testing.T) {
 	assert.EqualError(t, err, "unknown WAL entry type 255")
 	assert.Nil(t, e)
 }
+
+const userCreatedType wal.EntryType = 10
+
+// userCreatedV0 is the first, unversioned layout of the userCreated entry.
+type userCreatedV0 struct {
+	wal.JSONEntry[struct{ Name string }]
+}
+
+// userCreatedV2 is the current layout of the userCreated entry.
+type userCreatedV2 struct {
+	wal.JSONEntry[struct{ FirstName, LastName string }]
+}
+
+func (*userCreatedV2) Version() wal.EntryVersion { return 2 }
+
+func newUserCreatedV0(name string) *userCreatedV0 {
+	e := &userCreatedV0{}
+	e.EntryType = userCreatedType
+	e.Value.Name = name
+	return e
+}
+
+func newUserCreatedV2(firstName, lastName string) *userCreatedV2 {
+	e := &userCreatedV2{}
+	e.EntryType = userCreatedType
+	e.Value.FirstName = firstName
+	e.Value.LastName = lastName
+	return e
+}
+
+func upcastUserCreated(e wal.Entry) (wal.Entry, error) {
+	first, last, _ := strings.Cut(e.(*userCreatedV0).Value.Name, " ")
+	return newUserCreatedV2(first, last), nil
+}
+
+func TestEntryRegistry_Versions(t *testing.T) {
+	r := wal.NewEntryRegistry(
+		func() wal.Entry { return newUserCreatedV2("", "") },
+		func() wal.Entry { return newUserCreatedV0("") },
+	)
+
+	t.Log("New should return the latest version")
+	e, err := r.New(userCreatedType)
+	require.NoError(t, err)
+	assert.IsType(t, new(userCreatedV2), e)
+
+	e, err = r.NewVersion(userCreatedType, 0)
+	require.NoError(t, err)
+	assert.IsType(t, new(userCreatedV0), e)
+
+	_, err = r.NewVersion(userCreatedType, 1)
+	assert.EqualError(t, err, "unknown WAL entry type 10 version 1")
+
+	err = r.Register(func() wal.Entry { return newUserCreatedV2("", "") })
+	assert.EqualError(t, err, `EntryType 10 version 2 was already registered to type "*wal_test.userCreatedV2"`)
+
+	t.Log("Entries without upcaster should not be changed")
+	old := newUserCreatedV0("Alice Smith")
+	e, err = r.Upcast(old)
+	require.NoError(t, err)
+	assert.Same(t, old, e)
+
+	require.NoError(t, r.RegisterUpcaster(userCreatedType, 0, upcastUserCreated))
+	assert.Error(t, r.RegisterUpcaster(userCreatedType, 0, upcastUserCreated))
+
+	e, err = r.Upcast(old)
+	require.NoError(t, err)
+	assert.Equal(t, newUserCreatedV2("Alice", "Smith"), e)
+
+	t.Log("Upcasters must return a newer version")
+	require.NoError(t, r.RegisterUpcaster(userCreatedType, 2, func(e wal.Entry) (wal.Entry, error) {
+		return e, nil
+	}))
+	_, err = r.Upcast(old)
+	assert.EqualError(t, err, "upcaster of EntryType 10 version 2 must return a newer version of the same EntryType")
+
+	r = wal.NewEntryRegistry()
+	require.NoError(t, r.RegisterUpcaster(userCreatedType, 0, func(wal.Entry) (wal.Entry, error) {
+		return nil, errors.New("test")
+	}))
+	_, err = r.Upcast(old)
+	assert.EqualError(t, err, "upcasting EntryType 10 version 0: test")
+}
+
+func TestWAL_Upcasting(t *testing.T) {
+	fs := waltest.NewMemFS()
+	logger := zaptest.Logger(t)
+
+	t.Log("Write entries using the first version of the entry")
+	oldRegistry := wal.NewEntryRegistry(func() wal.Entry { return newUserCreatedV0("") })
+	w, err := wal.Open("/wal", oldRegistry, logger, wal.WithFS(fs))
+	require.NoError(t, err)
+	_, err = w.Write(newUserCreatedV0("Alice Smith"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	t.Log("Continue writing entries using the current version of the entry")
+	registry := wal.NewEntryRegistry(
+		func() wal.Entry { return newUserCreatedV0("") },
+		func() wal.Entry { return newUserCreatedV2("", "") },
+	)
+	require.NoError(t, registry.RegisterUpcaster(userCreatedType, 0, upcastUserCreated))
+
+	w, err = wal.Open("/wal", registry, logger, wal.WithFS(fs))
+	require.NoError(t, err)
+	_, err = w.Write(newUserCreatedV2("Bob", "Jones"))
+	require.NoError(t, err)
+
+	var replayed []wal.Entry
+	err = w.Replay(0, func(_ uint32, e wal.Entry) error {
+		replayed = append(replayed, e)
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	assert.Equal(t, []wal.Entry{
+		newUserCreatedV2("Alice", "Smith"),
+		newUserCreatedV2("Bob", "Jones"),
+	}, replayed)
+
+	t.Log("Old binaries must not decode newer versions with an old Entry")
+	_, err = wal.Open("/wal", oldRegistry, logger, wal.WithFS(fs))
+	assert.ErrorContains(t, err, "unknown WAL entry type 10 version 2")
+}
+
+func TestEntryRegistry_Namespace(t *testing.T) {
+	r := wal.NewEntryRegistry(func() wal.Entry { return new(waltest.ExampleEntry1) })
+
+	_, err := r.Namespace("example", 0, 99)
+	assert.EqualError(t, err, `EntryType 0 of namespace "example" was already registered`)
+
+	users, err := r.Namespace("users", 0x1000, 0x10FF)
+	require.NoError(t, err)
+	assert.Equal(t, "users", users.Name())
+	assert.Equal(t, wal.EntryType(0x1001), users.Type(1))
+	assert.True(t, users.Contains(0x10FF))
+	assert.False(t, users.Contains(0x1100))
+	assert.Panics(t, func() { users.Type(0x100) })
+
+	_, err = r.Namespace("users", 0x2000, 0x20FF)
+	assert.EqualError(t, err, `namespace "users" was already registered`)
+	_, err = r.Namespace("orders", 0x0F00, 0x1000)
+	assert.EqualError(t, err, `EntryTypes 3840 to 4096 of namespace "orders" overlap with namespace "users"`)
+	_, err = r.Namespace("orders", 2, 1)
+	assert.Error(t, err)
+
+	orders, err := r.Namespace("orders", 0x1100, 0x11FF)
+	require.NoError(t, err)
+
+	newUserEntry := wal.JSONEntryConstructor[string](users.Type(1))
+	require.NoError(t, users.Register(newUserEntry))
+	assert.EqualError(t, orders.Register(newUserEntry), `EntryType 4097 is reserved for namespace "users"`)
+	assert.EqualError(t, r.Register(newUserEntry), `EntryType 4097 is reserved for namespace "users"`)
+	assert.EqualError(t, users.Register(wal.JSONEntryConstructor[string](1)), `EntryType 1 is outside of namespace "users"`)
+
+	e, err := r.New(0x1001)
+	require.NoError(t, err)
+	assert.IsType(t, new(wal.JSONEntry[string]), e)
+}
+
+func TestWAL_WideEntryTypes(t *testing.T) {
+	logger := zaptest.Logger(t)
+	keys := wal.NewKeyRing()
+	require.NoError(t, keys.Add(1, make([]byte, 32)))
+
+	registry := wal.NewEntryRegistry(
+		func() wal.Entry { return new(waltest.ExampleEntry2) },
+		wal.JSONEntryConstructor[string](0x1234),
+		wal.JSONEntryConstructor[string](0xFF),
+	)
+
+	expected := []wal.Entry{
+		&waltest.ExampleEntry2{Name: "narrow"},
+		wal.NewJSONEntry[string](0x1234, "wide"),
+		wal.NewJSONEntry[string](0xFF, "extended record type"),
+	}
+
+	for i, opts := range [][]wal.Option{
+		nil,
+		{wal.WithEncryption(keys), wal.WithHashChain(nil)},
+	} {
+		fs := waltest.NewMemFS()
+		opts = append(opts, wal.WithFS(fs))
+		w, err := wal.Open("/wal", registry, logger, opts...)
+		require.NoError(t, err)
+
+		for _, e := range expected {
+			_, err := w.Write(e)
+			require.NoError(t, err)
+		}
+
+		require.NoError(t, w.Close())
+
+		w, err = wal.Open("/wal", registry, logger, append(opts, wal.ReadOnly())...)
+		require.NoError(t, err)
+
+		var actual []wal.Entry
+		err = w.Replay(0, func(_ uint32, e wal.Entry) error {
+			actual = append(actual, e)
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual)
+		if i == 1 {
+			require.NoError(t, w.Verify(), "the hash chain should cover wide EntryTypes")
+		}
+
+		require.NoError(t, w.Close())
+
+		t.Log("Segments without header only support narrow EntryTypes")
+		f, err := fs.OpenFile("/legacy.wal", os.O_CREATE|os.O_WRONLY, 0666)
+		require.NoError(t, err)
+		sw := wal.NewSegmentWriter(f)
+		assert.EqualError(t, sw.Write(1, 0x1234, 0, nil), "EntryType 4660 requires a segment header")
+		require.NoError(t, sw.Close())
+	}
+}
+
+func TestEntryRegistry_Introspection(t *testing.T) {
+	r := wal.NewEntryRegistry()
+	require.NoError(t, r.RegisterNamed("example_1", func() wal.Entry { return new(waltest.ExampleEntry1) }))
+	require.NoError(t, r.Register(func() wal.Entry { return new(waltest.ExampleEntry2) }))
+	require.NoError(t, r.RegisterNamed("user_created", func() wal.Entry { return newUserCreatedV0("") }))
+	require.NoError(t, r.Register(func() wal.Entry { return newUserCreatedV2("", "") }))
+
+	billing, err := r.Namespace("billing", 0x1000, 0x10FF)
+	require.NoError(t, err)
+	require.NoError(t, billing.RegisterNamed("invoice_created", wal.JSONEntryConstructor[string](0x1000)))
+
+	assert.Equal(t, []wal.EntryInfo{
+		{Type: waltest.ExampleEntry1Type, Name: "example_1"},
+		{Type: waltest.ExampleEntry2Type},
+		{Type: userCreatedType, Version: 0, Name: "user_created"},
+		{Type: userCreatedType, Version: 2, Name: "user_created"},
+		{Type: 0x1000, Name: "billing.invoice_created", Namespace: "billing"},
+	}, r.Types())
+
+	info, ok := r.Lookup(userCreatedType)
+	assert.True(t, ok)
+	assert.Equal(t, wal.EntryInfo{Type: userCreatedType, Version: 2, Name: "user_created"}, info)
+
+	_, ok = r.Lookup(0xFFFF)
+	assert.False(t, ok)
+
+	info, ok = r.LookupName("billing.invoice_created")
+	assert.True(t, ok)
+	assert.Equal(t, wal.EntryType(0x1000), info.Type)
+
+	_, ok = r.LookupName("unknown")
+	assert.False(t, ok)
+
+	t.Log("Names must be unique")
+	err = r.RegisterNamed("example_1", wal.JSONEntryConstructor[string](20))
+	assert.EqualError(t, err, `entry name "example_1" was already registered for EntryType 0`)
+	err = r.RegisterNamed("other", func() wal.Entry {
+		e := new(userCreatedV1)
+		e.EntryType = userCreatedType
+		return e
+	})
+	assert.EqualError(t, err, `EntryType 10 was already registered with name "user_created"`)
+	assert.Error(t, r.RegisterNamed("", wal.JSONEntryConstructor[string](20)))
+}
+
+// userCreatedV1 is an intermediate version of the userCreated entry.
+type userCreatedV1 struct {
+	wal.JSONEntry[struct{ Name string }]
+}
+
+func (*userCreatedV1) Version() wal.EntryVersion { return 1 }
+
+func TestEntryRegistry_Freeze(t *testing.T) {
+	r := wal.NewEntryRegistry(func() wal.Entry { return new(waltest.ExampleEntry1) })
+	r.Freeze()
+
+	assert.ErrorIs(t, r.Register(func() wal.Entry { return new(waltest.ExampleEntry2) }), wal.ErrRegistryFrozen)
+	assert.ErrorIs(t, r.RegisterNamed("test", func() wal.Entry { return new(waltest.ExampleEntry2) }), wal.ErrRegistryFrozen)
+	assert.ErrorIs(t, r.RegisterUpcaster(0, 0, upcastUserCreated), wal.ErrRegistryFrozen)
+	assert.ErrorIs(t, r.RegisterCodec(new(customCodec)), wal.ErrRegistryFrozen)
+	_, err := r.Namespace("test", 100, 200)
+	assert.ErrorIs(t, err, wal.ErrRegistryFrozen)
+
+	e, err := r.New(waltest.ExampleEntry1Type)
+	require.NoError(t, err)
+	assert.IsType(t, new(waltest.ExampleEntry1), e)
+	assert.Len(t, r.Types(), 1)
+}
+
+func TestEntryRegistry_Concurrency(t *testing.T) {
+	r := wal.NewEntryRegistry()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			assert.NoError(t, r.Register(wal.JSONEntryConstructor[int](wal.EntryType(i))))
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		_, _ = r.New(wal.EntryType(i))
+		_, _ = r.Lookup(wal.EntryType(i))
+		_ = r.Types()
+	}
+
+	<-done
+	assert.Len(t, r.Types(), 100)
+}
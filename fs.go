@@ -0,0 +1,154 @@
+package wal
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FS is the file system abstraction that is used by the WAL to manage its
+// segment files. By default, the WAL uses the OSFS which operates on the local
+// disk but you can use the WithFS(…) option to provide your own implementation,
+// e.g. to keep the WAL in memory or to inject faults in unit tests.
+//
+// All paths which are passed to an FS are constructed by joining the path of
+// the WAL directory with the file name using filepath.Join(…).
+type FS interface {
+	// MkdirAll creates a directory named path, along with any necessary
+	// parents. If path is already a directory, MkdirAll does nothing.
+	MkdirAll(path string) error
+
+	// OpenFile opens the named file using the same flags and semantics as
+	// os.OpenFile(…). It is used to open existing files and create new files.
+	// Errors should wrap os.ErrNotExist and os.ErrExist where applicable.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+
+	// Remove removes the named file.
+	Remove(name string) error
+
+	// Rename renames (moves) oldpath to newpath. If newpath already exists, it
+	// is replaced.
+	Rename(oldpath, newpath string) error
+
+	// List returns the names of all files in the directory, sorted by name.
+	// The returned names must not contain the directory itself.
+	List(dir string) ([]string, error)
+
+	// SyncDir commits any changes to the directory itself (i.e. created,
+	// renamed or removed files) to stable storage.
+	SyncDir(dir string) error
+}
+
+// FreeSpaceFS is an optional interface that can be implemented by an FS to
+// report the available disk space. If the FS implements this interface, the
+// WAL checks the free disk space before creating a new segment (see
+// Configuration.MinFreeSpace). On Linux, the OSFS implements this interface.
+type FreeSpaceFS interface {
+	FS
+
+	// FreeSpace returns the number of bytes that are available to
+	// unprivileged users on the file system of the given directory.
+	FreeSpace(dir string) (int64, error)
+}
+
+// File is a single file of an FS.
+type File interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.Closer
+
+	// Stat returns the FileInfo describing the file.
+	Stat() (os.FileInfo, error)
+
+	// Sync commits the current contents of the file to stable storage.
+	Sync() error
+
+	// Truncate changes the size of the file. It does not change the I/O offset.
+	Truncate(size int64) error
+}
+
+// OSFS is the default FS implementation which uses the os package to manage
+// files on the local disk.
+type OSFS struct{}
+
+// MkdirAll implements the FS interface.
+func (OSFS) MkdirAll(path string) error {
+	return os.MkdirAll(path, 0777)
+}
+
+// OpenFile implements the FS interface.
+func (OSFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err // do not return a non-nil interface holding a nil *os.File
+	}
+
+	return f, nil
+}
+
+// Remove implements the FS interface.
+func (OSFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// Rename implements the FS interface.
+func (OSFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// List implements the FS interface.
+func (OSFS) List(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+
+	return names, nil
+}
+
+// SyncDir implements the FS interface.
+func (OSFS) SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// listFiles returns the paths of all files in dir that have any of the given
+// suffixes.
+func listFiles(fs FS, dir string, suffixes ...string) ([]string, error) {
+	names, err := fs.List(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, name := range names {
+		for _, suffix := range suffixes {
+			if strings.HasSuffix(name, suffix) {
+				paths = append(paths, filepath.Join(dir, name))
+				break
+			}
+		}
+	}
+
+	sort.Strings(paths)
+	return paths, nil
+}
@@ -0,0 +1,18 @@
+//go:build linux
+
+package wal
+
+import (
+	"os"
+	"syscall"
+)
+
+// FreeSpace implements the FreeSpaceFS interface.
+func (OSFS) FreeSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, &os.PathError{Op: "statfs", Path: dir, Err: err}
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,119 @@
+package wal_test
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/fgrosse/wal"
+	"github.com/fgrosse/wal/waltest"
+	"github.com/fgrosse/zaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOSFS(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "wal")
+	fs := wal.OSFS{}
+
+	require.NoError(t, fs.MkdirAll(dir))
+
+	names, err := fs.List(dir)
+	require.NoError(t, err)
+	assert.Empty(t, names)
+
+	f, err := fs.OpenFile(filepath.Join(dir, "2.wal"), os.O_CREATE|os.O_EXCL|os.O_RDWR, 0666)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, f.Sync())
+	require.NoError(t, f.Truncate(4))
+	require.NoError(t, f.Close())
+
+	_, err = fs.OpenFile(filepath.Join(dir, "2.wal"), os.O_CREATE|os.O_EXCL|os.O_RDWR, 0666)
+	assert.ErrorIs(t, err, os.ErrExist)
+
+	require.NoError(t, fs.Rename(filepath.Join(dir, "2.wal"), filepath.Join(dir, "1.wal")))
+	require.NoError(t, fs.SyncDir(dir))
+
+	content, err := os.ReadFile(filepath.Join(dir, "1.wal"))
+	require.NoError(t, err)
+	assert.Equal(t, "hell", string(content))
+
+	names, err = fs.List(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.wal"}, names)
+
+	require.NoError(t, fs.Remove(filepath.Join(dir, "1.wal")))
+	_, err = fs.OpenFile(filepath.Join(dir, "1.wal"), os.O_RDONLY, 0)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestOSFS_FreeSpace(t *testing.T) {
+	fs, ok := any(wal.OSFS{}).(wal.FreeSpaceFS)
+	if !ok {
+		t.Skip("OSFS does not implement the FreeSpaceFS interface on this platform")
+	}
+
+	free, err := fs.FreeSpace(t.TempDir())
+	require.NoError(t, err)
+	assert.Greater(t, free, int64(0))
+
+	_, err = fs.FreeSpace(filepath.Join(t.TempDir(), "does-not-exist"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestWithFS(t *testing.T) {
+	path := t.TempDir()
+	fs := &recordingFS{FS: wal.OSFS{}}
+	logger := zaptest.Logger(t)
+
+	w, err := wal.Open(path, waltest.ExampleEntries, logger, wal.WithFS(fs))
+	require.NoError(t, err)
+
+	_, err = w.Write(&waltest.ExampleEntry1{ID: 1, Point: []float32{1, 2}})
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	assert.Equal(t, []string{
+		"MkdirAll " + path,
+		"List " + path, // segment files
+		"List " + path, // recycled segment files
+		"OpenFile " + filepath.Join(path, "1.wal"),
+		"SyncDir " + path,
+	}, fs.calls)
+}
+
+// recordingFS is a wal.FS that records all method calls to the FS.
+type recordingFS struct {
+	wal.FS
+	mu    sync.Mutex
+	calls []string
+}
+
+func (fs *recordingFS) record(method, path string) {
+	fs.mu.Lock()
+	fs.calls = append(fs.calls, method+" "+path)
+	fs.mu.Unlock()
+}
+
+func (fs *recordingFS) MkdirAll(path string) error {
+	fs.record("MkdirAll", path)
+	return fs.FS.MkdirAll(path)
+}
+
+func (fs *recordingFS) OpenFile(name string, flag int, perm os.FileMode) (wal.File, error) {
+	fs.record("OpenFile", name)
+	return fs.FS.OpenFile(name, flag, perm)
+}
+
+func (fs *recordingFS) List(dir string) ([]string, error) {
+	fs.record("List", dir)
+	return fs.FS.List(dir)
+}
+
+func (fs *recordingFS) SyncDir(dir string) error {
+	fs.record("SyncDir", dir)
+	return fs.FS.SyncDir(dir)
+}
@@ -0,0 +1,126 @@
+package wal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"time"
+)
+
+// Header is a small key/value pair that can be stored in the metadata of a
+// record via WAL.WriteWithHeaders(…), e.g. a trace ID or a tenant ID. Headers
+// can be read via SegmentReader.Headers() without decoding the entry payload.
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// maxHeaderKeySize and maxHeadersSize limit the size of the encoded headers of
+// a single record.
+const (
+	maxHeaderKeySize = math.MaxUint8
+	maxHeadersSize   = math.MaxUint16
+)
+
+// appendHeaders appends the binary representation of the headers to b. Each
+// header is encoded as KeyLength (1B), Key, ValueLength (2B) and Value.
+func appendHeaders(b []byte, headers []Header) ([]byte, error) {
+	start := len(b)
+	for _, h := range headers {
+		if len(h.Key) > maxHeaderKeySize {
+			return b[:start], fmt.Errorf("header key %q exceeds %d bytes", h.Key, maxHeaderKeySize)
+		}
+
+		if len(h.Value) > maxHeadersSize {
+			return b[:start], fmt.Errorf("value of header %q exceeds %d bytes", h.Key, maxHeadersSize)
+		}
+
+		b = append(b, byte(len(h.Key)))
+		b = append(b, h.Key...)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(h.Value)))
+		b = append(b, h.Value...)
+	}
+
+	if len(b)-start > maxHeadersSize {
+		return b[:start], fmt.Errorf("record headers exceed %d bytes", maxHeadersSize)
+	}
+
+	return b, nil
+}
+
+// parseHeaders decodes headers that have been encoded by appendHeaders(…).
+// The returned values point into b.
+func parseHeaders(b []byte) ([]Header, error) {
+	var headers []Header
+	for len(b) > 0 {
+		keyLen := int(b[0])
+		if len(b) < 1+keyLen+2 {
+			return headers, fmt.Errorf("invalid record headers")
+		}
+
+		key := string(b[1 : 1+keyLen])
+		b = b[1+keyLen:]
+
+		valueLen := int(binary.BigEndian.Uint16(b))
+		if len(b) < 2+valueLen {
+			return headers, fmt.Errorf("invalid record headers")
+		}
+
+		headers = append(headers, Header{Key: key, Value: b[2 : 2+valueLen : 2+valueLen]})
+		b = b[2+valueLen:]
+	}
+
+	return headers, nil
+}
+
+// hasMetadata returns whether the record stores a version, timestamp or
+// headers.
+func (r record) hasMetadata() bool {
+	return r.version != 0 || r.timestamp != 0 || len(r.headers) > 0
+}
+
+// appendMetadataPrefix appends the optional version, timestamp and the length
+// of the headers of an extended record to b. The encoded headers follow
+// directly after this prefix.
+func (r record) appendMetadataPrefix(b []byte) []byte {
+	if r.version != 0 {
+		b = append(b, byte(r.version))
+	}
+
+	if r.timestamp != 0 {
+		b = binary.BigEndian.AppendUint64(b, uint64(r.timestamp))
+	}
+
+	if len(r.headers) > 0 {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(r.headers)))
+	}
+
+	return b
+}
+
+// metadataChecksum extends the CRC of the payload with the metadata of the
+// record, so the checksum covers both.
+func (r record) metadataChecksum(crc uint32) uint32 {
+	if !r.hasMetadata() {
+		return crc
+	}
+
+	var buf [1 + 8 + 2]byte
+	crc = crc32.Update(crc, crc32.IEEETable, r.appendMetadataPrefix(buf[:0]))
+	return crc32.Update(crc, crc32.IEEETable, r.headers)
+}
+
+// timestamp returns the current time in nanoseconds since the unix epoch. The
+// timestamps of consecutive records never decrease, even if the wall clock is
+// turned back.
+// The caller must ensure the WAL is write-locked before calling this function.
+func (w *WAL) timestamp() int64 {
+	ts := time.Now().UnixNano()
+	if ts < w.lastTimestamp {
+		ts = w.lastTimestamp
+	}
+
+	w.lastTimestamp = ts
+	return ts
+}
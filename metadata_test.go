@@ -0,0 +1,93 @@
+package wal_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fgrosse/wal"
+	"github.com/fgrosse/wal/waltest"
+	"github.com/fgrosse/zaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL_RecordMetadata(t *testing.T) {
+	fs := waltest.NewMemFS()
+	logger := zaptest.Logger(t)
+	conf := wal.DefaultConfiguration()
+	conf.RecordTimestamps = true
+
+	w, err := wal.New("/wal", conf, waltest.ExampleEntries, logger, wal.WithFS(fs), wal.WithHashChain(nil))
+	require.NoError(t, err)
+
+	start := time.Now()
+	headers := []wal.Header{
+		{Key: "trace-id", Value: []byte("abc123")},
+		{Key: "tenant", Value: []byte("acme")},
+	}
+
+	_, err = w.WriteWithHeaders(&waltest.ExampleEntry1{ID: 1, Point: []float32{1, 2}}, headers...)
+	require.NoError(t, err)
+	_, err = w.Write(&waltest.ExampleEntry2{Name: "no headers"})
+	require.NoError(t, err)
+	end := time.Now()
+
+	t.Log("Headers must not exceed their maximum size")
+	_, err = w.WriteWithHeaders(&waltest.ExampleEntry2{}, wal.Header{Key: strings.Repeat("a", 256)})
+	assert.Error(t, err)
+
+	require.NoError(t, w.Verify())
+	require.NoError(t, w.Close())
+
+	content, err := fs.ReadFile("/wal/1.wal")
+	require.NoError(t, err)
+	r, err := wal.NewSegmentReader(bytes.NewReader(content), waltest.ExampleEntries)
+	require.NoError(t, err)
+
+	t.Log("Metadata should be readable without decoding the entry")
+	require.True(t, r.ReadNext())
+	require.NoError(t, r.Err())
+	first := r.Timestamp()
+	assert.False(t, first.Before(start.Truncate(0)))
+	assert.False(t, first.After(end))
+	assert.Equal(t, headers, r.Headers())
+
+	e, err := r.Decode()
+	require.NoError(t, err)
+	assert.Equal(t, &waltest.ExampleEntry1{ID: 1, Point: []float32{1, 2}}, e)
+
+	require.True(t, r.ReadNext())
+	assert.False(t, r.Timestamp().Before(first), "timestamps should never decrease")
+	assert.Nil(t, r.Headers())
+
+	e, err = r.Decode()
+	require.NoError(t, err)
+	assert.Equal(t, &waltest.ExampleEntry2{Name: "no headers"}, e)
+
+	assert.False(t, r.ReadNext())
+	require.NoError(t, r.Err())
+}
+
+func TestSegmentReader_RecordMetadata_Corruption(t *testing.T) {
+	fs := waltest.NewMemFS()
+	logger := zaptest.Logger(t)
+
+	w, err := wal.Open("/wal", waltest.ExampleEntries, logger, wal.WithFS(fs))
+	require.NoError(t, err)
+	_, err = w.WriteWithHeaders(&waltest.ExampleEntry2{Name: "test"}, wal.Header{Key: "tenant", Value: []byte("acme")})
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	content, err := fs.ReadFile("/wal/1.wal")
+	require.NoError(t, err)
+	content = bytes.Replace(content, []byte("acme"), []byte("evil"), 1)
+
+	r, err := wal.NewSegmentReader(bytes.NewReader(content), waltest.ExampleEntries)
+	require.NoError(t, err)
+	require.True(t, r.ReadNext())
+
+	_, err = r.Decode()
+	assert.EqualError(t, err, "detected WAL Entry corruption at WAL offset 1", "the checksum should cover the headers")
+}
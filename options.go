@@ -0,0 +1,125 @@
+package wal
+
+// Option is a functional option that can be passed to Open or New in order to
+// customize the behavior of the WAL.
+type Option func(*options)
+
+type options struct {
+	conf     Configuration
+	readOnly bool
+	fs       FS
+	archiver Archiver
+	codec    Codec
+	keys     KeyProvider
+	chain    bool
+	chainKey []byte
+
+	rawEntries   bool
+	reuseEntries bool
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		conf: DefaultConfiguration(),
+		fs:   OSFS{},
+	}
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
+
+// WithConfiguration sets the Configuration of the WAL. If this option is not
+// used, Open will use the DefaultConfiguration().
+func WithConfiguration(conf Configuration) Option {
+	return func(o *options) {
+		o.conf = conf
+	}
+}
+
+// ReadOnly opens the WAL in read-only mode. In this mode the WAL never creates
+// or modifies any files and all calls to WAL.Write(…) will fail with an
+// ErrReadOnly error. This is useful to inspect or replay existing WAL segments,
+// e.g. in offline tools or in follower processes.
+func ReadOnly() Option {
+	return func(o *options) {
+		o.readOnly = true
+	}
+}
+
+// WithFS sets the file system that is used to store the WAL segment files.
+// By default, the WAL uses the OSFS.
+func WithFS(fs FS) Option {
+	return func(o *options) {
+		o.fs = fs
+	}
+}
+
+// WithArchiver sets an Archiver which is called with each sealed segment before
+// it is deleted or recycled.
+func WithArchiver(a Archiver) Option {
+	return func(o *options) {
+		o.archiver = a
+	}
+}
+
+// WithCompression enables compressing the payload of all entries that are at
+// least Configuration.CompressionThreshold bytes large. Each compressed record
+// is flagged, so the SegmentReader can transparently decompress it again.
+// Custom codecs must use a CodecID of 128 or higher and must also be
+// registered via EntryRegistry.RegisterCodec(…).
+func WithCompression(c Codec) Option {
+	return func(o *options) {
+		o.codec = c
+	}
+}
+
+// WithEncryption enables encrypting the payload of all entries with AES-GCM
+// using the current key of the KeyProvider. The same KeyProvider is used to
+// decrypt entries when replaying the WAL. Since the ID of the key is stored
+// with each record, older entries remain readable after the key was rotated,
+// as long as the KeyProvider still knows the old keys.
+func WithEncryption(keys KeyProvider) Option {
+	return func(o *options) {
+		o.keys = keys
+	}
+}
+
+// WithHashChain turns the WAL into a tamper-evident log. Each record then
+// additionally stores a SHA-256 hash over the hash of the previous record and
+// its own contents and each segment header stores the hash of the last record
+// of the previous segment. Use WAL.Verify(…) to check that the log has not been
+// modified since it was written.
+//
+// If key is not nil, the hashes are computed using HMAC-SHA256, so the chain
+// cannot be forged by anyone who does not know the key.
+func WithHashChain(key []byte) Option {
+	return func(o *options) {
+		o.chain = true
+		o.chainKey = key
+	}
+}
+
+// WithRawEntries enables reading entries whose EntryType is not registered at
+// the EntryRegistry as RawEntry instead of failing. This allows tools to
+// replay, copy or replicate a WAL without knowing all of its entries. Only
+// records which store the length of their payload can be read as RawEntry
+// (see Configuration.RecordLengths).
+func WithRawEntries() Option {
+	return func(o *options) {
+		o.rawEntries = true
+	}
+}
+
+// WithReusedEntries makes WAL.Replay(…) reuse a single Entry per EntryType as
+// well as its payload buffers, so replaying a large WAL does not allocate for
+// each entry. Consequently, an Entry that is passed to the callback of Replay
+// is only valid until the callback returns (see
+// SegmentReader.SetReuseEntries(…)).
+func WithReusedEntries() Option {
+	return func(o *options) {
+		o.reuseEntries = true
+	}
+}
@@ -0,0 +1,18 @@
+package wal
+
+// preallocateTruncate is the portable fallback of preallocate(…). It extends
+// the file to the requested size which creates a sparse file on most file
+// systems. While this does not reserve any disk blocks, it still saves the
+// file system from updating the file size on every fsync.
+func preallocateTruncate(f File, size int64) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() >= size {
+		return nil
+	}
+
+	return f.Truncate(size)
+}
@@ -0,0 +1,27 @@
+//go:build linux
+
+package wal
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// preallocate reserves disk space for the file up to the given size using
+// fallocate(2). The allocated space is filled with zeros and is included in
+// the file size. If the file is not an *os.File or if the file system does not
+// support fallocate, the file is extended using ftruncate(2) instead.
+func preallocate(f File, size int64) error {
+	osFile, ok := f.(*os.File)
+	if !ok {
+		return preallocateTruncate(f, size)
+	}
+
+	err := syscall.Fallocate(int(osFile.Fd()), 0, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return preallocateTruncate(f, size)
+	}
+
+	return err
+}
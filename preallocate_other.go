@@ -0,0 +1,9 @@
+//go:build !linux
+
+package wal
+
+// preallocate extends the file to the given size. On platforms other than
+// Linux, this is implemented using ftruncate(2).
+func preallocate(f File, size int64) error {
+	return preallocateTruncate(f, size)
+}
@@ -0,0 +1,31 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreallocate(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "1.wal"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = f.Close() })
+
+	_, err = f.Write([]byte{1, 2, 3})
+	require.NoError(t, err)
+
+	err = preallocate(f, 4096)
+	require.NoError(t, err)
+
+	info, err := f.Stat()
+	require.NoError(t, err)
+	assert.EqualValues(t, 4096, info.Size())
+
+	content, err := os.ReadFile(f.Name())
+	require.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3}, content[:3], "existing data must not be modified")
+	assert.Equal(t, make([]byte, 4096-3), content[3:], "preallocated space must be zero-filled")
+}
@@ -0,0 +1,195 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// ErrLogFull is returned by WAL.Write(…) if the WAL cannot accept any more
+// entries because it reached one of its configured quotas or because the disk
+// is full. In contrast to other write errors, the WAL remains usable and
+// accepts new writes again as soon as there is enough space.
+var ErrLogFull = errors.New("WAL is full")
+
+// FullPolicy defines how the WAL behaves when it reaches one of its quotas
+// (see Configuration.MaxSegments, Configuration.MaxTotalSize and
+// Configuration.MinFreeSpace).
+type FullPolicy uint8
+
+const (
+	// FullPolicyReject rejects all writes with ErrLogFull until the
+	// application frees up space, e.g. by calling WAL.TruncateFront(…).
+	FullPolicyReject FullPolicy = iota
+
+	// FullPolicyDeleteOldest deletes the oldest segments which only contain
+	// entries up to the checkpoint (see WAL.SetCheckpoint(…)). If this does
+	// not free up enough space, writes are rejected with ErrLogFull. If an
+	// Archiver was configured, segments are deleted once they were archived
+	// in the background and writes are rejected with ErrLogFull until then.
+	FullPolicyDeleteOldest
+)
+
+// String returns a human-readable representation of the FullPolicy.
+func (p FullPolicy) String() string {
+	switch p {
+	case FullPolicyReject:
+		return "reject"
+	case FullPolicyDeleteOldest:
+		return "delete_oldest"
+	default:
+		return fmt.Sprintf("FullPolicy(%d)", p)
+	}
+}
+
+// isDiskFull returns whether err was caused by a full disk.
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+// ensureCapacity checks that the WAL can create another segment without
+// exceeding any of its quotas. If the FullPolicyDeleteOldest is used, old
+// segments are deleted until there is enough capacity.
+// The caller must ensure the WAL is write-locked before calling this function.
+func (w *WAL) ensureCapacity() error {
+	for {
+		reason := w.checkCapacity()
+		if !errors.Is(reason, ErrLogFull) || w.conf.FullPolicy != FullPolicyDeleteOldest || w.checkpoint == 0 {
+			return reason
+		}
+
+		segments, err := w.truncatableSegments(w.checkpoint + 1)
+		if err != nil {
+			return err
+		}
+
+		// Segments which are being archived free up space as soon as they
+		// were archived, so we do not archive even more segments until then.
+		if len(segments) == 0 || len(w.archiving) > 0 {
+			return reason
+		}
+
+		w.logger.Warn("Deleting oldest WAL segment to free up space",
+			zap.String("path", segments[0]),
+			zap.Uint32("checkpoint", w.checkpoint),
+			zap.NamedError("reason", reason),
+		)
+
+		done, err := w.discardSegment(segments[0], false)
+		if err != nil {
+			return fmt.Errorf("deleting WAL segment %q: %w", segments[0], err)
+		}
+
+		if done != nil {
+			// Writes are rejected until the segment was archived in the
+			// background, so we never block on the Archiver.
+			return reason
+		}
+	}
+}
+
+// checkCapacity returns an error wrapping ErrLogFull if creating another
+// segment would exceed any of the configured quotas.
+// The caller must ensure the WAL is write-locked before calling this function.
+func (w *WAL) checkCapacity() error {
+	conf := w.conf
+	if conf.MaxSegments <= 0 && conf.MaxTotalSize <= 0 && conf.MinFreeSpace <= 0 {
+		return nil
+	}
+
+	segments, err := segmentFileNames(w.fs, w.path)
+	if err != nil {
+		return fmt.Errorf("checking existing segment files: %w", err)
+	}
+
+	if conf.MaxSegments > 0 && len(segments) >= conf.MaxSegments {
+		return fmt.Errorf("%w: reached maximum of %d segments", ErrLogFull, conf.MaxSegments)
+	}
+
+	if conf.MaxTotalSize > 0 {
+		size, err := w.totalSize(segments)
+		if err != nil {
+			return err
+		}
+
+		if size+conf.MaxSegmentSize > conf.MaxTotalSize {
+			return fmt.Errorf("%w: segments use %d of %d bytes", ErrLogFull, size, conf.MaxTotalSize)
+		}
+	}
+
+	if fs, ok := w.fs.(FreeSpaceFS); ok && conf.MinFreeSpace > 0 {
+		free, err := fs.FreeSpace(w.path)
+		if err != nil {
+			return fmt.Errorf("checking free disk space: %w", err)
+		}
+
+		if free < int64(conf.MaxSegmentSize)+int64(conf.MinFreeSpace) {
+			return fmt.Errorf("%w: only %d bytes of free disk space left", ErrLogFull, free)
+		}
+	}
+
+	return nil
+}
+
+// totalSize returns the sum of the file sizes of all given segments.
+func (w *WAL) totalSize(segments []string) (int, error) {
+	var total int
+	for _, path := range segments {
+		info, err := w.statSegment(path)
+		if err != nil {
+			return 0, err
+		}
+
+		total += int(info.Size())
+	}
+
+	return total, nil
+}
+
+// statSegment returns the FileInfo of the segment file at the given path.
+func (w *WAL) statSegment(path string) (os.FileInfo, error) {
+	f, err := w.fs.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return f.Stat()
+}
+
+// handleWriteError decides how to proceed after writing or syncing the current
+// segment failed. If the disk is full, all records that have not been synced
+// yet are discarded and the WAL remains usable. Any other error puts the WAL
+// into the failed state.
+// The caller must ensure the WAL is write-locked before calling this function.
+func (w *WAL) handleWriteError(err error) error {
+	if !isDiskFull(err) {
+		w.fail(err)
+		return err
+	}
+
+	w.logger.Warn("Disk is full, discarding WAL entries that have not been synced yet",
+		zap.Int("segment_id", w.segmentID),
+		zap.Uint32("last_offset", w.lastOffset),
+		zap.Uint32("synced_offset", w.syncedOffset),
+		zap.Error(err),
+	)
+
+	if rollbackErr := w.segment.truncate(w.syncedSize); rollbackErr != nil {
+		rollbackErr = fmt.Errorf("discarding unsynced entries after %v: %w", err, rollbackErr)
+		w.fail(rollbackErr)
+		return rollbackErr
+	}
+
+	w.lastOffset = w.syncedOffset
+	w.currentTimes = w.syncedTimes
+	if w.chain != nil {
+		w.chain.head = w.chain.synced
+	}
+
+	return fmt.Errorf("%w: %w", ErrLogFull, err)
+}
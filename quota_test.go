@@ -0,0 +1,239 @@
+package wal_test
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/fgrosse/wal"
+	"github.com/fgrosse/wal/waltest"
+	"github.com/fgrosse/zaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL_MaxSegments(t *testing.T) {
+	fs := waltest.NewMemFS()
+	conf := wal.DefaultConfiguration()
+	conf.MaxSegmentSize = 60 // two entries per segment
+	conf.MaxSegments = 2
+
+	w, err := wal.New("/wal", conf, waltest.ExampleEntries, zaptest.Logger(t), wal.WithFS(fs))
+	require.NoError(t, err)
+
+	for i := 1; i <= 4; i++ {
+		_, err := w.Write(&waltest.ExampleEntry1{ID: uint32(i), Point: []float32{1, 2}})
+		require.NoError(t, err)
+	}
+
+	t.Log("Writing a fifth entry requires a third segment")
+	_, err = w.Write(&waltest.ExampleEntry1{ID: 5, Point: []float32{1, 2}})
+	assert.ErrorIs(t, err, wal.ErrLogFull)
+	assert.NoError(t, w.Err(), "a full WAL should not enter the failed state")
+
+	t.Log("Truncating the WAL should free up space")
+	require.NoError(t, w.TruncateFront(3))
+	offset, err := w.Write(&waltest.ExampleEntry1{ID: 5, Point: []float32{1, 2}})
+	require.NoError(t, err)
+	assert.EqualValues(t, 5, offset)
+
+	require.NoError(t, w.Close())
+}
+
+func TestWAL_FullPolicyDeleteOldest(t *testing.T) {
+	fs := waltest.NewMemFS()
+	conf := wal.DefaultConfiguration()
+	conf.MaxSegmentSize = 60 // two entries per segment
+	conf.MaxTotalSize = 200  // three segments
+	conf.FullPolicy = wal.FullPolicyDeleteOldest
+
+	w, err := wal.New("/wal", conf, waltest.ExampleEntries, zaptest.Logger(t), wal.WithFS(fs))
+	require.NoError(t, err)
+
+	write := func(id uint32) error {
+		_, err := w.Write(&waltest.ExampleEntry1{ID: id, Point: []float32{1, 2}})
+		return err
+	}
+
+	for i := 1; i <= 6; i++ {
+		require.NoError(t, write(uint32(i)))
+	}
+
+	t.Log("Without a checkpoint, no segment may be deleted")
+	assert.ErrorIs(t, write(7), wal.ErrLogFull)
+
+	t.Log("Segments up to the checkpoint can be deleted")
+	w.SetCheckpoint(2)
+	assert.EqualValues(t, 2, w.Checkpoint())
+	require.NoError(t, write(7))
+	require.NoError(t, write(8))
+
+	names, err := fs.List("/wal")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2.wal", "3.wal", "4.wal"}, names)
+
+	t.Log("Segments after the checkpoint must be kept")
+	assert.ErrorIs(t, write(9), wal.ErrLogFull)
+
+	var ids []uint32
+	err = w.Replay(0, func(_ uint32, e wal.Entry) error {
+		ids = append(ids, e.(*waltest.ExampleEntry1).ID)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{3, 4, 5, 6, 7, 8}, ids)
+
+	require.NoError(t, w.Close())
+}
+
+func TestWAL_FullPolicyDeleteOldest_RecycleSegments(t *testing.T) {
+	fs := waltest.NewMemFS()
+	fs.SetCapacity(1000)
+
+	conf := wal.DefaultConfiguration()
+	conf.MaxSegmentSize = 60 // two entries per segment
+	conf.MinFreeSpace = 760  // three segments
+	conf.RecycleSegments = 1
+	conf.FullPolicy = wal.FullPolicyDeleteOldest
+
+	w, err := wal.New("/wal", conf, waltest.ExampleEntries, zaptest.Logger(t), wal.WithFS(fs))
+	require.NoError(t, err)
+
+	write := func(id uint32) error {
+		_, err := w.Write(&waltest.ExampleEntry1{ID: id, Point: []float32{1, 2}})
+		return err
+	}
+
+	for i := 1; i <= 6; i++ {
+		require.NoError(t, write(uint32(i)))
+	}
+
+	assert.ErrorIs(t, write(7), wal.ErrLogFull)
+	free, err := fs.FreeSpace("/wal")
+	require.NoError(t, err)
+
+	t.Log("Deleted segments must not be recycled, since this would not free up any disk space")
+	w.SetCheckpoint(2)
+	require.NoError(t, write(7))
+	require.NoError(t, write(8))
+
+	names, err := fs.List("/wal")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2.wal", "3.wal", "4.wal"}, names)
+
+	newFree, err := fs.FreeSpace("/wal")
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, newFree, free)
+
+	require.NoError(t, w.Close())
+}
+
+func TestWAL_DiskFull(t *testing.T) {
+	const (
+		headerSize = 4 + 1 + 2 + 4 + 4
+		recordSize = 4 + 1 + 4 + 4 + 2 + 2*4
+	)
+
+	fs := waltest.NewMemFS()
+	fs.SetCapacity(headerSize + 3*recordSize + 10)
+
+	w, err := wal.Open("/wal", waltest.ExampleEntries, zaptest.Logger(t), wal.WithFS(fs))
+	require.NoError(t, err)
+
+	for i := 1; i <= 3; i++ {
+		_, err := w.Write(&waltest.ExampleEntry1{ID: uint32(i), Point: []float32{1, 2}})
+		require.NoError(t, err)
+	}
+
+	t.Log("The fourth entry can only be written partially")
+	_, err = w.Write(&waltest.ExampleEntry1{ID: 4, Point: []float32{1, 2}})
+	assert.ErrorIs(t, err, wal.ErrLogFull)
+	assert.ErrorIs(t, err, syscall.ENOSPC)
+	assert.NoError(t, w.Err(), "a full disk should not put the WAL into the failed state")
+	assert.EqualValues(t, 3, w.Offset())
+
+	content, err := fs.ReadFile("/wal/1.wal")
+	require.NoError(t, err)
+	assert.Len(t, content, headerSize+3*recordSize, "partially written record should have been removed")
+
+	t.Log("Writes should succeed again once there is enough space")
+	fs.SetCapacity(0)
+	offset, err := w.Write(&waltest.ExampleEntry1{ID: 4, Point: []float32{1, 2}})
+	require.NoError(t, err)
+	assert.EqualValues(t, 4, offset)
+	require.NoError(t, w.Close())
+
+	w, err = wal.Open("/wal", waltest.ExampleEntries, zaptest.Logger(t), wal.WithFS(fs))
+	require.NoError(t, err)
+
+	var ids []uint32
+	err = w.Replay(0, func(_ uint32, e wal.Entry) error {
+		ids = append(ids, e.(*waltest.ExampleEntry1).ID)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{1, 2, 3, 4}, ids)
+	require.NoError(t, w.Close())
+}
+
+func TestWAL_MinFreeSpace(t *testing.T) {
+	fs := waltest.NewMemFS()
+	fs.SetCapacity(1000)
+
+	conf := wal.DefaultConfiguration()
+	conf.MaxSegmentSize = 60 // two entries per segment
+	conf.MinFreeSpace = 850
+
+	w, err := wal.New("/wal", conf, waltest.ExampleEntries, zaptest.Logger(t), wal.WithFS(fs))
+	require.NoError(t, err)
+
+	for i := 1; i <= 4; i++ {
+		_, err := w.Write(&waltest.ExampleEntry1{ID: uint32(i), Point: []float32{1, 2}})
+		require.NoError(t, err)
+	}
+
+	t.Log("A third segment would leave less than MinFreeSpace on the disk")
+	_, err = w.Write(&waltest.ExampleEntry1{ID: 5, Point: []float32{1, 2}})
+	assert.ErrorIs(t, err, wal.ErrLogFull)
+	assert.NotErrorIs(t, err, syscall.ENOSPC, "the WAL should detect a full disk before writing")
+	assert.NoError(t, w.Err())
+
+	require.NoError(t, w.Close())
+}
+
+func TestWAL_DiskFull_NewSegment(t *testing.T) {
+	fs := waltest.NewMemFS()
+	fs.SetCapacity(100)
+
+	conf := wal.DefaultConfiguration()
+	conf.MaxSegmentSize = 60 // two entries per segment
+	conf.PreallocateSegments = true
+
+	w, err := wal.New("/wal", conf, waltest.ExampleEntries, zaptest.Logger(t), wal.WithFS(fs))
+	require.NoError(t, err)
+
+	for i := 1; i <= 2; i++ {
+		_, err := w.Write(&waltest.ExampleEntry1{ID: uint32(i), Point: []float32{1, 2}})
+		require.NoError(t, err)
+	}
+
+	t.Log("There is not enough space to preallocate the second segment")
+	_, err = w.Write(&waltest.ExampleEntry1{ID: 3, Point: []float32{1, 2}})
+	assert.ErrorIs(t, err, wal.ErrLogFull)
+	assert.ErrorIs(t, err, syscall.ENOSPC)
+	assert.NoError(t, w.Err())
+
+	names, err := fs.List("/wal")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.wal"}, names, "incomplete segment file should have been removed")
+
+	fs.SetCapacity(0)
+	offset, err := w.Write(&waltest.ExampleEntry1{ID: 3, Point: []float32{1, 2}})
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, offset)
+
+	names, err = fs.List("/wal")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.wal", "2.wal"}, names)
+
+	require.NoError(t, w.Close())
+}
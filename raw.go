@@ -0,0 +1,52 @@
+package wal
+
+import (
+	"errors"
+	"io"
+)
+
+// RawEntry is the Entry which is returned for records whose EntryType (or
+// version) is not registered at the EntryRegistry, if raw entries have been
+// enabled via the WithRawEntries() option or SegmentReader.SetRawEntries(…).
+// This way, tools can replay, copy, replicate or verify a WAL without knowing
+// all entries of the application.
+//
+// Since the payload of an unknown entry cannot be read by its Entry
+// implementation, only records which store the length of their payload can be
+// read as RawEntry. These are all records that are written while
+// Configuration.RecordLengths is enabled, as well as all records which are
+// compressed, encrypted, hash chained or carry metadata.
+//
+// The Payload is the payload as it was encoded by the original Entry, i.e. it
+// has already been decrypted and decompressed. Therefore, writing a RawEntry
+// into another WAL reproduces the original entry.
+type RawEntry struct {
+	EntryType    EntryType
+	EntryVersion EntryVersion
+	Offset       uint32 // the WAL offset of the record
+	Checksum     uint32 // the checksum of the record as it is stored
+	Payload      []byte
+}
+
+// Type implements the Entry interface.
+func (e *RawEntry) Type() EntryType { return e.EntryType }
+
+// Version implements the VersionedEntry interface.
+func (e *RawEntry) Version() EntryVersion { return e.EntryVersion }
+
+// EncodePayload implements the Entry interface.
+func (e *RawEntry) EncodePayload(b []byte) []byte {
+	return append(b[:0], e.Payload...)
+}
+
+// ReadPayload implements the Entry interface. It always returns an error,
+// since the length of a raw payload is not known.
+func (*RawEntry) ReadPayload(io.Reader) ([]byte, error) {
+	return nil, errors.New("cannot read the payload of a RawEntry from a record without length")
+}
+
+// DecodePayload implements the Entry interface.
+func (e *RawEntry) DecodePayload(b []byte) error {
+	e.Payload = append(e.Payload[:0], b...)
+	return nil
+}
@@ -0,0 +1,109 @@
+package wal_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/fgrosse/wal"
+	"github.com/fgrosse/wal/waltest"
+	"github.com/fgrosse/zaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL_RawEntries(t *testing.T) {
+	fs := waltest.NewMemFS()
+	logger := zaptest.Logger(t)
+	conf := wal.DefaultConfiguration()
+	conf.RecordLengths = true
+
+	keys := wal.NewKeyRing()
+	require.NoError(t, keys.Add(1, make([]byte, 32)))
+
+	w, err := wal.New("/wal", conf, waltest.ExampleEntries, logger, wal.WithFS(fs), wal.WithEncryption(keys), wal.WithHashChain(nil))
+	require.NoError(t, err)
+
+	expected := []wal.Entry{
+		&waltest.ExampleEntry1{ID: 1, Point: []float32{1, 2}},
+		&waltest.ExampleEntry2{Name: "unknown to the reader"},
+		&waltest.ExampleEntry1{ID: 3, Point: []float32{3}},
+	}
+
+	for _, e := range expected {
+		_, err := w.Write(e)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, w.Close())
+
+	t.Log("Readers without raw entries should fail on unknown entries")
+	registry := wal.NewEntryRegistry(func() wal.Entry { return new(waltest.ExampleEntry1) })
+	_, err = wal.Open("/wal", registry, logger, wal.WithFS(fs), wal.WithEncryption(keys), wal.ReadOnly())
+	assert.ErrorContains(t, err, "unknown WAL entry type 1")
+
+	t.Log("Readers with raw entries should pass through unknown entries")
+	w, err = wal.Open("/wal", registry, logger, wal.WithFS(fs), wal.WithEncryption(keys), wal.WithHashChain(nil), wal.WithRawEntries(), wal.ReadOnly())
+	require.NoError(t, err)
+	require.NoError(t, w.Verify())
+
+	var replayed []wal.Entry
+	err = w.Replay(0, func(_ uint32, e wal.Entry) error {
+		replayed = append(replayed, e)
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	require.Len(t, replayed, 3)
+	assert.Equal(t, expected[0], replayed[0])
+	assert.Equal(t, expected[2], replayed[2])
+
+	raw, ok := replayed[1].(*wal.RawEntry)
+	require.True(t, ok, "unexpected entry %T", replayed[1])
+	assert.Equal(t, waltest.ExampleEntry2Type, raw.Type())
+	assert.Equal(t, uint32(2), raw.Offset)
+	assert.NotZero(t, raw.Checksum)
+	assert.Equal(t, expected[1].EncodePayload(nil), raw.Payload, "the payload should be decrypted")
+
+	t.Log("Copying raw entries should reproduce the original entries")
+	copied, err := wal.Open("/copy", registry, logger, wal.WithFS(fs))
+	require.NoError(t, err)
+	for _, e := range replayed {
+		_, err := copied.Write(e)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, copied.Close())
+
+	copied, err = wal.Open("/copy", waltest.ExampleEntries, logger, wal.WithFS(fs))
+	require.NoError(t, err)
+	replayed = nil
+	err = copied.Replay(0, func(_ uint32, e wal.Entry) error {
+		replayed = append(replayed, e)
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, copied.Close())
+	assert.Equal(t, expected, replayed)
+}
+
+func TestSegmentReader_RawEntries_WithoutLength(t *testing.T) {
+	fs := waltest.NewMemFS()
+	logger := zaptest.Logger(t)
+
+	w, err := wal.Open("/wal", waltest.ExampleEntries, logger, wal.WithFS(fs))
+	require.NoError(t, err)
+	_, err = w.Write(&waltest.ExampleEntry2{Name: "test"})
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	content, err := fs.ReadFile("/wal/1.wal")
+	require.NoError(t, err)
+
+	r, err := wal.NewSegmentReader(bytes.NewReader(content), wal.NewEntryRegistry())
+	require.NoError(t, err)
+	r.SetRawEntries(true)
+
+	assert.False(t, r.ReadNext())
+	assert.EqualError(t, r.Err(), "unknown WAL entry type 1", "records without length cannot be skipped")
+}
@@ -0,0 +1,164 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// recycledSuffix is the file extension of segment files in the recycling pool.
+// Such files are not picked up by SegmentFileNames(…).
+const recycledSuffix = ".recycle"
+
+// loadRecycledSegments adds all existing segment files of the recycling pool to
+// the WAL and then pre-creates new files until the pool is full.
+func (w *WAL) loadRecycledSegments() error {
+	names, err := listFiles(w.fs, w.path, recycledSuffix)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		seq, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(name), recycledSuffix))
+		if err != nil {
+			continue // not created by us
+		}
+
+		if seq > w.recycledSeq {
+			w.recycledSeq = seq
+		}
+
+		w.recycled = append(w.recycled, name)
+	}
+
+	for len(w.recycled) < w.conf.RecycleSegments {
+		path := w.nextRecycledPath()
+		f, err := w.fs.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0666)
+		if err != nil {
+			return err
+		}
+
+		if w.conf.PreallocateSegments {
+			err = preallocate(f, int64(w.conf.MaxSegmentSize))
+		}
+
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+
+		if err != nil {
+			return err
+		}
+
+		w.recycled = append(w.recycled, path)
+	}
+
+	if len(w.recycled) > 0 {
+		w.logger.Debug("Prepared recycled segment files",
+			zap.Int("count", len(w.recycled)),
+		)
+	}
+
+	return nil
+}
+
+// reuseSegmentFile takes a file from the recycling pool and turns it into a new
+// segment file at the given path.
+// The caller must ensure the WAL is write-locked before calling this function.
+func (w *WAL) reuseSegmentFile(path string, header SegmentHeader) (*SegmentWriter, error) {
+	recycled := w.recycled[len(w.recycled)-1]
+	w.recycled = w.recycled[:len(w.recycled)-1]
+
+	f, err := w.fs.OpenFile(recycled, os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	if w.conf.PreallocateSegments {
+		if err := preallocate(f, int64(w.conf.MaxSegmentSize)); err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("preallocating segment: %w", err)
+		}
+	}
+
+	w.logger.Debug("Starting new WAL segment from recycled file",
+		zap.Int("segment_id", w.segmentID),
+		zap.String("path", path),
+		zap.String("recycled_path", recycled),
+	)
+
+	// The new header must be persisted before the file is renamed. Otherwise,
+	// a crash could leave us with a segment file that still contains the
+	// header and records of the segment it was recycled from.
+	sw := NewSegmentWriterSize(f, w.conf.WriteBufferSize)
+	err = sw.WriteHeader(header)
+	if err == nil {
+		err = sw.Sync()
+	}
+
+	if err == nil {
+		err = w.fs.Rename(recycled, path)
+	}
+
+	if err == nil {
+		err = w.fs.SyncDir(w.path)
+	}
+
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return sw, nil
+}
+
+// discardSegment returns a segment file to the recycling pool or removes it if
+// the pool is already full or recycle is false. Segments must not be recycled
+// if they are discarded to free up disk space, since files in the recycling
+// pool still use the same space. If an Archiver was configured, the segment is
+// only queued to be archived and it is discarded in the background afterwards.
+// In this case, the returned channel receives the result. Otherwise, it is nil.
+// The caller must ensure the WAL is write-locked before calling this function.
+func (w *WAL) discardSegment(path string, recycle bool) (<-chan error, error) {
+	if w.archiveSignal != nil {
+		return w.queueArchiving(path, recycle), nil
+	}
+
+	return nil, w.removeSegment(path, recycle)
+}
+
+// removeSegment returns a segment file to the recycling pool or removes it if
+// the pool is already full or recycle is false.
+// The caller must ensure the WAL is write-locked before calling this function.
+func (w *WAL) removeSegment(path string, recycle bool) error {
+	if !recycle || len(w.recycled) >= w.conf.RecycleSegments || isCompressed(path) {
+		w.logger.Info("Removing WAL segment", zap.String("path", path))
+		if err := w.fs.Remove(path); err != nil {
+			return err
+		}
+
+		return w.fs.SyncDir(w.path)
+	}
+
+	recycled := w.nextRecycledPath()
+	w.logger.Info("Recycling WAL segment",
+		zap.String("path", path),
+		zap.String("recycled_path", recycled),
+	)
+
+	if err := w.fs.Rename(path, recycled); err != nil {
+		return err
+	}
+
+	w.recycled = append(w.recycled, recycled)
+	return w.fs.SyncDir(w.path)
+}
+
+func (w *WAL) nextRecycledPath() string {
+	w.recycledSeq++
+	return filepath.Join(w.path, strconv.Itoa(w.recycledSeq)+recycledSuffix)
+}
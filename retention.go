@@ -0,0 +1,230 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// retentionEnabled returns whether any of the retention rules is enabled.
+func (c Configuration) retentionEnabled() bool {
+	return c.RetentionMaxSize > 0 || c.RetentionMaxSegments > 0 || c.RetentionMaxAge > 0
+}
+
+// runRetention periodically enforces the retention rules until the WAL is
+// closed.
+func (w *WAL) runRetention() {
+	defer w.background.Done()
+
+	interval := w.conf.RetentionInterval
+	if interval <= 0 {
+		interval = DefaultRetentionInterval
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if err := w.enforceRetention(); err != nil {
+				w.logger.Error("Failed to enforce WAL retention", zap.Error(err))
+			}
+		case <-w.closing:
+			return
+		}
+	}
+}
+
+// EnforceRetention immediately deletes all segments that violate any of the
+// retention rules of the Configuration. Usually, this does not need to be
+// called because the WAL periodically enforces its retention rules in the
+// background. If an Archiver was configured, the segments are deleted in the
+// background as soon as they were archived.
+func (w *WAL) EnforceRetention() error {
+	w.mu.Lock()
+	closed, readOnly := w.isClosed(), w.readOnly
+	w.mu.Unlock()
+
+	if closed {
+		return errors.New("WAL is already closed")
+	}
+
+	if readOnly {
+		return ErrReadOnly
+	}
+
+	return w.enforceRetention()
+}
+
+// retentionCandidate is a segment which violates a retention rule.
+type retentionCandidate struct {
+	path   string
+	reason string
+	info   os.FileInfo
+}
+
+// enforceRetention deletes the oldest segments, as long as they violate any
+// of the retention rules and only contain entries up to the checkpoint.
+//
+// The segments are inspected without holding the lock, so writes are not
+// blocked while the WAL reads the segment files. Only the state of the WAL is
+// copied under the lock at the beginning and the lock is acquired again to
+// check that the segments can still be deleted before deleting them.
+// The caller must not hold the lock when calling this function.
+func (w *WAL) enforceRetention() error {
+	if !w.conf.retentionEnabled() {
+		return nil
+	}
+
+	w.mu.Lock()
+	if w.isClosed() || w.checkpoint == 0 {
+		w.mu.Unlock()
+		return nil
+	}
+
+	checkpoint := w.checkpoint
+	current, currentFirstOffset := w.segmentPath(w.segmentID), w.firstOffset
+	archiving := make(map[string]bool, len(w.archiving))
+	for path := range w.archiving {
+		archiving[path] = true
+	}
+
+	segments, err := segmentFileNames(w.fs, w.path)
+	w.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("checking existing segment files: %w", err)
+	}
+
+	candidates, err := w.retentionCandidates(segments, current, currentFirstOffset, checkpoint, archiving)
+	if err != nil || len(candidates) == 0 {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// The WAL might have changed while we did not hold the lock. Segments are
+	// only deleted if they still exist and the checkpoint was not moved back.
+	if w.isClosed() || w.checkpoint < checkpoint {
+		return nil
+	}
+
+	segments, err = segmentFileNames(w.fs, w.path)
+	if err != nil {
+		return fmt.Errorf("checking existing segment files: %w", err)
+	}
+
+	existing := make(map[string]bool, len(segments))
+	for _, path := range segments {
+		existing[path] = true
+	}
+
+	for _, c := range candidates {
+		if !existing[c.path] || w.isArchiving(c.path) {
+			continue // already deleted or queued in the meantime
+		}
+
+		w.logger.Info("Deleting WAL segment due to retention policy",
+			zap.String("path", c.path),
+			zap.String("reason", c.reason),
+			zap.Uint32("checkpoint", checkpoint),
+			zap.Int64("size", c.info.Size()),
+			zap.Time("modified", c.info.ModTime()),
+		)
+
+		if _, err := w.discardSegment(c.path, true); err != nil {
+			return fmt.Errorf("deleting WAL segment %q: %w", c.path, err)
+		}
+	}
+
+	return nil
+}
+
+// retentionCandidates returns the oldest segments which violate any of the
+// retention rules and only contain entries up to the checkpoint. Segments
+// which are being archived are skipped, since they are deleted as soon as
+// they were archived. This function only reads the given state and the
+// segment files, so it must be called without holding the lock.
+func (w *WAL) retentionCandidates(segments []string, current string, currentFirstOffset, checkpoint uint32, archiving map[string]bool) ([]retentionCandidate, error) {
+	truncatable, err := w.segmentsBefore(segments, current, currentFirstOffset, checkpoint+1)
+	if err != nil || len(truncatable) == 0 {
+		return nil, err
+	}
+
+	count := len(segments)
+	size, err := w.totalSize(segments)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []retentionCandidate
+	now := time.Now()
+	for _, path := range truncatable {
+		info, err := w.statSegment(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if archiving[path] {
+			// The segment is deleted as soon as it was archived.
+			count--
+			size -= int(info.Size())
+			continue
+		}
+
+		var reason string
+		switch {
+		case w.conf.RetentionMaxSegments > 0 && count > w.conf.RetentionMaxSegments:
+			reason = "max_segments"
+		case w.conf.RetentionMaxSize > 0 && size > w.conf.RetentionMaxSize:
+			reason = "max_size"
+		case w.conf.RetentionMaxAge > 0:
+			t, err := w.segmentTime(path, info)
+			if err != nil {
+				return nil, err
+			}
+
+			if now.Sub(t) <= w.conf.RetentionMaxAge {
+				return result, nil // all remaining segments are newer
+			}
+
+			reason = "max_age"
+		default:
+			return result, nil
+		}
+
+		result = append(result, retentionCandidate{path: path, reason: reason, info: info})
+		count--
+		size -= int(info.Size())
+	}
+
+	return result, nil
+}
+
+// segmentTime returns the time of the newest entry in the segment at the given
+// path. If the WAL records timestamps, this is the timestamp of the last record
+// of the segment. Otherwise, or if the segment does not contain any timestamped
+// records, it falls back to the modification time of the file, which is not
+// reliable because compressing, copying or restoring a segment resets it.
+// The caller must not hold the lock when calling this function.
+func (w *WAL) segmentTime(path string, stat os.FileInfo) (time.Time, error) {
+	if !w.conf.RecordTimestamps {
+		return stat.ModTime(), nil
+	}
+
+	times, err := w.sealedSegmentTimes(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if times.last == 0 {
+		return stat.ModTime(), nil
+	}
+
+	return time.Unix(0, times.last), nil
+}
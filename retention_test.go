@@ -0,0 +1,136 @@
+package wal_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fgrosse/wal"
+	"github.com/fgrosse/wal/waltest"
+	"github.com/fgrosse/zaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL_EnforceRetention(t *testing.T) {
+	cases := map[string]func(*wal.Configuration){
+		"max segments": func(conf *wal.Configuration) { conf.RetentionMaxSegments = 2 },
+		"max size":     func(conf *wal.Configuration) { conf.RetentionMaxSize = 150 },
+	}
+
+	for name, configure := range cases {
+		t.Run(name, func(t *testing.T) {
+			fs := waltest.NewMemFS()
+			conf := wal.DefaultConfiguration()
+			conf.MaxSegmentSize = 60 // two entries per segment
+			configure(&conf)
+
+			w, err := wal.New("/wal", conf, waltest.ExampleEntries, zaptest.Logger(t), wal.WithFS(fs))
+			require.NoError(t, err)
+
+			for i := 1; i <= 7; i++ {
+				_, err := w.Write(&waltest.ExampleEntry1{ID: uint32(i), Point: []float32{1, 2}})
+				require.NoError(t, err)
+			}
+
+			t.Log("Without a checkpoint, no segment may be deleted")
+			require.NoError(t, w.EnforceRetention())
+			names, err := fs.List("/wal")
+			require.NoError(t, err)
+			assert.Equal(t, []string{"1.wal", "2.wal", "3.wal", "4.wal"}, names)
+
+			t.Log("Segments after the checkpoint must be kept")
+			w.SetCheckpoint(3)
+			require.NoError(t, w.EnforceRetention())
+			names, err = fs.List("/wal")
+			require.NoError(t, err)
+			assert.Equal(t, []string{"2.wal", "3.wal", "4.wal"}, names)
+
+			w.SetCheckpoint(7)
+			require.NoError(t, w.EnforceRetention())
+			names, err = fs.List("/wal")
+			require.NoError(t, err)
+			assert.Equal(t, []string{"3.wal", "4.wal"}, names)
+
+			require.NoError(t, w.Close())
+		})
+	}
+}
+
+func TestWAL_RetentionMaxAge(t *testing.T) {
+	path := t.TempDir()
+	conf := wal.DefaultConfiguration()
+	conf.MaxSegmentSize = 60 // two entries per segment
+	conf.RetentionMaxAge = time.Hour
+	conf.RetentionInterval = 10 * time.Millisecond
+
+	w, err := wal.New(path, conf, waltest.ExampleEntries, zaptest.Logger(t))
+	require.NoError(t, err)
+
+	for i := 1; i <= 5; i++ {
+		_, err := w.Write(&waltest.ExampleEntry1{ID: uint32(i), Point: []float32{1, 2}})
+		require.NoError(t, err)
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	for _, name := range []string{"1.wal", "3.wal"} {
+		require.NoError(t, os.Chtimes(filepath.Join(path, name), old, old))
+	}
+
+	t.Log("The background goroutine should delete old segments up to the checkpoint")
+	w.SetCheckpoint(5)
+	assert.Eventually(t, func() bool {
+		segments, err := wal.SegmentFileNames(path)
+		return err == nil && len(segments) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	segments, err := wal.SegmentFileNames(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(path, "2.wal"),
+		filepath.Join(path, "3.wal"),
+	}, segments, "only the oldest segments should be deleted")
+
+	require.NoError(t, w.Close())
+}
+
+func TestWAL_RetentionMaxAge_RecordTimestamps(t *testing.T) {
+	path := t.TempDir()
+	conf := wal.DefaultConfiguration()
+	conf.MaxSegmentSize = 1 // one entry per segment
+	conf.RecordTimestamps = true
+	conf.RetentionMaxAge = 100 * time.Millisecond
+
+	w, err := wal.New(path, conf, waltest.ExampleEntries, zaptest.Logger(t))
+	require.NoError(t, err)
+
+	for i := 1; i <= 4; i++ {
+		if i == 3 {
+			time.Sleep(2 * conf.RetentionMaxAge)
+		}
+
+		_, err := w.Write(&waltest.ExampleEntry1{ID: uint32(i), Point: []float32{1, 2}})
+		require.NoError(t, err)
+	}
+
+	t.Log("Touching the old segments must not make them look new")
+	now := time.Now()
+	segments, err := wal.SegmentFileNames(path)
+	require.NoError(t, err)
+	for _, segment := range segments {
+		require.NoError(t, os.Chtimes(segment, now, now))
+	}
+
+	w.SetCheckpoint(4)
+	require.NoError(t, w.EnforceRetention())
+
+	segments, err = wal.SegmentFileNames(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(path, "3.wal"),
+		filepath.Join(path, "4.wal"),
+	}, segments, "segments should be deleted based on the timestamp of their last record")
+
+	require.NoError(t, w.Close())
+}
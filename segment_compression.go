@@ -0,0 +1,221 @@
+package wal
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// compressingSuffix is appended to the file name of a segment while it is being
+// compressed, e.g. "7.wal.gz.tmp". Such files are renamed to their final name
+// once they are complete, so they are never picked up by SegmentFileNames(…).
+const compressingSuffix = compressedSuffix + ".tmp"
+
+// startSegmentCompression schedules the compression of all sealed segments
+// which have not been compressed yet (e.g. because the WAL was closed before)
+// and then starts compressing segments in the background.
+func (w *WAL) startSegmentCompression() error {
+	// Files of interrupted compressions are incomplete, so we can remove them.
+	stale, err := listFiles(w.fs, w.path, compressingSuffix)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range stale {
+		if err := w.fs.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	segments, err := segmentFileNames(w.fs, w.path)
+	if err != nil {
+		return fmt.Errorf("checking existing segment files: %w", err)
+	}
+
+	for _, path := range segments {
+		if isCompressed(path) || (w.segment != nil && path == w.segmentPath(w.segmentID)) {
+			continue
+		}
+
+		w.compressQueue = append(w.compressQueue, path)
+	}
+
+	w.compressSignal = make(chan struct{}, 1)
+	if len(w.compressQueue) > 0 {
+		w.compressSignal <- struct{}{}
+	}
+
+	w.background.Add(1)
+	go w.runSegmentCompression()
+
+	return nil
+}
+
+// queueSegmentCompression schedules a sealed segment to be compressed in the
+// background if Configuration.CompressSegments is enabled.
+// The caller must ensure the WAL is write-locked before calling this function.
+func (w *WAL) queueSegmentCompression(path string) {
+	if w.compressSignal == nil {
+		return
+	}
+
+	w.compressQueue = append(w.compressQueue, path)
+
+	// Wake up the background goroutine unless it was already notified.
+	select {
+	case w.compressSignal <- struct{}{}:
+	default:
+	}
+}
+
+// runSegmentCompression compresses all queued segments until the WAL is
+// closed. Segments that are still queued when the WAL is closed are compressed
+// after the WAL has been opened again.
+func (w *WAL) runSegmentCompression() {
+	defer w.background.Done()
+
+	for {
+		select {
+		case <-w.compressSignal:
+		case <-w.closing:
+			return
+		}
+
+		for {
+			w.mu.Lock()
+			if w.isClosed() || len(w.compressQueue) == 0 {
+				w.mu.Unlock()
+				break
+			}
+
+			path := w.compressQueue[0]
+			w.compressQueue = w.compressQueue[1:]
+			w.mu.Unlock()
+
+			if err := w.compressSegment(path); err != nil {
+				w.logger.Error("Failed to compress WAL segment",
+					zap.String("path", path),
+					zap.Error(err),
+				)
+			}
+		}
+	}
+}
+
+// compressSegment replaces the sealed segment at the given path with a gzip
+// compressed copy (e.g. "7.wal" becomes "7.wal.gz").
+//
+// The compressed copy is written to a temporary file first, which is then
+// atomically renamed. Only afterwards the original segment file is removed.
+// If we crash in between, both files exist and the original segment wins (see
+// segmentFileNames(…)). Since the heavy lifting happens without holding the
+// lock, the WAL can keep on writing to the current segment in the meantime.
+func (w *WAL) compressSegment(path string) error {
+	start := time.Now()
+	tmp := path + compressingSuffix
+
+	size, err := w.writeCompressedSegment(path, tmp)
+	if err != nil {
+		_ = w.fs.Remove(tmp)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil // segment was truncated concurrently
+		}
+
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// The segment might have been removed or recycled while we were
+	// compressing it. In this case, we must not bring it back. The same is
+	// true if it is being archived, since it is removed afterwards. If the
+	// WAL was closed, the segment is compressed again when the WAL is opened.
+	if _, err := w.statSegment(path); w.isClosed() || w.isArchiving(path) || errors.Is(err, os.ErrNotExist) {
+		return w.fs.Remove(tmp)
+	} else if err != nil {
+		_ = w.fs.Remove(tmp)
+		return err
+	}
+
+	target := path + compressedSuffix
+	if err := w.fs.Rename(tmp, target); err != nil {
+		_ = w.fs.Remove(tmp)
+		return err
+	}
+
+	if err := w.fs.SyncDir(w.path); err != nil {
+		return err
+	}
+
+	if err := w.fs.Remove(path); err != nil {
+		return err
+	}
+
+	if err := w.fs.SyncDir(w.path); err != nil {
+		return err
+	}
+
+	compressed, err := w.statSegment(target)
+	if err != nil {
+		return err
+	}
+
+	w.logger.Info("Compressed WAL segment",
+		zap.String("path", target),
+		zap.Int64("size", size),
+		zap.Int64("compressed_size", compressed.Size()),
+		zap.Duration("took", time.Since(start)),
+	)
+
+	return nil
+}
+
+// writeCompressedSegment writes a gzip compressed copy of the segment at the
+// given path into a new file at tmp and syncs it. Anything after the logical
+// end of the segment (e.g. preallocated space or stale data of a recycled
+// segment file) is omitted. It returns the uncompressed size of the segment.
+func (w *WAL) writeCompressedSegment(path, tmp string) (int64, error) {
+	id, err := parseSegmentID(path)
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := w.inspectSegment(path, id)
+	if err != nil {
+		return 0, err
+	}
+
+	src, err := w.fs.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	defer src.Close()
+
+	dst, err := w.fs.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return 0, err
+	}
+
+	gz := gzip.NewWriter(dst)
+	_, err = io.CopyN(gz, src, info.end)
+	if err == nil {
+		err = gz.Close()
+	}
+
+	if err == nil {
+		err = dst.Sync()
+	}
+
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+
+	return info.end, err
+}
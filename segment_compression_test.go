@@ -0,0 +1,126 @@
+package wal_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fgrosse/wal"
+	"github.com/fgrosse/wal/waltest"
+	"github.com/fgrosse/zaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL_CompressSegments(t *testing.T) {
+	fs := waltest.NewMemFS()
+	logger := zaptest.Logger(t)
+	conf := wal.DefaultConfiguration()
+	conf.MaxSegmentSize = 200
+	conf.CompressSegments = true
+
+	archiver := &recordingArchiver{Archiver: &wal.DirArchiver{Dir: "/archive", FS: fs}}
+	w, err := wal.New("/wal", conf, waltest.ExampleEntries, logger, wal.WithFS(fs), wal.WithArchiver(archiver))
+	require.NoError(t, err)
+
+	var expected []wal.Entry
+	for i := 1; i <= 12; i++ {
+		e := &waltest.ExampleEntry2{Name: fmt.Sprintf("%03d-%s", i, strings.Repeat("a", 50))}
+		expected = append(expected, e)
+
+		_, err := w.Write(e)
+		require.NoError(t, err)
+	}
+
+	t.Log("All sealed segments should be compressed in the background")
+	assert.Eventually(t, func() bool {
+		names, err := fs.List("/wal")
+		require.NoError(t, err)
+		return assert.ObjectsAreEqual([]string{"1.wal.gz", "2.wal.gz", "3.wal.gz", "4.wal"}, names)
+	}, time.Second, time.Millisecond)
+
+	content, err := fs.ReadFile("/wal/1.wal.gz")
+	require.NoError(t, err)
+	assert.Less(t, len(content), conf.MaxSegmentSize/2)
+
+	t.Log("Compressed segments should be replayed transparently")
+	replay := func(w *wal.WAL) []wal.Entry {
+		var actual []wal.Entry
+		err := w.Replay(0, func(_ uint32, e wal.Entry) error {
+			actual = append(actual, e)
+			return nil
+		})
+		require.NoError(t, err)
+		return actual
+	}
+
+	assert.Equal(t, expected, replay(w))
+
+	t.Log("Compressed segments should be archived uncompressed")
+	require.NoError(t, w.TruncateFront(4))
+	require.Len(t, archiver.archived(), 1)
+	assert.Equal(t, "/wal/1.wal.gz", archiver.archived()[0].Path)
+	names, err := fs.List("/archive")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.wal.gz"}, names)
+
+	require.NoError(t, w.Close())
+
+	t.Log("Reopening the WAL should continue with the last segment")
+	w, err = wal.New("/wal", conf, waltest.ExampleEntries, logger, wal.WithFS(fs))
+	require.NoError(t, err)
+	assert.EqualValues(t, 12, w.Offset())
+
+	e := &waltest.ExampleEntry2{Name: "b"}
+	offset, err := w.Write(e)
+	require.NoError(t, err)
+	assert.EqualValues(t, 13, offset)
+	assert.Equal(t, append(expected[3:], e), replay(w))
+	require.NoError(t, w.Close())
+}
+
+func TestWAL_CompressSegments_Recovery(t *testing.T) {
+	fs := waltest.NewMemFS()
+	logger := zaptest.Logger(t)
+	conf := wal.DefaultConfiguration()
+	conf.MaxSegmentSize = 200
+
+	w, err := wal.New("/wal", conf, waltest.ExampleEntries, logger, wal.WithFS(fs))
+	require.NoError(t, err)
+
+	var expected []wal.Entry
+	for i := 1; i <= 10; i++ {
+		e := &waltest.ExampleEntry2{Name: fmt.Sprintf("%03d-%s", i, strings.Repeat("a", 50))}
+		expected = append(expected, e)
+
+		_, err := w.Write(e)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, w.Close())
+
+	t.Log("Simulating a crash while compressing the first two segments")
+	require.NoError(t, fs.WriteFile("/wal/1.wal.gz", []byte("incomplete")))
+	require.NoError(t, fs.WriteFile("/wal/2.wal.gz.tmp", []byte("incomplete")))
+
+	conf.CompressSegments = true
+	w, err = wal.New("/wal", conf, waltest.ExampleEntries, logger, wal.WithFS(fs))
+	require.NoError(t, err)
+
+	t.Log("All sealed segments should be compressed after opening the WAL")
+	assert.Eventually(t, func() bool {
+		names, err := fs.List("/wal")
+		require.NoError(t, err)
+		return assert.ObjectsAreEqual([]string{"1.wal.gz", "2.wal.gz", "3.wal.gz", "4.wal"}, names)
+	}, time.Second, time.Millisecond)
+
+	var actual []wal.Entry
+	err = w.Replay(0, func(_ uint32, e wal.Entry) error {
+		actual = append(actual, e)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+	require.NoError(t, w.Close())
+}
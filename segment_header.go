@@ -0,0 +1,134 @@
+package wal
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// SegmentHeader is written at the beginning of each segment file that is
+// created by the WAL. It identifies the segment and the offset of its first
+// record, which enables the SegmentReader to distinguish live records from
+// stale data at the end of segment files that have been recycled.
+//
+// The header is written using the following binary layout (big endian format):
+//
+//	  ┌────────────┬──────────────┬───────────┬─────────────────┬───────────────────┐
+//	  │ Magic (4B) │ Version (1B) │ Size (2B) │ Segment ID (4B) │ First Offset (4B) │
+//	  └────────────┴──────────────┴───────────┴─────────────────┴───────────────────┘
+//
+//		- Magic = The bytes "WALS" which distinguish segments with a header from legacy segments
+//		- Version = The version of the segment format
+//		- Size = The total size of the header in bytes, so new fields can be appended in the future
+//		- Segment ID = The ID of the segment which is also used in its file name
+//		- First Offset = The offset of the first record in this segment
+//
+// Segments whose records are part of a hash chain (see WithHashChain(…)) have
+// a larger header with the following additional fields:
+//
+//	  ┌────────────┬───────────────┐
+//	  │ Flags (1B) │ Anchor (32B)  │
+//	  └────────────┴───────────────┘
+//
+//		- Flags = Bit field which marks the segment as chained and, optionally, signed using HMAC
+//		- Anchor = The hash of the last record of the previous segment
+//
+// Segments without a header are still supported. For such legacy segments,
+// the SegmentReader does not check the offsets of the records it reads.
+type SegmentHeader struct {
+	Version     uint8 // set automatically by SegmentWriter.WriteHeader(…)
+	SegmentID   uint32
+	FirstOffset uint32
+
+	// Chained is true if all records of the segment are part of a hash chain.
+	// In this case, Anchor contains the hash of the last record of the
+	// previous segment, or zero if the chain starts in this segment. Signed
+	// is true if the chain uses HMAC-SHA256 instead of plain SHA-256.
+	Chained bool
+	Signed  bool
+	Anchor  [sha256.Size]byte
+}
+
+// SegmentVersion is the version of the segment format that is written by this
+// version of the library.
+// Version 2 introduced extended records (see SegmentWriter).
+const SegmentVersion uint8 = 2
+
+// segmentMagic is written at the start of every segment header.
+var segmentMagic = [4]byte{'W', 'A', 'L', 'S'}
+
+// segmentHeaderSize is the size of the segment header that is written by this
+// version of the library.
+const segmentHeaderSize = 4 + 1 + 2 + 4 + 4
+
+// chainedHeaderSize is the size of the header of hash chained segments.
+const chainedHeaderSize = segmentHeaderSize + 1 + sha256.Size
+
+// Flags of the segment header.
+const (
+	headerFlagChained uint8 = 1 << iota // the records of the segment are hash chained
+	headerFlagSigned                    // the hash chain uses HMAC-SHA256
+)
+
+// appendSegmentHeader appends the binary representation of the header to b.
+func appendSegmentHeader(b []byte, h SegmentHeader) []byte {
+	b = append(b, segmentMagic[:]...)
+	b = append(b, h.Version)
+	if !h.Chained {
+		b = binary.BigEndian.AppendUint16(b, segmentHeaderSize)
+		b = binary.BigEndian.AppendUint32(b, h.SegmentID)
+		b = binary.BigEndian.AppendUint32(b, h.FirstOffset)
+		return b
+	}
+
+	flags := headerFlagChained
+	if h.Signed {
+		flags |= headerFlagSigned
+	}
+
+	b = binary.BigEndian.AppendUint16(b, chainedHeaderSize)
+	b = binary.BigEndian.AppendUint32(b, h.SegmentID)
+	b = binary.BigEndian.AppendUint32(b, h.FirstOffset)
+	b = append(b, flags)
+	b = append(b, h.Anchor[:]...)
+	return b
+}
+
+// readSegmentHeader reads a segment header from r. The caller must already
+// have checked that the next bytes in r start with the segmentMagic.
+func readSegmentHeader(r io.Reader) (SegmentHeader, error) {
+	var prefix [7]byte // 4B magic + 1B version + 2B size
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return SegmentHeader{}, fmt.Errorf("reading segment header: %w", err)
+	}
+
+	h := SegmentHeader{Version: prefix[4]}
+	if h.Version == 0 || h.Version > SegmentVersion {
+		return h, fmt.Errorf("unsupported segment version %d", h.Version)
+	}
+
+	size := int(binary.BigEndian.Uint16(prefix[5:7]))
+	if size < segmentHeaderSize {
+		return h, fmt.Errorf("invalid segment header size %d", size)
+	}
+
+	// Headers written by future versions of this library may be larger.
+	// We only decode the fields we know and skip the rest.
+	fields := make([]byte, size-len(prefix))
+	if _, err := io.ReadFull(r, fields); err != nil {
+		return h, fmt.Errorf("reading segment header: %w", err)
+	}
+
+	h.SegmentID = binary.BigEndian.Uint32(fields[0:4])
+	h.FirstOffset = binary.BigEndian.Uint32(fields[4:8])
+
+	if size >= chainedHeaderSize {
+		flags := fields[8]
+		h.Chained = flags&headerFlagChained != 0
+		h.Signed = flags&headerFlagSigned != 0
+		copy(h.Anchor[:], fields[9:9+sha256.Size])
+	}
+
+	return h, nil
+}
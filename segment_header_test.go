@@ -0,0 +1,66 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSegmentWriter_WriteHeader(t *testing.T) {
+	w := NewTestWriter()
+	sw := NewSegmentWriter(w)
+
+	err := sw.WriteHeader(SegmentHeader{SegmentID: 7, FirstOffset: 42})
+	require.NoError(t, err)
+	require.NoError(t, sw.Sync())
+	assert.Equal(t, segmentHeaderSize, sw.size)
+
+	var expected []byte
+	expected = append(expected, 'W', 'A', 'L', 'S')                       // Magic (4B)
+	expected = append(expected, SegmentVersion)                           // Version (1B)
+	expected = binary.BigEndian.AppendUint16(expected, segmentHeaderSize) // Size (2B)
+	expected = binary.BigEndian.AppendUint32(expected, 7)                 // Segment ID (4B)
+	expected = binary.BigEndian.AppendUint32(expected, 42)                // First Offset (4B)
+
+	assert.Equal(t, expected, w.Bytes())
+}
+
+func TestReadSegmentHeader(t *testing.T) {
+	b := appendSegmentHeader(nil, SegmentHeader{Version: SegmentVersion, SegmentID: 3, FirstOffset: 100})
+	h, err := readSegmentHeader(bytes.NewReader(b))
+	require.NoError(t, err)
+	assert.Equal(t, SegmentHeader{Version: SegmentVersion, SegmentID: 3, FirstOffset: 100}, h)
+
+	t.Run("unsupported version", func(t *testing.T) {
+		b := appendSegmentHeader(nil, SegmentHeader{Version: 99})
+		_, err := readSegmentHeader(bytes.NewReader(b))
+		assert.EqualError(t, err, "unsupported segment version 99")
+	})
+
+	t.Run("chained", func(t *testing.T) {
+		expected := SegmentHeader{Version: SegmentVersion, SegmentID: 3, FirstOffset: 100, Chained: true, Signed: true}
+		expected.Anchor[0] = 42
+
+		b := appendSegmentHeader(nil, expected)
+		assert.Len(t, b, chainedHeaderSize)
+
+		h, err := readSegmentHeader(bytes.NewReader(b))
+		require.NoError(t, err)
+		assert.Equal(t, expected, h)
+	})
+
+	t.Run("larger header", func(t *testing.T) {
+		b := appendSegmentHeader(nil, SegmentHeader{Version: SegmentVersion, SegmentID: 3, FirstOffset: 100})
+		binary.BigEndian.PutUint16(b[5:7], segmentHeaderSize+3)
+		b = append(b, 1, 2, 3, 4) // 3 bytes unknown header fields + 1 byte data
+
+		r := bytes.NewReader(b)
+		h, err := readSegmentHeader(r)
+		require.NoError(t, err)
+		assert.EqualValues(t, 100, h.FirstOffset)
+		assert.Equal(t, 1, r.Len(), "unknown header fields should be skipped")
+	})
+}
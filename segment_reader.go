@@ -2,11 +2,15 @@ package wal
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
+	"math"
+	"time"
 )
 
 // The SegmentReader is responsible for reading WAL entries from their binary
@@ -29,51 +33,218 @@ import (
 //	if err := r.Err(); err != nil {
 //	  …
 //	}
+//
+// Since the WAL starts counting offsets at 1, a record with offset zero marks
+// the end of the segment. This way, segment files which have been preallocated
+// with zeros can be read like any other segment file.
+//
+// If the segment starts with a SegmentHeader, the reader additionally expects
+// the offsets of all records to be consecutive, starting at the first offset
+// of the header. The first record that does not match the expected offset
+// marks the end of the segment. This way, stale records at the end of recycled
+// segment files are never mistaken for live records.
+//
+// Entries that have been compressed using a Codec are decompressed
+// transparently by SegmentReader.Decode(). Encrypted entries can only be
+// decoded after a KeyProvider was set via SegmentReader.SetKeyProvider(…).
+//
+// By default, each call to ReadNext() creates a new Entry and reads its
+// payload into a new buffer. To replay large segments without allocating for
+// each record, the reader can reuse its entries and buffers instead (see
+// SegmentReader.SetReuseEntries(…)).
 type SegmentReader struct {
-	r        *bufio.Reader
-	offset   uint32
-	typ      EntryType
-	checksum uint32
-	entry    Entry
-	payload  []byte
-	err      error
-	registry *EntryRegistry
+	r          *positionReader
+	header     SegmentHeader
+	hasHeader  bool
+	nextOffset uint32 // expected offset of the next record, if the segment has a header
+	offset     uint32
+	typ        EntryType
+	checksum   uint32
+	codec      CodecID // the codec of the current entry or zero if its payload is not compressed
+	encrypted  bool    // whether the payload of the current entry is encrypted
+	keyID      KeyID   // the key of the current entry, if it is encrypted
+	chained    bool    // whether the current entry is part of a hash chain
+	hash       [sha256.Size]byte
+	version    EntryVersion // the schema version of the current entry
+	timestamp  int64        // nanoseconds since the unix epoch or zero if the current entry has no timestamp
+	headers    []byte       // the encoded headers of the current entry
+	encryption *encryption
+	raw        bool // whether unknown entries are read as RawEntry
+	reuse      bool // whether entries and buffers are reused across calls to ReadNext()
+	entries    map[entryKey]Entry
+	rawEntry   *RawEntry
+	buf        []byte // the reused payload buffer
+	headerBuf  []byte // the reused buffer of the encoded headers
+	plain      []byte // the reused buffer of the decrypted payload
+	inflated   []byte // the reused buffer of the decompressed payload
+	scratch    [9]byte
+	verify     bool   // whether SeekEnd() and SeekOffset(…) verify the checksums of all records
+	skipped    bool   // whether the payload of the current entry was skipped
+	crc        uint32 // the checksum of the skipped payload, if checksums are verified
+	entry      Entry
+	payload    []byte
+	err        error
+	registry   *EntryRegistry
 }
 
 // NewSegmentReader creates a new SegmentReader that reads encoded WAL entries
 // from the provided reader. The registry is used to map the entry types that
 // have been read to their Entry implementations which contain the decoding logic.
 func NewSegmentReader(r io.Reader, registry *EntryRegistry) (*SegmentReader, error) {
-	return &SegmentReader{
-		r:        bufio.NewReader(r),
+	sr := &SegmentReader{
+		r:        &positionReader{r: bufio.NewReader(r)},
 		registry: registry,
-	}, nil
+	}
+
+	magic, err := sr.r.r.Peek(len(segmentMagic))
+	if err != nil || !bytes.Equal(magic, segmentMagic[:]) {
+		// This is either an empty or a legacy segment without header.
+		return sr, nil
+	}
+
+	sr.header, err = readSegmentHeader(sr.r)
+	if err != nil {
+		return nil, err
+	}
+
+	sr.hasHeader = true
+	sr.nextOffset = sr.header.FirstOffset
+
+	return sr, nil
+}
+
+// SetKeyProvider sets the KeyProvider which is used to decrypt encrypted
+// entries.
+func (r *SegmentReader) SetKeyProvider(keys KeyProvider) {
+	r.encryption = newEncryption(keys)
+}
+
+// SetRawEntries enables reading entries whose EntryType is not registered at
+// the EntryRegistry as RawEntry instead of failing. Only records which store
+// the length of their payload can be read as RawEntry.
+func (r *SegmentReader) SetRawEntries(enabled bool) {
+	r.raw = enabled
+}
+
+// SetReuseEntries enables reusing a single Entry per EntryType and version as
+// well as the payload buffers across calls to ReadNext(). Entries which
+// implement the PayloadAppender interface are then read without allocating.
+//
+// In this mode, the Entry that is returned by Decode() and all of its fields
+// that reference the payload (e.g. a RawEntry.Payload) are only valid until
+// the next call to ReadNext(). Callers which want to keep an Entry must copy
+// it before reading the next record. Additionally, the DecodePayload(…) method
+// of each Entry must overwrite all fields of the entry, since it is called on
+// the Entry of the previous record of the same type.
+func (r *SegmentReader) SetReuseEntries(enabled bool) {
+	r.reuse = enabled
+	if enabled && r.entries == nil {
+		r.entries = map[entryKey]Entry{}
+	}
+}
+
+// Header returns the SegmentHeader of the segment. The boolean return value is
+// false if the segment does not have a header.
+func (r *SegmentReader) Header() (SegmentHeader, bool) {
+	return r.header, r.hasHeader
+}
+
+// SetVerifyOnSeek enables verifying the checksums of all records that are read
+// by SegmentReader.SeekEnd() and SegmentReader.SeekOffset(…). The checksum of a
+// skipped payload is computed while it is discarded, so the payload is still
+// never held in memory. The first corrupted record stops the seek and is
+// returned via SegmentReader.Err().
+func (r *SegmentReader) SetVerifyOnSeek(enabled bool) {
+	r.verify = enabled
 }
 
 // SeekEnd reads through the entire segment until the end and returns the last offset.
+//
+// If the records store the length of their payload (see
+// Configuration.RecordLengths), their payloads are discarded without reading
+// them into memory. The payloads of all other records are read into a reused
+// buffer, since only their Entry implementation knows where they end.
 func (r *SegmentReader) SeekEnd() (lastOffset uint32, err error) {
-	for r.ReadNext() {
+	for r.next(skipAll) {
+		if r.err != nil || !r.verified() {
+			break
+		}
+
 		lastOffset = r.Offset()
 	}
 
 	return lastOffset, r.Err()
 }
 
+// SeekOffset reads through the segment until the record with the given offset,
+// or the first record after it, and returns whether such a record was found.
+// This record can then be decoded via SegmentReader.Decode() as if it was read
+// by SegmentReader.ReadNext(). Like SegmentReader.SeekEnd(), SeekOffset skips
+// the payloads of all records before it without reading them into memory, if
+// possible.
+func (r *SegmentReader) SeekOffset(offset uint32) bool {
+	for r.next(offset) {
+		if r.err != nil || r.offset >= offset {
+			return true
+		}
+
+		if !r.verified() {
+			return false
+		}
+	}
+
+	return false
+}
+
+// verified returns false and sets the error of the reader, if checksums are
+// verified on seeks and the current entry is corrupted.
+func (r *SegmentReader) verified() bool {
+	if !r.verify || r.err != nil || r.validChecksum() {
+		return true
+	}
+
+	r.err = fmt.Errorf("detected WAL Entry corruption at WAL offset %d", r.offset)
+	return false
+}
+
 // ReadNext loads the data for the next Entry from the underlying reader.
 // For efficiency reasons, this function neither checks the entry checksum,
 // nor does it decode the entry bytes. This is done, so the caller can quickly
 // seek through a WAL up to a specific offset without having to decode each WAL
-// entry.
+// entry. To skip the payloads entirely, use SegmentReader.SeekOffset(…).
 //
 // You can get the offset of the current entry using SegmentReader.Offset().
 // In order to actually decode the read WAL entry, you need to use SegmentReader.Decode(…).
+// Once reading an entry failed, ReadNext returns false and the error is
+// returned by SegmentReader.Err().
 func (r *SegmentReader) ReadNext() bool {
-	var header [9]byte // 4B offset + 1B type + 4B checksum
-	n, err := io.ReadFull(r.r, header[:])
+	if r.err != nil {
+		return false
+	}
+
+	return r.next(0)
+}
+
+// skipAll makes SegmentReader.next(…) skip the payloads of all records.
+const skipAll = math.MaxUint32
+
+// next reads the next record. The payloads of records with an offset below
+// skipBelow are skipped if their records store the length. Otherwise, they are
+// read into the reused payload buffer. The error of the previous record is
+// reset, so the WAL can continue reading after an incomplete record.
+func (r *SegmentReader) next(skipBelow uint32) bool {
+	r.err = nil
+	header := r.scratch[:9] // 4B offset + 1B type + 4B checksum
+	n, err := io.ReadFull(r.r, header)
 	if err == io.EOF {
 		return false
 	}
 
+	if err == io.ErrUnexpectedEOF && r.hasHeader {
+		// We reached a fragment of stale data at the end of a recycled segment.
+		return false
+	}
+
 	if err != nil {
 		r.err = err
 		return false
@@ -85,25 +256,333 @@ func (r *SegmentReader) ReadNext() bool {
 	}
 
 	r.offset = binary.BigEndian.Uint32(header[:4])
+	if r.offset == 0 {
+		// We reached zero-filled space at the end of a preallocated segment.
+		return false
+	}
+
+	if r.hasHeader {
+		if r.offset != r.nextOffset {
+			// We reached stale data at the end of a recycled segment.
+			return false
+		}
+
+		r.nextOffset++
+	}
+
 	r.typ = EntryType(header[4])
 	r.checksum = binary.BigEndian.Uint32(header[5:9])
+	r.codec = 0
+	r.encrypted = false
+	r.chained = false
+	r.version = 0
+	r.timestamp = 0
+	r.headers = nil
+	r.skipped = false
 
-	r.entry, err = r.registry.New(r.typ)
+	skip := r.offset < skipBelow
+	if r.typ == extendedRecordType && r.hasHeader && r.header.Version >= 2 {
+		return r.readExtended(skip)
+	}
+
+	r.entry, err = r.newEntry(r.typ, 0, r.reuse || skip)
 	if err != nil {
 		r.err = err
 		return false
 	}
 
+	if a, ok := r.entry.(PayloadAppender); ok && (r.reuse || skip) {
+		r.buf, r.err = a.AppendPayload(r.buf[:0], r.r)
+		r.payload = r.buf
+		return true
+	}
+
 	r.payload, r.err = r.entry.ReadPayload(r.r)
 	return true
 }
 
+// newEntry creates the Entry of the given type and version or returns the
+// Entry of the previous record of the same type, if reuse is true.
+func (r *SegmentReader) newEntry(typ EntryType, version EntryVersion, reuse bool) (Entry, error) {
+	if !reuse {
+		return r.registry.NewVersion(typ, version)
+	}
+
+	if r.entries == nil {
+		r.entries = map[entryKey]Entry{}
+	}
+
+	key := entryKey{typ: typ, version: version}
+	if e, ok := r.entries[key]; ok {
+		return e, nil
+	}
+
+	e, err := r.registry.NewVersion(typ, version)
+	if err == nil {
+		r.entries[key] = e
+	}
+
+	return e, err
+}
+
+// readExtended reads the remaining fields and the payload of an extended
+// record (see SegmentWriter). If skip is true, the payload is discarded.
+func (r *SegmentReader) readExtended(skip bool) bool {
+	header := r.scratch[:1+2+4] // 1B flags + 1B or 2B type + 4B length
+	if _, err := io.ReadFull(r.r, header[:1]); err != nil {
+		r.err = io.ErrUnexpectedEOF
+		return true
+	}
+
+	flags := header[0]
+	if flags&^knownRecordFlags != 0 {
+		r.err = fmt.Errorf("unsupported record flags %08b at WAL offset %d", flags, r.offset)
+		return true
+	}
+
+	fields := header[1:6]
+	if flags&recordFlagWideType != 0 {
+		fields = header[1:7]
+	}
+
+	if _, err := io.ReadFull(r.r, fields); err != nil {
+		r.err = io.ErrUnexpectedEOF
+		return true
+	}
+
+	if flags&recordFlagWideType != 0 {
+		r.typ = EntryType(binary.BigEndian.Uint16(fields))
+		fields = fields[2:]
+	} else {
+		r.typ = EntryType(fields[0])
+		fields = fields[1:]
+	}
+
+	length := binary.BigEndian.Uint32(fields)
+
+	if flags&recordFlagCompressed != 0 {
+		codec := r.scratch[:1]
+		if _, err := io.ReadFull(r.r, codec); err != nil {
+			r.err = io.ErrUnexpectedEOF
+			return true
+		}
+
+		r.codec = CodecID(codec[0])
+	}
+
+	if flags&recordFlagEncrypted != 0 {
+		keyID := r.scratch[:4]
+		if _, err := io.ReadFull(r.r, keyID); err != nil {
+			r.err = io.ErrUnexpectedEOF
+			return true
+		}
+
+		r.encrypted = true
+		r.keyID = KeyID(binary.BigEndian.Uint32(keyID))
+	}
+
+	if flags&recordFlagChained != 0 {
+		if _, err := io.ReadFull(r.r, r.hash[:]); err != nil {
+			r.err = io.ErrUnexpectedEOF
+			return true
+		}
+
+		r.chained = true
+	}
+
+	if flags&recordFlagVersion != 0 {
+		version := r.scratch[:1]
+		if _, err := io.ReadFull(r.r, version); err != nil {
+			r.err = io.ErrUnexpectedEOF
+			return true
+		}
+
+		r.version = EntryVersion(version[0])
+	}
+
+	if flags&recordFlagTimestamp != 0 {
+		timestamp := r.scratch[:8]
+		if _, err := io.ReadFull(r.r, timestamp); err != nil {
+			r.err = io.ErrUnexpectedEOF
+			return true
+		}
+
+		r.timestamp = int64(binary.BigEndian.Uint64(timestamp))
+	}
+
+	if flags&recordFlagHeaders != 0 {
+		size := r.scratch[:2]
+		if _, err := io.ReadFull(r.r, size); err != nil {
+			r.err = io.ErrUnexpectedEOF
+			return true
+		}
+
+		n := int(binary.BigEndian.Uint16(size))
+		if r.reuse || skip {
+			r.headerBuf = grow(r.headerBuf[:0], n)
+			r.headers = r.headerBuf
+		} else {
+			r.headers = make([]byte, n)
+		}
+
+		if _, err := io.ReadFull(r.r, r.headers); err != nil {
+			r.err = io.ErrUnexpectedEOF
+			return true
+		}
+	}
+
+	if skip {
+		// We do not need an Entry to skip the payload, but unknown entries
+		// must still be detected.
+		key := entryKey{typ: r.typ, version: r.version}
+		if _, ok := r.registry.constructor(key); !ok && !r.raw {
+			r.err = unknownEntryError(r.typ, r.version)
+			return false
+		}
+
+		r.entry, r.payload, r.skipped = nil, nil, true
+		r.err = r.discard(int(length))
+		return true
+	}
+
+	var err error
+	r.entry, err = r.newEntry(r.typ, r.version, r.reuse)
+	if err != nil && r.raw {
+		r.entry, err = r.newRawEntry(), nil
+	}
+
+	if err != nil {
+		r.err = err
+		return false
+	}
+
+	if !r.reuse {
+		// We do not allocate the entire buffer upfront, since the length
+		// might be garbage if the record is incomplete.
+		var payload bytes.Buffer
+		_, err = io.CopyN(&payload, r.r, int64(length))
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		r.payload, r.err = payload.Bytes(), err
+		return true
+	}
+
+	r.buf, r.err = readLength(r.buf[:0], r.r, int(length))
+	r.payload = r.buf
+	return true
+}
+
+// discard skips the payload of the current record. If checksums are verified
+// on seeks, the checksum of the payload is computed along the way.
+func (r *SegmentReader) discard(n int) error {
+	r.crc = 0
+	if !r.verify {
+		if _, err := r.r.Discard(n); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+
+		return nil
+	}
+
+	for n > 0 {
+		chunk := n
+		if chunk > r.r.r.Size() {
+			chunk = r.r.r.Size()
+		}
+
+		// Peek returns fewer bytes only if the reader has no more data.
+		b, err := r.r.r.Peek(chunk)
+		r.crc = crc32.Update(r.crc, crc32.IEEETable, b)
+		discarded, _ := r.r.Discard(len(b))
+		if err != nil {
+			return io.ErrUnexpectedEOF
+		}
+
+		n -= discarded
+	}
+
+	return nil
+}
+
+// newRawEntry returns the RawEntry of the current record. If entries are
+// reused, the RawEntry of the previous unknown record is returned instead.
+func (r *SegmentReader) newRawEntry() *RawEntry {
+	e := r.rawEntry
+	if e == nil || !r.reuse {
+		e = new(RawEntry)
+	}
+
+	if r.reuse {
+		r.rawEntry = e
+	}
+
+	e.EntryType, e.EntryVersion = r.typ, r.version
+	e.Offset, e.Checksum = r.offset, r.checksum
+	return e
+}
+
+// readLength reads n bytes from r and appends them to dst. The buffer grows in
+// chunks, since the length might be garbage if the record is incomplete.
+func readLength(dst []byte, r io.Reader, n int) ([]byte, error) {
+	const chunkSize = 64 << 10
+	for n > 0 {
+		chunk := n
+		if chunk > chunkSize {
+			chunk = chunkSize
+		}
+
+		start := len(dst)
+		dst = grow(dst, chunk)
+		if _, err := io.ReadFull(r, dst[start:]); err != nil {
+			return dst, io.ErrUnexpectedEOF
+		}
+
+		n -= chunk
+	}
+
+	return dst, nil
+}
+
+// grow extends the length of b by n bytes. It only allocates if the capacity
+// of b is too small.
+func grow(b []byte, n int) []byte {
+	return append(b, make([]byte, n)...)
+}
+
 // Offset returns the offset of the last entry that was read by SegmentReader.ReadNext().
 func (r *SegmentReader) Offset() uint32 {
 	return r.offset
 }
 
+// Timestamp returns the time at which the last entry that was read by
+// SegmentReader.ReadNext() was written. The zero time is returned if the entry
+// has no timestamp (see Configuration.RecordTimestamps).
+func (r *SegmentReader) Timestamp() time.Time {
+	if r.timestamp == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, r.timestamp)
+}
+
+// Headers returns the headers of the last entry that was read by
+// SegmentReader.ReadNext() or nil if the entry has no headers. Note that the
+// headers are not verified against the checksum of the entry until it is
+// decoded.
+func (r *SegmentReader) Headers() []Header {
+	headers, _ := parseHeaders(r.headers)
+	return headers
+}
+
 // Decode decodes the last entry that was read using SegmentReader.ReadNext().
+// If the entry was written with an older version of its EntryType, the
+// Upcasters of the EntryRegistry are applied to the decoded Entry (see
+// EntryRegistry.RegisterUpcaster(…)).
+//
+// If entries are reused (see SegmentReader.SetReuseEntries(…)), the returned
+// Entry is only valid until the next call to ReadNext().
 func (r *SegmentReader) Decode() (Entry, error) {
 	if r.err != nil {
 		return nil, r.err
@@ -113,12 +592,52 @@ func (r *SegmentReader) Decode() (Entry, error) {
 		return nil, errors.New("must call SegmentReader.ReadNext() first")
 	}
 
-	if r.checksum != crc32.ChecksumIEEE(r.payload) {
+	if !r.validChecksum() {
 		return nil, fmt.Errorf("detected WAL Entry corruption at WAL offset %d", r.offset)
 	}
 
-	err := r.entry.DecodePayload(r.payload)
-	return r.entry, err
+	payload := r.payload
+	if r.encrypted {
+		if r.encryption == nil {
+			return nil, fmt.Errorf("WAL offset %d: %w %d: no KeyProvider configured", r.offset, ErrUnknownKey, r.keyID)
+		}
+
+		var err error
+		payload, err = r.encryption.open(r.plain[:0], r.offset, r.record())
+		if r.reuse {
+			r.plain = payload
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("WAL offset %d: %w", r.offset, err)
+		}
+	}
+
+	if r.codec != 0 {
+		codec, err := r.registry.codec(r.codec)
+		if err != nil {
+			return nil, err
+		}
+
+		payload, err = codec.Decompress(r.inflated[:0], payload)
+		if r.reuse {
+			r.inflated = payload
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("WAL offset %d: %w", r.offset, err)
+		}
+	}
+
+	if err := r.entry.DecodePayload(payload); err != nil {
+		return r.entry, err
+	}
+
+	if _, ok := r.entry.(*RawEntry); ok {
+		return r.entry, nil
+	}
+
+	return r.registry.Upcast(r.entry)
 }
 
 // Err returns any error that happened when calling ReadNext(). This function must
@@ -128,3 +647,54 @@ func (r *SegmentReader) Decode() (Entry, error) {
 func (r *SegmentReader) Err() error {
 	return r.err
 }
+
+// record returns the current record as it is stored in the segment.
+func (r *SegmentReader) record() record {
+	return record{
+		typ:       r.typ,
+		payload:   r.payload,
+		checksum:  r.checksum,
+		codec:     r.codec,
+		encrypted: r.encrypted,
+		keyID:     r.keyID,
+		chained:   r.chained,
+		hash:      r.hash,
+		version:   r.version,
+		timestamp: r.timestamp,
+		headers:   r.headers,
+	}
+}
+
+// validChecksum returns whether the payload and metadata of the current entry
+// match its checksum.
+func (r *SegmentReader) validChecksum() bool {
+	crc := r.crc
+	if !r.skipped {
+		crc = crc32.ChecksumIEEE(r.payload)
+	}
+
+	if r.version != 0 || r.timestamp != 0 || r.headers != nil {
+		crc = r.record().metadataChecksum(crc)
+	}
+
+	return r.checksum == crc
+}
+
+// positionReader wraps a buffered reader and keeps track of the number of
+// bytes that have been read from it.
+type positionReader struct {
+	r   *bufio.Reader
+	pos int64
+}
+
+func (r *positionReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *positionReader) Discard(n int) (int, error) {
+	n, err := r.r.Discard(n)
+	r.pos += int64(n)
+	return n, err
+}
@@ -2,11 +2,13 @@ package wal_test
 
 import (
 	"bytes"
+	"fmt"
 	"hash/crc32"
 	"testing"
 
 	"github.com/fgrosse/wal"
 	"github.com/fgrosse/wal/waltest"
+	"github.com/fgrosse/zaptest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -62,3 +64,215 @@ func TestSegmentReader(t *testing.T) {
 
 	assert.NoError(t, r.Err())
 }
+
+func TestSegmentReader_Preallocated(t *testing.T) {
+	buf := wal.NewTestWriter()
+	w := wal.NewSegmentWriter(buf)
+
+	e := &waltest.ExampleEntry1{ID: 42, Point: []float32{1, 2}}
+	payload := e.EncodePayload(nil)
+	err := w.Write(1, e.Type(), crc32.ChecksumIEEE(payload), payload)
+	require.NoError(t, err)
+	require.NoError(t, w.Sync())
+
+	// Simulate a segment file that was preallocated with zeros.
+	data := append(buf.Bytes(), make([]byte, 1024)...)
+	r, err := wal.NewSegmentReader(bytes.NewReader(data), waltest.ExampleEntries)
+	require.NoError(t, err)
+
+	require.True(t, r.ReadNext())
+	assert.EqualValues(t, 1, r.Offset())
+
+	entry, err := r.Decode()
+	require.NoError(t, err)
+	assert.Equal(t, e, entry)
+
+	assert.False(t, r.ReadNext(), "zero-filled space should be treated as the end of the segment")
+	assert.NoError(t, r.Err())
+}
+
+func TestSegmentReader_RecycledSegment(t *testing.T) {
+	buf := wal.NewTestWriter()
+	w := wal.NewSegmentWriter(buf)
+
+	write := func(offset uint32, e wal.Entry) {
+		payload := e.EncodePayload(nil)
+		err := w.Write(offset, e.Type(), crc32.ChecksumIEEE(payload), payload)
+		require.NoError(t, err)
+	}
+
+	e1 := &waltest.ExampleEntry1{ID: 1, Point: []float32{1, 2}}
+	e2 := &waltest.ExampleEntry1{ID: 2, Point: []float32{3, 4}}
+
+	require.NoError(t, w.WriteHeader(wal.SegmentHeader{SegmentID: 5, FirstOffset: 10}))
+	write(10, e1)
+	write(11, e2)
+
+	// Simulate stale records of an older segment that previously used this file.
+	write(3, e1)
+	write(4, e2)
+	require.NoError(t, w.Sync())
+
+	r, err := wal.NewSegmentReader(bytes.NewReader(buf.Bytes()), waltest.ExampleEntries)
+	require.NoError(t, err)
+
+	h, ok := r.Header()
+	require.True(t, ok)
+	assert.Equal(t, wal.SegmentHeader{Version: wal.SegmentVersion, SegmentID: 5, FirstOffset: 10}, h)
+
+	var offsets []uint32
+	for r.ReadNext() {
+		offsets = append(offsets, r.Offset())
+	}
+
+	require.NoError(t, r.Err())
+	assert.Equal(t, []uint32{10, 11}, offsets)
+}
+
+func TestSegmentReader_ReuseEntries(t *testing.T) {
+	conf := wal.DefaultConfiguration()
+	conf.RecordLengths = true
+
+	cases := map[string][]wal.Option{
+		"default":        nil,
+		"record lengths": {wal.WithConfiguration(conf)},
+		"compression":    {wal.WithCompression(new(wal.FlateCodec))},
+	}
+
+	for name, opts := range cases {
+		t.Run(name, func(t *testing.T) {
+			fs := waltest.NewMemFS()
+			w, err := wal.Open("/wal", waltest.ExampleEntries, zaptest.Logger(t), append(opts, wal.WithFS(fs))...)
+			require.NoError(t, err)
+
+			var entries []wal.Entry
+			for i := 0; i < 300; i++ {
+				var e wal.Entry = &waltest.ExampleEntry1{ID: uint32(i), Point: []float32{float32(i), 2}}
+				if i%2 == 1 {
+					e = &waltest.ExampleEntry2{Test: true, Name: fmt.Sprintf("entry-%03d", i)}
+				}
+
+				_, err := w.Write(e)
+				require.NoError(t, err)
+				entries = append(entries, e)
+			}
+			require.NoError(t, w.Close())
+
+			content, err := fs.ReadFile("/wal/1.wal")
+			require.NoError(t, err)
+
+			t.Log("Entries of the same type should be decoded into the same instance")
+			r, err := wal.NewSegmentReader(bytes.NewReader(content), waltest.ExampleEntries)
+			require.NoError(t, err)
+			r.SetReuseEntries(true)
+
+			instances := map[wal.EntryType]wal.Entry{}
+			for i, expected := range entries {
+				require.True(t, r.ReadNext())
+				actual, err := r.Decode()
+				require.NoError(t, err)
+				assert.Equal(t, expected, actual)
+
+				if previous, ok := instances[actual.Type()]; ok {
+					assert.Same(t, previous, actual, "entry %d was not reused", i)
+				}
+				instances[actual.Type()] = actual
+			}
+
+			assert.False(t, r.ReadNext())
+			require.NoError(t, r.Err())
+
+			t.Log("Reading records should not allocate once the buffers have grown")
+			r, err = wal.NewSegmentReader(bytes.NewReader(content), waltest.ExampleEntries)
+			require.NoError(t, err)
+			r.SetReuseEntries(true)
+
+			require.True(t, r.ReadNext())
+			require.True(t, r.ReadNext())
+			allocs := testing.AllocsPerRun(100, func() {
+				require.True(t, r.ReadNext())
+			})
+			assert.Zero(t, allocs)
+			require.NoError(t, r.Err())
+		})
+	}
+}
+
+func TestSegmentReader_Seek(t *testing.T) {
+	conf := wal.DefaultConfiguration()
+	conf.RecordLengths = true
+
+	fs := waltest.NewMemFS()
+	w, err := wal.Open("/wal", waltest.ExampleEntries, zaptest.Logger(t), wal.WithFS(fs), wal.WithConfiguration(conf))
+	require.NoError(t, err)
+
+	var entries []wal.Entry
+	for i := 1; i <= 300; i++ {
+		e := &waltest.ExampleEntry1{ID: uint32(i), Point: []float32{float32(i), 2}}
+		_, err := w.Write(e)
+		require.NoError(t, err)
+		entries = append(entries, e)
+	}
+	require.NoError(t, w.Close())
+
+	content, err := fs.ReadFile("/wal/1.wal")
+	require.NoError(t, err)
+
+	newReader := func() *wal.SegmentReader {
+		r, err := wal.NewSegmentReader(bytes.NewReader(content), waltest.ExampleEntries)
+		require.NoError(t, err)
+		return r
+	}
+
+	t.Log("SeekEnd should not allocate if the records store their length")
+	readers := make([]*wal.SegmentReader, 101)
+	lastOffsets := make([]uint32, 0, len(readers))
+	for i := range readers {
+		readers[i] = newReader()
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		lastOffset, _ := readers[len(lastOffsets)].SeekEnd()
+		lastOffsets = lastOffsets[:len(lastOffsets)+1]
+		lastOffsets[len(lastOffsets)-1] = lastOffset
+	})
+	assert.Zero(t, allocs)
+	for i, r := range readers {
+		require.NoError(t, r.Err())
+		require.EqualValues(t, 300, lastOffsets[i])
+	}
+
+	t.Log("SeekOffset should position the reader at the given offset")
+	r := newReader()
+	require.True(t, r.SeekOffset(150))
+	assert.EqualValues(t, 150, r.Offset())
+	actual, err := r.Decode()
+	require.NoError(t, err)
+	assert.Equal(t, entries[149], actual)
+
+	require.True(t, r.ReadNext())
+	actual, err = r.Decode()
+	require.NoError(t, err)
+	assert.Equal(t, entries[150], actual)
+
+	assert.False(t, newReader().SeekOffset(301))
+
+	t.Log("Corrupted payloads should only be detected if checksums are verified")
+	content[len(content)-1] ^= 0xFF // flip bits in the payload of the last entry
+
+	lastOffset, err := newReader().SeekEnd()
+	require.NoError(t, err)
+	assert.EqualValues(t, 300, lastOffset)
+
+	r = newReader()
+	r.SetVerifyOnSeek(true)
+	lastOffset, err = r.SeekEnd()
+	assert.EqualError(t, err, "detected WAL Entry corruption at WAL offset 300")
+	assert.EqualValues(t, 299, lastOffset)
+
+	r = newReader()
+	r.SetVerifyOnSeek(true)
+	assert.True(t, r.SeekOffset(300))
+	_, err = r.Decode()
+	assert.EqualError(t, err, "detected WAL Entry corruption at WAL offset 300")
+}
@@ -2,8 +2,12 @@ package wal
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
-	"os"
+	"math"
 )
 
 // The SegmentWriter is responsible for writing WAL entry records to disk.
@@ -19,13 +23,58 @@ import (
 //		- Type = Type of WAL entry
 //		- CRC = 32bit hash computed over the payload using CRC
 //		- Payload = The actual WAL entry payload data
+//
+// Segments with a SegmentHeader of version 2 or later may additionally contain
+// extended records, which are marked by the type 0xFF:
+//
+//	  ┌─────────────┬───────────┬──────────┬────────────┬─────────────┬─────────────┬──────────────┬──────────────┬──────────────┬────────────────┬──────────────────┬───────────┬─────────┐
+//	  │ Offset (4B) │ 0xFF (1B) │ CRC (4B) │ Flags (1B) │ Type (1-2B) │ Length (4B) │ [Codec (1B)] │ [KeyID (4B)] │ [Hash (32B)] │ [Version (1B)] │ [Timestamp (8B)] │ [Headers] │ Payload │
+//	  └─────────────┴───────────┴──────────┴────────────┴─────────────┴─────────────┴──────────────┴──────────────┴──────────────┴────────────────┴──────────────────┴───────────┴─────────┘
+//
+//		- Flags = Bit field which defines which optional fields follow the Length
+//		- Type = Type of WAL entry, stored with 2 bytes if the wide type flag is set
+//		- Length = Length of the payload in bytes
+//		- Codec = ID of the Codec which compressed the payload, if the compressed flag is set
+//		- KeyID = ID of the key which encrypted the payload, if the encrypted flag is set
+//		- Hash = SHA-256 or HMAC-SHA256 which links the record to the previous record, if the chained flag is set
+//		- Version = Schema version of the WAL entry (see VersionedEntry), if the version flag is set
+//		- Timestamp = Nanoseconds since the unix epoch at which the record was written, if the timestamp flag is set
+//		- Headers = Length (2B) of the encoded key/value headers followed by the headers, if the headers flag is set
+//		- CRC = 32bit hash computed over the payload as it is stored (i.e. after compression and encryption), followed by the version, timestamp and headers
+//
+// The payload of encrypted records starts with the random nonce, followed by
+// the AES-GCM ciphertext and its authentication tag.
 type SegmentWriter struct {
-	w      *bufio.Writer
-	size   int // current size of the WAL segment that this writer owns. Used to roll over segment files
-	closer io.Closer
-	sync   func() error // sync function when writing to a file, otherwise a no-op
+	w        *bufio.Writer
+	size     int // current size of the WAL segment that this writer owns. Used to roll over segment files
+	closer   io.Closer
+	sync     func() error // sync function when writing to a File, otherwise a no-op
+	extended bool         // whether the segment header allows extended records
+	chained  bool         // whether the segment header marks the segment as hash chained
 }
 
+// extendedRecordType is written instead of the EntryType to mark extended
+// records. Entries that actually use this EntryType are written as extended
+// records as well.
+const extendedRecordType EntryType = 0xFF
+
+// Flags of extended records.
+const (
+	recordFlagCompressed uint8 = 1 << iota // the payload is compressed and the Codec ID is stored
+	recordFlagEncrypted                    // the payload is encrypted and the KeyID is stored
+	recordFlagChained                      // the hash of the record within the hash chain is stored
+	recordFlagTimestamp                    // the time at which the record was written is stored
+	recordFlagHeaders                      // key/value headers are stored
+	recordFlagVersion                      // the schema version of the entry is stored
+	recordFlagWideType                     // the EntryType is stored with 2 bytes
+
+	knownRecordFlags = recordFlagCompressed | recordFlagEncrypted | recordFlagChained | recordFlagTimestamp | recordFlagHeaders | recordFlagVersion | recordFlagWideType
+)
+
+// maxNarrowEntryType is the largest EntryType that can be stored with a
+// single byte. Larger types are only supported by extended records.
+const maxNarrowEntryType EntryType = math.MaxUint8
+
 // NewSegmentWriter returns a new SegmentWriter writing to w, using the default
 // write buffer size.
 func NewSegmentWriter(w io.WriteCloser) *SegmentWriter {
@@ -45,19 +94,42 @@ func NewSegmentWriterSize(w io.WriteCloser, bufferSize int) *SegmentWriter {
 		closer: w,
 	}
 
-	if f, ok := w.(*os.File); ok {
+	if f, ok := w.(interface{ Sync() error }); ok {
 		sw.sync = f.Sync
 	}
 
 	return sw
 }
 
+// WriteHeader writes the SegmentHeader. If used, this function must be called
+// before writing any entries. The Version field of the header is ignored and
+// the current SegmentVersion is written instead.
+func (w *SegmentWriter) WriteHeader(h SegmentHeader) error {
+	h.Version = SegmentVersion
+
+	var buf [chainedHeaderSize]byte
+	n, err := w.w.Write(appendSegmentHeader(buf[:0], h))
+	w.size += n
+	w.extended = true
+	w.chained = h.Chained
+
+	return err
+}
+
 // Write a new WAL entry.
 //
 // Note, that we do not use the Entry interface here because encoding the
 // payload is done at an earlier stage than actually writing data to the WAL
 // segment.
 func (w *SegmentWriter) Write(offset uint32, typ EntryType, checksum uint32, payload []byte) error {
+	if typ >= extendedRecordType && w.extended {
+		return w.writeExtended(offset, record{typ: typ, payload: payload, checksum: checksum})
+	}
+
+	if typ > maxNarrowEntryType {
+		return fmt.Errorf("EntryType %d requires a segment header", typ)
+	}
+
 	var err error
 	writeByte := func(b byte) {
 		if err != nil {
@@ -92,9 +164,136 @@ func (w *SegmentWriter) Write(offset uint32, typ EntryType, checksum uint32, pay
 	return nil
 }
 
+// record is an encoded entry that is ready to be written to a segment.
+type record struct {
+	typ       EntryType
+	payload   []byte
+	checksum  uint32
+	codec     CodecID // the codec that compressed the payload or zero
+	encrypted bool    // whether the payload was encrypted with the key of keyID
+	keyID     KeyID
+	chained   bool              // whether the record is part of a hash chain
+	hash      [sha256.Size]byte // the hash of the record within the hash chain
+	version   EntryVersion      // the schema version of the entry
+	timestamp int64             // nanoseconds since the unix epoch or zero
+	headers   []byte            // the encoded headers (see appendHeaders(…))
+	sized     bool              // whether the length of the payload must be stored in any case
+}
+
+// extended returns whether the record must be written as an extended record.
+func (r record) extended() bool {
+	return r.sized || r.codec != 0 || r.encrypted || r.chained || r.hasMetadata() || r.wideType()
+}
+
+// wideType returns whether the EntryType of the record must be stored with 2
+// bytes.
+func (r record) wideType() bool {
+	return r.typ > maxNarrowEntryType
+}
+
+// appendType appends the EntryType of an extended record to b.
+func (r record) appendType(b []byte) []byte {
+	if r.wideType() {
+		return binary.BigEndian.AppendUint16(b, uint16(r.typ))
+	}
+
+	return append(b, byte(r.typ))
+}
+
+// flags returns the flags of the record if it is written as an extended record.
+func (r record) flags() uint8 {
+	var flags uint8
+	if r.codec != 0 {
+		flags |= recordFlagCompressed
+	}
+
+	if r.encrypted {
+		flags |= recordFlagEncrypted
+	}
+
+	if r.chained {
+		flags |= recordFlagChained
+	}
+
+	if r.version != 0 {
+		flags |= recordFlagVersion
+	}
+
+	if r.timestamp != 0 {
+		flags |= recordFlagTimestamp
+	}
+
+	if len(r.headers) > 0 {
+		flags |= recordFlagHeaders
+	}
+
+	if r.wideType() {
+		flags |= recordFlagWideType
+	}
+
+	return flags
+}
+
+// writeRecord writes the record using the extended record format if necessary.
+func (w *SegmentWriter) writeRecord(offset uint32, rec record) error {
+	if !rec.extended() {
+		return w.Write(offset, rec.typ, rec.checksum, rec.payload)
+	}
+
+	return w.writeExtended(offset, rec)
+}
+
+// writeExtended writes an extended record. If the codec of the record is not
+// zero, the payload is marked as compressed by the corresponding Codec.
+// Encrypted records additionally store the ID of their key, chained records
+// store their hash and the metadata of the record follows at the end.
+func (w *SegmentWriter) writeExtended(offset uint32, rec record) error {
+	if !w.extended {
+		return errors.New("extended records require a segment header")
+	}
+
+	var buf [4 + 1 + 4 + 1 + 2 + 4 + 1 + 4 + sha256.Size + 1 + 8 + 2]byte
+	b := binary.BigEndian.AppendUint32(buf[:0], offset)
+	b = append(b, byte(extendedRecordType))
+	b = binary.BigEndian.AppendUint32(b, rec.checksum)
+	b = append(b, rec.flags())
+	b = rec.appendType(b)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(rec.payload)))
+	if rec.codec != 0 {
+		b = append(b, byte(rec.codec))
+	}
+
+	if rec.encrypted {
+		b = binary.BigEndian.AppendUint32(b, uint32(rec.keyID))
+	}
+
+	if rec.chained {
+		b = append(b, rec.hash[:]...)
+	}
+
+	b = rec.appendMetadataPrefix(b)
+
+	n, err := w.w.Write(b)
+	w.size += n
+	if err != nil {
+		return err
+	}
+
+	n, err = w.w.Write(rec.headers)
+	w.size += n
+	if err != nil {
+		return err
+	}
+
+	n, err = w.w.Write(rec.payload)
+	w.size += n
+
+	return err
+}
+
 // Sync writes any buffered data to the underlying io.Writer and syncs the file
 // systems in-memory copy of recently written data to disk if we are writing to
-// an os.File.
+// a File (i.e. if the writer has a Sync() error method).
 func (w *SegmentWriter) Sync() error {
 	if err := w.w.Flush(); err != nil {
 		return err
@@ -103,6 +302,33 @@ func (w *SegmentWriter) Sync() error {
 	return w.sync()
 }
 
+// truncate discards all buffered data and truncates the underlying file to the
+// given size, so the next entry is written at this position. This is used to
+// roll back records that could not be synced.
+func (w *SegmentWriter) truncate(size int) error {
+	f, ok := w.closer.(interface {
+		io.Writer
+		io.Seeker
+		Truncate(size int64) error
+	})
+	if !ok {
+		return errors.New("segment writer does not support truncation")
+	}
+
+	if err := f.Truncate(int64(size)); err != nil {
+		return err
+	}
+
+	if _, err := f.Seek(int64(size), io.SeekStart); err != nil {
+		return err
+	}
+
+	w.w.Reset(f)
+	w.size = size
+
+	return w.sync()
+}
+
 // Close ensures that all buffered data is flushed to disk before and then closes
 // the associated writer or file.
 func (w *SegmentWriter) Close() error {
@@ -40,6 +40,40 @@ func TestSegmentWriter_Write(t *testing.T) {
 	assert.Equal(t, expected, actual)
 }
 
+func TestSegmentWriter_WriteExtended(t *testing.T) {
+	w := NewTestWriter()
+	sw := NewSegmentWriter(w)
+
+	payload := []byte{1, 2, 3}
+	err := sw.writeRecord(1, record{typ: 3, payload: payload, checksum: 0x01020304, codec: CodecFlate})
+	assert.EqualError(t, err, "extended records require a segment header")
+
+	require.NoError(t, sw.WriteHeader(SegmentHeader{SegmentID: 1, FirstOffset: 1}))
+	require.NoError(t, sw.writeRecord(1, record{typ: 3, payload: payload, checksum: 0x01020304, codec: CodecFlate}))
+	require.NoError(t, sw.Write(2, extendedRecordType, 0x01020304, payload))
+	require.NoError(t, sw.Sync())
+
+	var expected []byte
+	expected = binary.BigEndian.AppendUint32(expected, 1) // Offset (4B)
+	expected = append(expected, 0xFF)                     // Extended record (1B)
+	expected = append(expected, 0x01, 0x02, 0x03, 0x04)   // CRC (4B)
+	expected = append(expected, recordFlagCompressed)     // Flags (1B)
+	expected = append(expected, 3)                        // Type (1B)
+	expected = binary.BigEndian.AppendUint32(expected, 3) // Length (4B)
+	expected = append(expected, byte(CodecFlate))         // Codec (1B)
+	expected = append(expected, payload...)               // Payload
+	expected = binary.BigEndian.AppendUint32(expected, 2) // Offset (4B)
+	expected = append(expected, 0xFF)                     // Extended record (1B)
+	expected = append(expected, 0x01, 0x02, 0x03, 0x04)   // CRC (4B)
+	expected = append(expected, 0)                        // Flags (1B)
+	expected = append(expected, 0xFF)                     // Type (1B)
+	expected = binary.BigEndian.AppendUint32(expected, 3) // Length (4B)
+	expected = append(expected, payload...)               // Payload
+
+	assert.Equal(t, expected, w.Bytes()[segmentHeaderSize:])
+	assert.Equal(t, len(w.Bytes()), sw.size)
+}
+
 func TestSegmentWriter_Write_Size(t *testing.T) {
 	w := NewTestWriter()
 	sw := NewSegmentWriter(w)
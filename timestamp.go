@@ -0,0 +1,360 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// timeIndexFile is the name of the file in the WAL directory which stores the
+// timestamps of the first and last record of each sealed segment, so
+// WAL.OffsetForTime(…) does not need to read all segments. The file is only a
+// cache, which is rebuilt from the segments if it is missing or corrupted.
+const timeIndexFile = "timestamps.idx"
+
+// timeIndexEntrySize is the encoded size of a single segment in the time
+// index: 4B segment ID + 8B first timestamp + 8B last timestamp.
+const timeIndexEntrySize = 4 + 8 + 8
+
+// segmentTimes are the timestamps of the first and last timestamped record of
+// a segment. Both are zero if the segment has no timestamped records.
+type segmentTimes struct {
+	first int64
+	last  int64
+}
+
+// add extends the segmentTimes by the timestamp of a new record.
+func (t *segmentTimes) add(ts int64) {
+	if t.first == 0 {
+		t.first = ts
+	}
+
+	t.last = ts
+}
+
+// OffsetForTime returns the first offset that was written at or after the
+// given time, e.g. to start replaying the WAL at a wall-clock time. If no such
+// entry exists, the offset of the next entry that will be written is returned.
+//
+// Only entries that have been written with Configuration.RecordTimestamps
+// enabled have a timestamp. All other entries are treated as if they had been
+// written before any timestamped entry.
+//
+// Since timestamps never decrease, the WAL performs a binary search using the
+// timestamps of the first and last record of each segment and then only scans
+// a single segment to find the exact offset. The timestamps of sealed segments
+// are stored in an index file next to the segments, so they are only read
+// once.
+func (w *WAL) OffsetForTime(t time.Time) (uint32, error) {
+	w.mu.Lock()
+	if !w.isClosed() {
+		w.sync() // make sure all written entries are visible to the segment reader
+	}
+	lastOffset := w.lastOffset
+	w.loadTimeIndex()
+	w.mu.Unlock()
+
+	segments, times, err := w.segmentTimesForSearch()
+	if err != nil {
+		return 0, err
+	}
+
+	// Segments without any timestamped records are treated as if they had
+	// been written before all timestamped records, so we can skip them.
+	var timed []int
+	for i := range segments {
+		if times[i].last != 0 {
+			timed = append(timed, i)
+		}
+	}
+
+	// Find the first segment whose last record was written at or after the
+	// given time. The first entry at or after t must be in this segment.
+	ts := t.UnixNano()
+	k := sort.Search(len(timed), func(k int) bool {
+		return times[timed[k]].last >= ts
+	})
+
+	for ; k < len(timed); k++ {
+		offset, found, err := w.findTimestamp(segments[timed[k]], ts, lastOffset)
+		if err != nil || found {
+			return offset, err
+		}
+	}
+
+	return lastOffset + 1, nil
+}
+
+// segmentTimesForSearch returns all segments of the WAL together with their
+// timestamps. Segments which are not part of the time index yet are read
+// without holding the lock and are then added to the index.
+func (w *WAL) segmentTimesForSearch() ([]string, []segmentTimes, error) {
+	segments, err := segmentFileNames(w.fs, w.path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("checking existing segment files: %w", err)
+	}
+
+	ids := make([]int, len(segments))
+	times := make([]segmentTimes, len(segments))
+	known := make([]bool, len(segments))
+
+	w.mu.Lock()
+	for i, path := range segments {
+		ids[i], err = parseSegmentID(path)
+		if err != nil {
+			w.mu.Unlock()
+			return nil, nil, err
+		}
+
+		if ids[i] == w.segmentID {
+			times[i], known[i] = w.currentTimes, true
+		} else {
+			times[i], known[i] = w.timeIndex[ids[i]]
+		}
+	}
+	w.mu.Unlock()
+
+	var missing bool
+	for i, path := range segments {
+		if known[i] {
+			continue
+		}
+
+		info, err := w.inspectSegment(path, ids[i])
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading segment %q: %w", path, err)
+		}
+
+		times[i] = segmentTimes{first: info.firstTimestamp, last: info.lastTimestamp}
+		missing = true
+	}
+
+	if missing {
+		w.mu.Lock()
+		for i := range segments {
+			if !known[i] && ids[i] != w.segmentID {
+				w.timeIndex[ids[i]] = times[i]
+			}
+		}
+		w.saveTimeIndex()
+		w.mu.Unlock()
+	}
+
+	return segments, times, nil
+}
+
+// sealedSegmentTimes returns the timestamps of the sealed segment at the given
+// path from the time index or reads them from the segment. Since segments which
+// are not part of the time index yet are read without holding the lock, the
+// caller must not hold the lock when calling this function.
+func (w *WAL) sealedSegmentTimes(path string) (segmentTimes, error) {
+	id, err := parseSegmentID(path)
+	if err != nil {
+		return segmentTimes{}, err
+	}
+
+	w.mu.Lock()
+	w.loadTimeIndex()
+	times, ok := w.timeIndex[id]
+	w.mu.Unlock()
+
+	if ok {
+		return times, nil
+	}
+
+	info, err := w.inspectSegment(path, id)
+	if err != nil {
+		return segmentTimes{}, fmt.Errorf("reading WAL segment %q: %w", path, err)
+	}
+
+	times = segmentTimes{first: info.firstTimestamp, last: info.lastTimestamp}
+
+	w.mu.Lock()
+	w.timeIndex[id] = times
+	w.saveTimeIndex()
+	w.mu.Unlock()
+
+	return times, nil
+}
+
+// indexSegmentTimes adds the timestamps of the current segment to the time
+// index after the segment with the given ID was sealed.
+// The caller must ensure the WAL is write-locked before calling this function.
+func (w *WAL) indexSegmentTimes(segmentID int) {
+	w.loadTimeIndex()
+	w.timeIndex[segmentID] = w.currentTimes
+	w.currentTimes = segmentTimes{}
+	w.saveTimeIndex()
+}
+
+// loadTimeIndex reads the time index file unless it was loaded already. If
+// the file does not exist or is corrupted, the index starts empty and is
+// rebuilt from the segments on demand.
+// The caller must ensure the WAL is write-locked before calling this function.
+func (w *WAL) loadTimeIndex() {
+	if w.timeIndex != nil {
+		return
+	}
+
+	w.timeIndex = map[int]segmentTimes{}
+
+	data, err := w.readTimeIndex()
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+
+	if err == nil && (len(data) < 4 || (len(data)-4)%timeIndexEntrySize != 0) {
+		err = errors.New("unexpected size")
+	}
+
+	if err == nil && crc32.ChecksumIEEE(data[:len(data)-4]) != binary.BigEndian.Uint32(data[len(data)-4:]) {
+		err = errors.New("checksum mismatch")
+	}
+
+	if err != nil {
+		w.logger.Warn("Ignoring WAL time index", zap.Error(err))
+		return
+	}
+
+	for b := data[:len(data)-4]; len(b) > 0; b = b[timeIndexEntrySize:] {
+		id := int(binary.BigEndian.Uint32(b))
+
+		// The current segment is not sealed yet, so its entry must be stale.
+		if id >= w.segmentID {
+			continue
+		}
+
+		w.timeIndex[id] = segmentTimes{
+			first: int64(binary.BigEndian.Uint64(b[4:])),
+			last:  int64(binary.BigEndian.Uint64(b[12:])),
+		}
+	}
+}
+
+func (w *WAL) readTimeIndex() ([]byte, error) {
+	f, err := w.fs.OpenFile(filepath.Join(w.path, timeIndexFile), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return io.ReadAll(f)
+}
+
+// saveTimeIndex writes the timestamps of all existing sealed segments into the
+// time index file, if the WAL records timestamps and is still open. Since the
+// index is only a cache, errors are logged but otherwise ignored.
+// The caller must ensure the WAL is write-locked before calling this function.
+func (w *WAL) saveTimeIndex() {
+	if w.readOnly || w.isClosed() || !w.conf.RecordTimestamps {
+		return
+	}
+
+	if err := w.writeTimeIndex(); err != nil {
+		w.logger.Warn("Failed to write WAL time index", zap.Error(err))
+	}
+}
+
+func (w *WAL) writeTimeIndex() error {
+	segments, err := segmentFileNames(w.fs, w.path)
+	if err != nil {
+		return fmt.Errorf("checking existing segment files: %w", err)
+	}
+
+	// Drop the entries of segments which have been removed in the meantime.
+	existing := make(map[int]bool, len(segments))
+	var data []byte
+	for _, path := range segments {
+		id, err := parseSegmentID(path)
+		if err != nil {
+			return err
+		}
+
+		existing[id] = true
+		times, ok := w.timeIndex[id]
+		if !ok {
+			continue
+		}
+
+		data = binary.BigEndian.AppendUint32(data, uint32(id))
+		data = binary.BigEndian.AppendUint64(data, uint64(times.first))
+		data = binary.BigEndian.AppendUint64(data, uint64(times.last))
+	}
+
+	for id := range w.timeIndex {
+		if !existing[id] {
+			delete(w.timeIndex, id)
+		}
+	}
+
+	data = binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(data))
+
+	// Write to a temporary file first, so a crash never leaves an incomplete
+	// index behind.
+	path := filepath.Join(w.path, timeIndexFile)
+	tmp := path + ".tmp"
+	f, err := w.fs.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = w.fs.Rename(tmp, path)
+	}
+
+	if err != nil {
+		_ = w.fs.Remove(tmp)
+	}
+
+	return err
+}
+
+// findTimestamp returns the offset of the first record in the segment which was
+// written at or after the given minimum timestamp and whether such a record
+// exists. Records after lastOffset are ignored.
+func (w *WAL) findTimestamp(path string, minTimestamp int64, lastOffset uint32) (uint32, bool, error) {
+	f, err := w.openSegmentFile(path)
+	if err != nil {
+		return 0, false, err
+	}
+
+	defer f.Close()
+
+	r, err := NewSegmentReader(f, w.registry)
+	if err != nil {
+		return 0, false, err
+	}
+
+	r.raw = true // timestamps can be read without decoding the entries
+	r.SetReuseEntries(true)
+
+	for r.next(skipAll) && r.Offset() <= lastOffset {
+		if r.Err() != nil {
+			break
+		}
+
+		if r.timestamp != 0 && r.timestamp >= minTimestamp {
+			return r.Offset(), true, nil
+		}
+	}
+
+	if err := r.Err(); err != nil {
+		return 0, false, fmt.Errorf("reading segment %q: %w", path, err)
+	}
+
+	return 0, false, nil
+}
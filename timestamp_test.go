@@ -0,0 +1,137 @@
+package wal_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fgrosse/wal"
+	"github.com/fgrosse/wal/waltest"
+	"github.com/fgrosse/zaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL_OffsetForTime(t *testing.T) {
+	fs := waltest.NewMemFS()
+	logger := zaptest.Logger(t)
+	conf := wal.DefaultConfiguration()
+	conf.MaxSegmentSize = 150
+
+	t.Log("Writing entries without timestamps")
+	w, err := wal.New("/wal", conf, waltest.ExampleEntries, logger, wal.WithFS(fs))
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := w.Write(&waltest.ExampleEntry2{Name: "legacy"})
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+
+	t.Log("Writing entries with timestamps")
+	conf.RecordTimestamps = true
+	w, err = wal.New("/wal", conf, waltest.ExampleEntries, logger, wal.WithFS(fs))
+	require.NoError(t, err)
+
+	times := map[uint32]time.Time{}
+	for i := 0; i < 20; i++ {
+		times[uint32(i+4)] = time.Now()
+		offset, err := w.Write(&waltest.ExampleEntry2{Name: "timestamped"})
+		require.NoError(t, err)
+		require.EqualValues(t, i+4, offset)
+		time.Sleep(time.Millisecond)
+	}
+
+	names, err := fs.List("/wal")
+	require.NoError(t, err)
+	require.Greater(t, len(names), 3, "entries should be spread over multiple segments")
+
+	offset, err := w.OffsetForTime(time.Time{})
+	require.NoError(t, err)
+	assert.EqualValues(t, 4, offset, "should return the first timestamped entry")
+
+	for expected := uint32(4); expected <= 23; expected++ {
+		offset, err := w.OffsetForTime(times[expected])
+		require.NoError(t, err)
+		assert.Equal(t, expected, offset)
+	}
+
+	offset, err = w.OffsetForTime(time.Now())
+	require.NoError(t, err)
+	assert.EqualValues(t, 24, offset, "should return the next offset if no entry was written after the time")
+
+	require.NoError(t, w.Close())
+}
+
+func TestWAL_OffsetForTime_MixedSegments(t *testing.T) {
+	fs := waltest.NewMemFS()
+	logger := zaptest.Logger(t)
+	conf := wal.DefaultConfiguration()
+	conf.MaxSegmentSize = 40
+
+	times := map[uint32]time.Time{}
+	var between time.Time
+	write := func(timestamps bool) {
+		conf.RecordTimestamps = timestamps
+		w, err := wal.New("/wal", conf, waltest.ExampleEntries, logger, wal.WithFS(fs))
+		require.NoError(t, err)
+
+		for i := 0; i < 5; i++ {
+			now := time.Now()
+			offset, err := w.Write(&waltest.ExampleEntry2{Name: "entry"})
+			require.NoError(t, err)
+			if timestamps {
+				times[offset] = now
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		between = time.Now()
+		time.Sleep(time.Millisecond)
+		require.NoError(t, w.Close())
+	}
+
+	t.Log("Writing segments without timestamps between timestamped segments")
+	write(true)
+	write(false)
+	afterUntimed := between
+	write(true)
+
+	names, err := fs.List("/wal")
+	require.NoError(t, err)
+	require.Greater(t, len(names), 6, "entries should be spread over multiple segments")
+
+	check := func(w *wal.WAL) {
+		offset, err := w.OffsetForTime(time.Time{})
+		require.NoError(t, err)
+		assert.EqualValues(t, 1, offset, "should return the first timestamped entry")
+
+		for expected, ts := range times {
+			offset, err := w.OffsetForTime(ts)
+			require.NoError(t, err)
+			assert.Equal(t, expected, offset)
+		}
+
+		offset, err = w.OffsetForTime(afterUntimed)
+		require.NoError(t, err)
+		assert.EqualValues(t, 11, offset, "entries without timestamps should be skipped")
+
+		offset, err = w.OffsetForTime(time.Now())
+		require.NoError(t, err)
+		assert.EqualValues(t, 16, offset)
+	}
+
+	w, err := wal.New("/wal", conf, waltest.ExampleEntries, logger, wal.WithFS(fs))
+	require.NoError(t, err)
+	check(w)
+	require.NoError(t, w.Close())
+
+	names, err = fs.List("/wal")
+	require.NoError(t, err)
+	assert.Contains(t, names, "timestamps.idx", "the timestamps of sealed segments should be indexed")
+
+	t.Log("A corrupted index should be rebuilt from the segments")
+	require.NoError(t, fs.WriteFile("/wal/timestamps.idx", []byte("corrupted")))
+	w, err = wal.New("/wal", conf, waltest.ExampleEntries, logger, wal.WithFS(fs))
+	require.NoError(t, err)
+	check(w)
+	require.NoError(t, w.Close())
+}
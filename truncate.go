@@ -0,0 +1,167 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+)
+
+// TruncateFront removes all segments from the WAL that only contain entries
+// with an offset lower than the given offset. Since the WAL can only delete
+// entire segment files, the remaining segments might still contain some
+// entries before the given offset. The segment that is currently written to
+// is never removed.
+//
+// If Configuration.RecycleSegments is set, the segment files are returned to
+// the recycling pool instead of deleting them. If an Archiver was configured,
+// TruncateFront waits until the segments were archived and discarded, but the
+// WAL keeps on accepting writes in the meantime.
+func (w *WAL) TruncateFront(offset uint32) error {
+	segments, pending, err := w.truncateFront(offset)
+	if err != nil {
+		return err
+	}
+
+	for i, done := range pending {
+		if done == nil {
+			continue
+		}
+
+		if err := <-done; err != nil {
+			return fmt.Errorf("truncating WAL segment %q: %w", segments[i], err)
+		}
+	}
+
+	return nil
+}
+
+// truncateFront discards all segments before the given offset. It returns the
+// paths of the segments and, for each segment that is archived in the
+// background, a channel that receives the result.
+func (w *WAL) truncateFront(offset uint32) ([]string, []<-chan error, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.isClosed() {
+		return nil, nil, errors.New("WAL is already closed")
+	}
+
+	if w.readOnly {
+		return nil, nil, ErrReadOnly
+	}
+
+	segments, err := w.truncatableSegments(offset)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pending := make([]<-chan error, len(segments))
+	for i, path := range segments {
+		pending[i], err = w.discardSegment(path, true)
+		if err != nil {
+			return nil, nil, fmt.Errorf("truncating WAL segment %q: %w", path, err)
+		}
+	}
+
+	return segments, pending, nil
+}
+
+// SetCheckpoint informs the WAL that the application has persisted the effects
+// of all entries up to and including the given offset elsewhere, so the WAL no
+// longer needs to keep them. Segments which only contain entries up to the
+// checkpoint may be deleted automatically by the retention rules of the
+// Configuration or when using the FullPolicyDeleteOldest. The checkpoint is
+// not persisted, so it must be set again after the WAL was opened.
+func (w *WAL) SetCheckpoint(offset uint32) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.checkpoint = offset
+}
+
+// Checkpoint returns the offset that was last passed to SetCheckpoint(…) or zero
+// if no checkpoint was set yet.
+func (w *WAL) Checkpoint() uint32 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.checkpoint
+}
+
+// truncatableSegments returns the paths of all sealed segments whose entries
+// all have an offset lower than the given offset.
+// The caller must ensure the WAL is write-locked before calling this function.
+func (w *WAL) truncatableSegments(offset uint32) ([]string, error) {
+	segments, err := segmentFileNames(w.fs, w.path)
+	if err != nil {
+		return nil, fmt.Errorf("checking existing segment files: %w", err)
+	}
+
+	return w.segmentsBefore(segments, w.segmentPath(w.segmentID), w.firstOffset, offset)
+}
+
+// segmentsBefore returns the paths of all given segments whose entries all have
+// an offset lower than the given offset. Since the header of the current
+// segment might not have been flushed yet, its first offset must be passed by
+// the caller. This function does not access the state of the WAL, so it can be
+// called without holding the lock.
+func (w *WAL) segmentsBefore(segments []string, current string, currentFirstOffset, offset uint32) ([]string, error) {
+	var result []string
+	for i := 0; i+1 < len(segments); i++ {
+		// A segment only contains entries before the given offset, if the
+		// next segment starts at or before that offset.
+		var nextFirstOffset uint32
+		next := segments[i+1]
+		if next == current {
+			nextFirstOffset = currentFirstOffset
+		} else {
+			var (
+				ok  bool
+				err error
+			)
+			nextFirstOffset, ok, err = w.segmentFirstOffset(next)
+			if err != nil {
+				return nil, fmt.Errorf("reading WAL segment %q: %w", next, err)
+			}
+
+			if !ok {
+				break // empty segment without header, so we cannot tell
+			}
+		}
+
+		if nextFirstOffset > offset {
+			break
+		}
+
+		result = append(result, segments[i])
+	}
+
+	return result, nil
+}
+
+// segmentFirstOffset returns the offset of the first entry in the segment at
+// the given path without reading the entire segment. The boolean return value
+// is false if the segment neither has a header nor any entries.
+func (w *WAL) segmentFirstOffset(path string) (uint32, bool, error) {
+	f, err := w.openSegmentFile(path)
+	if err != nil {
+		return 0, false, err
+	}
+
+	defer f.Close()
+
+	r, err := NewSegmentReader(f, w.registry)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if h, ok := r.Header(); ok {
+		return h.FirstOffset, true, nil
+	}
+
+	// Legacy segments without header must be read until the first entry.
+	if !r.ReadNext() {
+		return 0, false, r.Err()
+	}
+
+	return r.Offset(), true, nil
+}
@@ -0,0 +1,123 @@
+package wal_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fgrosse/wal"
+	"github.com/fgrosse/wal/waltest"
+	"github.com/fgrosse/zaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL_TruncateFront(t *testing.T) {
+	path := t.TempDir()
+	conf := wal.DefaultConfiguration()
+	conf.MaxSegmentSize = 60 // two entries per segment
+
+	w, err := wal.New(path, conf, waltest.ExampleEntries, zaptest.Logger(t))
+	require.NoError(t, err)
+
+	for i := 1; i <= 7; i++ {
+		_, err := w.Write(&waltest.ExampleEntry1{ID: uint32(i), Point: []float32{1, 2}})
+		require.NoError(t, err)
+	}
+
+	segments, err := wal.SegmentFileNames(path)
+	require.NoError(t, err)
+	require.Len(t, segments, 4) // [1,2] [3,4] [5,6] [7]
+
+	t.Log("Segments that still contain entries at or after the offset must be kept")
+	require.NoError(t, w.TruncateFront(4))
+	segments, err = wal.SegmentFileNames(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(path, "2.wal"),
+		filepath.Join(path, "3.wal"),
+		filepath.Join(path, "4.wal"),
+	}, segments)
+
+	t.Log("The current segment must never be removed")
+	require.NoError(t, w.TruncateFront(100))
+	segments, err = wal.SegmentFileNames(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(path, "4.wal")}, segments)
+
+	var offsets []uint32
+	err = w.Replay(0, func(offset uint32, _ wal.Entry) error {
+		offsets = append(offsets, offset)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{7}, offsets)
+
+	require.NoError(t, w.Close())
+}
+
+func TestWAL_RecycleSegments(t *testing.T) {
+	path := t.TempDir()
+	conf := wal.DefaultConfiguration()
+	conf.MaxSegmentSize = 60 // two entries per segment
+	conf.RecycleSegments = 2
+	logger := zaptest.Logger(t)
+
+	w, err := wal.New(path, conf, waltest.ExampleEntries, logger)
+	require.NoError(t, err)
+
+	recycled, err := filepath.Glob(filepath.Join(path, "*.recycle"))
+	require.NoError(t, err)
+	assert.Len(t, recycled, 2, "the pool should be filled when the WAL is opened")
+
+	var expected []wal.Entry
+	write := func(n int) {
+		for i := 0; i < n; i++ {
+			e := &waltest.ExampleEntry1{ID: uint32(len(expected) + 1), Point: []float32{1, float32(i)}}
+			expected = append(expected, e)
+
+			_, err := w.Write(e)
+			require.NoError(t, err)
+		}
+	}
+
+	write(6) // three segments, the first two from the pool
+
+	recycled, err = filepath.Glob(filepath.Join(path, "*.recycle"))
+	require.NoError(t, err)
+	assert.Empty(t, recycled)
+
+	t.Log("Truncating the WAL should return the segment files to the pool")
+	require.NoError(t, w.TruncateFront(5))
+	recycled, err = filepath.Glob(filepath.Join(path, "*.recycle"))
+	require.NoError(t, err)
+	assert.Len(t, recycled, 2)
+
+	t.Log("Writing a single entry should reuse a recycled file that still contains stale entries")
+	write(3)
+
+	segments, err := wal.SegmentFileNames(path)
+	require.NoError(t, err)
+	require.Len(t, segments, 3) // [5,6] [7,8] [9]
+
+	info, err := os.Stat(segments[2])
+	require.NoError(t, err)
+	assert.Greater(t, info.Size(), int64(60), "last segment should be a recycled file with stale data")
+
+	t.Log("Re-open the WAL and check that no stale entries are read")
+	require.NoError(t, w.Close())
+	w, err = wal.New(path, conf, waltest.ExampleEntries, logger)
+	require.NoError(t, err)
+	assert.EqualValues(t, 9, w.Offset())
+
+	write(1)
+
+	var actual []wal.Entry
+	err = w.Replay(0, func(_ uint32, e wal.Entry) error {
+		actual = append(actual, e)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, expected[4:], actual)
+	require.NoError(t, w.Close())
+}
@@ -0,0 +1,87 @@
+package wal
+
+import (
+	"fmt"
+	"time"
+)
+
+// TypedWAL wraps a WAL to write and replay entries of a single concrete Entry
+// type T with compile-time type safety, so callers do not need to type switch
+// on the entries returned by the WAL. T can also be an interface type to
+// represent a sum of Entry types, e.g.:
+//
+//	type Event interface {
+//		wal.Entry
+//		isEvent()
+//	}
+//
+//	events := wal.NewTypedWAL[Event](w)
+//
+// All Entry implementations must still be registered at the EntryRegistry of
+// the underlying WAL.
+type TypedWAL[T Entry] struct {
+	w *WAL
+}
+
+// NewTypedWAL creates a new TypedWAL which writes to and reads from w.
+func NewTypedWAL[T Entry](w *WAL) *TypedWAL[T] {
+	return &TypedWAL[T]{w: w}
+}
+
+// WAL returns the underlying WAL, e.g. to truncate it.
+func (t *TypedWAL[T]) WAL() *WAL {
+	return t.w
+}
+
+// Write appends the entry to the WAL (see WAL.Write(…)).
+func (t *TypedWAL[T]) Write(e T) (offset uint32, err error) {
+	return t.w.Write(e)
+}
+
+// WriteWithHeaders appends the entry and its headers to the WAL (see
+// WAL.WriteWithHeaders(…)).
+func (t *TypedWAL[T]) WriteWithHeaders(e T, headers ...Header) (offset uint32, err error) {
+	return t.w.WriteWithHeaders(e, headers...)
+}
+
+// Replay passes all entries of the WAL starting at the given offset to fn (see
+// WAL.Replay(…)). An error is returned if the WAL contains an entry which is
+// not of type T.
+func (t *TypedWAL[T]) Replay(fromOffset uint32, fn func(offset uint32, e T) error) error {
+	return t.w.Replay(fromOffset, func(offset uint32, e Entry) error {
+		typed, err := As[T](offset, e)
+		if err != nil {
+			return err
+		}
+
+		return fn(offset, typed)
+	})
+}
+
+// OffsetForTime returns the first offset that was written at or after the
+// given time (see WAL.OffsetForTime(…)).
+func (t *TypedWAL[T]) OffsetForTime(tt time.Time) (uint32, error) {
+	return t.w.OffsetForTime(tt)
+}
+
+// Close closes the underlying WAL.
+func (t *TypedWAL[T]) Close() error {
+	return t.w.Close()
+}
+
+// As converts an Entry that was read from the WAL at the given offset into the
+// type T. It returns an error if the entry is not of type T. This is useful to
+// decode entries of a SegmentReader:
+//
+//	e, err := r.Decode()
+//	…
+//	typed, err := wal.As[*MyEntry](r.Offset(), e)
+func As[T Entry](offset uint32, e Entry) (T, error) {
+	typed, ok := e.(T)
+	if !ok {
+		var zero T
+		return zero, fmt.Errorf("WAL entry at offset %d has unexpected type %T", offset, e)
+	}
+
+	return typed, nil
+}
@@ -0,0 +1,78 @@
+package wal_test
+
+import (
+	"testing"
+
+	"github.com/fgrosse/wal"
+	"github.com/fgrosse/wal/waltest"
+	"github.com/fgrosse/zaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTypedWAL(t *testing.T) {
+	logger := zaptest.Logger(t)
+	w, err := wal.Open("/wal", waltest.ExampleEntries, logger, wal.WithFS(waltest.NewMemFS()))
+	require.NoError(t, err)
+
+	typed := wal.NewTypedWAL[*waltest.ExampleEntry1](w)
+	expected := []*waltest.ExampleEntry1{
+		{ID: 1, Point: []float32{1, 2}},
+		{ID: 2, Point: []float32{3, 4}},
+	}
+
+	for _, e := range expected {
+		_, err := typed.Write(e)
+		require.NoError(t, err)
+	}
+
+	var actual []*waltest.ExampleEntry1
+	err = typed.Replay(0, func(_ uint32, e *waltest.ExampleEntry1) error {
+		actual = append(actual, e)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+
+	t.Log("Entries of another type should be rejected")
+	_, err = typed.WAL().Write(&waltest.ExampleEntry2{Name: "test"})
+	require.NoError(t, err)
+
+	err = typed.Replay(0, func(uint32, *waltest.ExampleEntry1) error { return nil })
+	assert.EqualError(t, err, `replaying segment "/wal/1.wal": WAL entry at offset 3 has unexpected type *waltest.ExampleEntry2`)
+
+	require.NoError(t, typed.Close())
+}
+
+// payloadEntry stands in for an application specific sum type (see the
+// documentation of wal.TypedWAL) which is implemented by both example entries.
+type payloadEntry interface {
+	wal.Entry
+	EncodePayload([]byte) []byte
+}
+
+func TestTypedWAL_SumType(t *testing.T) {
+	logger := zaptest.Logger(t)
+	w, err := wal.Open("/wal", waltest.ExampleEntries, logger, wal.WithFS(waltest.NewMemFS()))
+	require.NoError(t, err)
+
+	typed := wal.NewTypedWAL[payloadEntry](w)
+	expected := []payloadEntry{
+		&waltest.ExampleEntry1{ID: 1, Point: []float32{1, 2}},
+		&waltest.ExampleEntry2{Name: "test"},
+	}
+
+	for _, e := range expected {
+		_, err := typed.Write(e)
+		require.NoError(t, err)
+	}
+
+	var actual []payloadEntry
+	err = typed.Replay(0, func(_ uint32, e payloadEntry) error {
+		actual = append(actual, e)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+	require.NoError(t, typed.Close())
+}
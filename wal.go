@@ -1,12 +1,19 @@
 package wal
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/crc32"
+	"io"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,41 +21,135 @@ import (
 	"go.uber.org/zap"
 )
 
+// ErrReadOnly is returned when trying to write to a WAL that was opened using
+// the ReadOnly() option.
+var ErrReadOnly = errors.New("WAL is read-only")
+
+// ErrFailed is returned by WAL.Write(…) after the WAL has entered the failed
+// state because of an earlier write or sync error. The returned error also
+// wraps the original cause of the failure.
+var ErrFailed = errors.New("WAL has failed")
+
 // WAL is a write-ahead log implementation.
 type WAL struct {
-	logger *zap.Logger
-	conf   Configuration
+	logger   *zap.Logger
+	conf     Configuration
+	registry *EntryRegistry
+	readOnly bool
+	fs       FS
+	archiver Archiver
+	codec    Codec
+	crypt    *encryption // nil if encryption is disabled
+	chain    *hashChain  // nil if hash chaining is disabled
+	chainKey []byte      // HMAC key of the hash chain, used by Verify()
+	raw      bool        // whether unknown entries are read as RawEntry
+	reuse    bool        // whether Replay reuses its entries
 
 	buffers sync.Pool // byte buffers for creating new WAL entries
 	path    string    // filesystem path to the WAL directory
 
-	mu         sync.Mutex
-	lastOffset uint32         // the last offset that has been written or zero if no writes occurred yet
-	segmentID  int            // ID of the current WAL segment, used to create segment file names
-	segment    *SegmentWriter // might be nil if we have never written anything to the WAL
+	mu          sync.Mutex
+	lastOffset  uint32         // the last offset that has been written or zero if no writes occurred yet
+	firstOffset uint32         // the first offset of the current WAL segment
+	segmentID   int            // ID of the current WAL segment, used to create segment file names
+	segment     *SegmentWriter // might be nil if we have never written anything to the WAL
+	recycled    []string       // paths of segment files that can be reused by the next segment
+	recycledSeq int            // sequence number to create unique file names for recycled segments
+	err         error          // the write or sync error that put the WAL into the failed state
+	checkpoint  uint32         // entries up to this offset may be deleted automatically
+
+	lastTimestamp int64                // timestamp of the last record in nanoseconds since the unix epoch
+	currentTimes  segmentTimes         // timestamps of the records of the current segment
+	timeIndex     map[int]segmentTimes // timestamps of sealed segments by segment ID, loaded lazily
+
+	syncedSize   int          // size of the current segment as of the last successful sync
+	syncedOffset uint32       // the last offset as of the last successful sync
+	syncedTimes  segmentTimes // the timestamps of the current segment as of the last successful sync
+
+	compressQueue  []string      // sealed segments which are compressed in the background
+	compressSignal chan struct{} // wakes up the compression goroutine, nil if segment compression is disabled
+
+	archiving     map[string][]chan<- error // sealed segments which are archived in the background and the goroutines waiting for them
+	archiveQueue  []queuedSegment           // sealed segments which wait to be archived
+	archiveSignal chan struct{}             // wakes up the archiving goroutine, nil if no Archiver was configured
 
 	syncScheduled atomic.Bool
 	syncWaiters   []chan<- error // goroutines waiting for the next fsync
 	closing       chan struct{}  // channel to signal that the WAL was closed (by closing the channel)
+	background    sync.WaitGroup // background goroutines which must finish before Close returns
 }
 
 // New creates a new WAL instance that writes and reads segment files to a
-// directory at the provided path.
-func New(path string, conf Configuration, registry *EntryRegistry, logger *zap.Logger) (*WAL, error) {
-	logger.Debug("Creating write-ahead log",
+// directory at the provided path. The directory is created if it does not
+// exist yet.
+//
+// This is a shorthand for calling Open(…) together with the WithConfiguration(…)
+// option.
+func New(path string, conf Configuration, registry *EntryRegistry, logger *zap.Logger, opts ...Option) (*WAL, error) {
+	opts = append([]Option{WithConfiguration(conf)}, opts...)
+	return Open(path, registry, logger, opts...)
+}
+
+// Open opens the WAL at the provided path. By default, the WAL uses the
+// DefaultConfiguration() and creates the directory if it does not exist yet.
+// This behavior can be changed by passing any Option.
+func Open(path string, registry *EntryRegistry, logger *zap.Logger, opts ...Option) (*WAL, error) {
+	o := newOptions(opts)
+	conf := o.conf
+
+	logger.Debug("Opening write-ahead log",
 		zap.String("path", path),
+		zap.Bool("read_only", o.readOnly),
 		zap.Object("configuration", conf),
 	)
 
-	if err := os.MkdirAll(path, 0777); err != nil {
+	if o.codec != nil {
+		if err := checkCodecID(o.codec); err != nil {
+			return nil, fmt.Errorf("invalid compression codec: %w", err)
+		}
+
+		if _, err := registry.codec(o.codec.ID()); err != nil {
+			return nil, fmt.Errorf("compression codec must be registered at the EntryRegistry: %w", err)
+		}
+	}
+
+	var crypt *encryption
+	if o.keys != nil {
+		crypt = newEncryption(o.keys)
+
+		// Fail early if the current key cannot be used.
+		id, key, err := o.keys.CurrentKey()
+		if err == nil {
+			_, err = crypt.cipher(id, key)
+		}
+
+		if err != nil && !o.readOnly {
+			return nil, fmt.Errorf("invalid encryption key: %w", err)
+		}
+	}
+
+	if o.readOnly {
+		if _, err := o.fs.List(path); err != nil {
+			return nil, fmt.Errorf("checking WAL directory: %w", err)
+		}
+	} else if err := o.fs.MkdirAll(path); err != nil {
 		return nil, fmt.Errorf("creating WAL directory: %w", err)
 	}
 
 	wal := &WAL{
-		logger:  logger,
-		conf:    conf,
-		path:    path,
-		closing: make(chan struct{}),
+		logger:   logger,
+		conf:     conf,
+		registry: registry,
+		readOnly: o.readOnly,
+		fs:       o.fs,
+		archiver: o.archiver,
+		codec:    o.codec,
+		crypt:    crypt,
+		chainKey: o.chainKey,
+		raw:      o.rawEntries,
+		reuse:    o.reuseEntries,
+		path:     path,
+		closing:  make(chan struct{}),
 		buffers: sync.Pool{
 			New: func() interface{} {
 				// The Pool's New function should generally only return pointer
@@ -65,20 +166,47 @@ func New(path string, conf Configuration, registry *EntryRegistry, logger *zap.L
 		},
 	}
 
-	err := wal.load(path, registry, logger)
+	if o.chain {
+		wal.chain = newHashChain(o.chainKey)
+	}
+
+	err := wal.load(path, logger)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load WAL: %w", err)
 	}
 
+	if !wal.readOnly {
+		err = wal.loadRecycledSegments()
+		if err != nil {
+			return nil, fmt.Errorf("failed to prepare recycled segments: %w", err)
+		}
+
+		if conf.retentionEnabled() {
+			wal.background.Add(1)
+			go wal.runRetention()
+		}
+
+		if wal.archiver != nil {
+			wal.startArchiving()
+		}
+
+		if conf.CompressSegments {
+			err = wal.startSegmentCompression()
+			if err != nil {
+				return nil, fmt.Errorf("failed to start segment compression: %w", err)
+			}
+		}
+	}
+
 	return wal, nil
 }
 
-func (w *WAL) load(path string, registry *EntryRegistry, logger *zap.Logger) error {
+func (w *WAL) load(path string, logger *zap.Logger) error {
 	logger = logger.With(zap.String("path", path))
 
 	logger.Debug("Checking for existing WAL segment files")
 
-	segments, err := SegmentFileNames(path)
+	segments, err := segmentFileNames(w.fs, path)
 	if err != nil {
 		return fmt.Errorf("checking existing segment files: %w", err)
 	}
@@ -89,64 +217,427 @@ func (w *WAL) load(path string, registry *EntryRegistry, logger *zap.Logger) err
 	}
 
 	lastSegment := segments[len(segments)-1]
+	segmentID, err := parseSegmentID(lastSegment)
+	if err != nil {
+		return err
+	}
 
 	logger.Info("Loading existing WAL segments",
 		zap.Strings("segments", segments),
 		zap.String("last_segment", lastSegment),
 	)
 
-	segmentWriter, lastOffset, err := w.openSegment(lastSegment, registry)
+	// Compressed segments are sealed, so the next write starts a new segment.
+	var info segmentInfo
+	if w.readOnly || isCompressed(lastSegment) {
+		info, err = w.inspectSegment(lastSegment, segmentID)
+	} else {
+		w.segment, info, err = w.openSegment(lastSegment, segmentID)
+	}
+
 	if err != nil {
 		return fmt.Errorf("opening last segment: %w", err)
 	}
 
+	// If the last segment neither has a header nor any records, we have to
+	// look at the previous segments to find the last offset.
+	lastOffset := info.lastOffset
+	for i := len(segments) - 2; !info.known && lastOffset == 0 && i >= 0; i-- {
+		id, err := parseSegmentID(segments[i])
+		if err != nil {
+			return err
+		}
+
+		prev, err := w.inspectSegment(segments[i], id)
+		if err != nil {
+			return fmt.Errorf("opening previous segment: %w", err)
+		}
+
+		lastOffset = prev.lastOffset
+	}
+
 	logger.Info("Finished reading last WAL segment",
 		zap.String("last_segment", lastSegment),
 		zap.Uint32("last_offset", lastOffset),
 	)
 
-	w.segment = segmentWriter
+	w.segmentID = segmentID
 	w.lastOffset = lastOffset
+	w.syncedOffset = lastOffset
+	w.syncedSize = int(info.end)
+	w.firstOffset = info.firstOffset
+	if !info.known {
+		w.firstOffset = lastOffset + 1
+	}
+
+	w.lastTimestamp = info.lastTimestamp
+	w.currentTimes = segmentTimes{first: info.firstTimestamp, last: info.lastTimestamp}
+	w.syncedTimes = w.currentTimes
+	if w.chain != nil && info.chained {
+		w.chain.head = info.head
+		w.chain.synced = info.head
+	}
 
 	return nil
 }
 
 // SegmentFileNames will return all files that are WAL segment files in sorted
-// order by ascending ID.
+// order by ascending ID. This includes compressed segments (e.g. "7.wal.gz").
+// If a segment exists both compressed and uncompressed, because the WAL was
+// interrupted while compressing it, only the uncompressed segment is returned.
 func SegmentFileNames(dir string) ([]string, error) {
-	names, err := filepath.Glob(filepath.Join(dir, "*.wal"))
+	return segmentFileNames(OSFS{}, dir)
+}
+
+func segmentFileNames(fs FS, dir string) ([]string, error) {
+	names, err := listFiles(fs, dir, ".wal", ".wal"+compressedSuffix)
 	if err != nil {
 		return nil, err
 	}
-	sort.Strings(names)
+
+	ids := make(map[string]int, len(names))
+	uncompressed := map[int]bool{}
+	for _, name := range names {
+		ids[name], err = parseSegmentID(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if !isCompressed(name) {
+			uncompressed[ids[name]] = true
+		}
+	}
+
+	// The original segment file is only removed after its compressed copy
+	// is complete, so we can always rely on it.
+	segments := names[:0]
+	for _, name := range names {
+		if !isCompressed(name) || !uncompressed[ids[name]] {
+			segments = append(segments, name)
+		}
+	}
+	names = segments
+
+	// Sort numerically, so "10.wal" comes after "9.wal".
+	sort.Slice(names, func(i, j int) bool {
+		return ids[names[i]] < ids[names[j]]
+	})
+
 	return names, nil
 }
 
-func (w *WAL) openSegment(path string, registry *EntryRegistry) (*SegmentWriter, uint32, error) {
-	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+// parseSegmentID returns the ID of a segment from its file name.
+func parseSegmentID(path string) (int, error) {
+	name := strings.TrimSuffix(filepath.Base(path), compressedSuffix)
+	name = strings.TrimSuffix(name, ".wal")
+	id, err := strconv.Atoi(name)
+	if err != nil {
+		return 0, fmt.Errorf("invalid WAL segment file name %q", path)
+	}
+
+	return id, nil
+}
+
+// segmentInfo describes the contents of a segment file.
+type segmentInfo struct {
+	firstOffset uint32            // offset of the first record in the segment
+	lastOffset  uint32            // offset of the last record, or firstOffset-1 if the segment is empty
+	end         int64             // logical end of the segment, i.e. where the next record must be written
+	known       bool              // false if the segment neither has a header nor any records
+	version     uint8             // version of the segment header or zero if the segment has no header
+	chained     bool              // whether the records of the segment are hash chained
+	head        [sha256.Size]byte // hash of the last record or the anchor of a chained segment
+
+	firstTimestamp int64 // timestamp of the first timestamped record or zero if it has none
+	lastTimestamp  int64 // timestamp of the last record or zero if it has none
+}
+
+func (w *WAL) openSegment(path string, segmentID int) (*SegmentWriter, segmentInfo, error) {
+	f, err := w.fs.OpenFile(path, os.O_RDWR, 0666)
 	if err != nil {
-		return nil, 0, err
+		return nil, segmentInfo{}, err
 	}
 
-	lastOffset, err := w.readSegment(f, registry)
+	sw, info, err := w.resumeSegment(f, segmentID)
 	if err != nil {
-		return nil, 0, err
+		_ = f.Close()
+		return nil, segmentInfo{}, err
+	}
+
+	return sw, info, nil
+}
+
+func (w *WAL) resumeSegment(f File, segmentID int) (*SegmentWriter, segmentInfo, error) {
+	info, err := w.readSegment(f, segmentID)
+	if err != nil {
+		return nil, info, err
+	}
+
+	if err := w.checkSegmentTail(f, info); err != nil {
+		return nil, info, err
+	}
+
+	// Drop everything after the logical end of the segment (i.e. zero-filled
+	// preallocated space, stale data of a recycled segment file or an
+	// incomplete record) and then resume writing at the logical end.
+	if err := f.Truncate(info.end); err != nil {
+		return nil, info, err
+	}
+
+	if _, err := f.Seek(info.end, io.SeekStart); err != nil {
+		return nil, info, err
+	}
+
+	if w.conf.PreallocateSegments {
+		if err := preallocate(f, int64(w.conf.MaxSegmentSize)); err != nil {
+			return nil, info, fmt.Errorf("preallocating segment: %w", err)
+		}
 	}
 
 	sw := NewSegmentWriterSize(f, w.conf.WriteBufferSize)
-	return sw, lastOffset, nil
+	sw.size = int(info.end)
+	sw.extended = info.version >= 2
+	sw.chained = info.chained
+
+	return sw, info, nil
+}
+
+// checkSegmentTail makes sure that there are no more records of the segment
+// after its logical end, which would be lost when the segment is truncated.
+// This happens if a record in the middle of the segment was corrupted, e.g.
+// because its header was overwritten with zeros, which otherwise marks the
+// end of a preallocated segment.
+//
+// Zero-filled space, an incomplete record and stale data of a recycled segment
+// file are expected after the logical end. Stale records were written to older
+// segments, so their offsets are always lower than the offsets of this segment.
+// Therefore, it is enough to search for valid records with the next two
+// offsets after the last record of the segment.
+func (w *WAL) checkSegmentTail(f File, info segmentInfo) error {
+	if !info.known {
+		return nil
+	}
+
+	if _, err := f.Seek(info.end, io.SeekStart); err != nil {
+		return err
+	}
+
+	var patterns [2][4]byte
+	for i := range patterns {
+		binary.BigEndian.PutUint32(patterns[i][:], info.lastOffset+1+uint32(i))
+	}
+
+	buf := make([]byte, 64*1024)
+	pos, kept := info.end, 0 // position of buf[0] in the file and the bytes kept from the last chunk
+	for {
+		n, readErr := io.ReadFull(f, buf[kept:])
+		chunk := buf[:kept+n]
+
+		var found bool
+		for _, p := range patterns {
+			for i := bytes.Index(chunk, p[:]); i >= 0; {
+				offset := binary.BigEndian.Uint32(p[:])
+				ok, err := w.isRecordAt(f, info, pos+int64(i), offset)
+				if err != nil {
+					return err
+				}
+
+				if ok {
+					return fmt.Errorf("detected WAL Entry corruption before WAL offset %d", offset)
+				}
+
+				found = true
+				j := bytes.Index(chunk[i+1:], p[:])
+				if j < 0 {
+					break
+				}
+
+				i += j + 1
+			}
+		}
+
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			return nil
+		}
+
+		if readErr != nil {
+			return readErr
+		}
+
+		// An offset might cross the boundary of two chunks.
+		kept = copy(buf, chunk[len(chunk)-3:])
+		pos += int64(len(chunk) - kept)
+		if found {
+			if _, err := f.Seek(pos+int64(kept), io.SeekStart); err != nil {
+				return err
+			}
+		}
+	}
 }
 
-func (w *WAL) readSegment(f *os.File, registry *EntryRegistry) (lastOffset uint32, err error) {
-	r, err := NewSegmentReader(f, registry)
+// isRecordAt returns whether a complete record with the given offset and a
+// valid checksum starts at the given position of the segment file.
+func (w *WAL) isRecordAt(f File, info segmentInfo, pos int64, offset uint32) (bool, error) {
+	if _, err := f.Seek(pos, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	r := &SegmentReader{
+		r:          &positionReader{r: bufio.NewReader(f)},
+		header:     SegmentHeader{Version: info.version, FirstOffset: offset},
+		hasHeader:  info.version > 0,
+		nextOffset: offset,
+		registry:   w.registry,
+		raw:        true,
+		reuse:      true,
+		verify:     true,
+	}
+
+	return r.next(skipAll) && r.Err() == nil && r.validChecksum(), nil
+}
+
+// inspectSegment reads the segment at the given path without keeping the file
+// open for writing.
+func (w *WAL) inspectSegment(path string, segmentID int) (segmentInfo, error) {
+	f, err := w.openSegmentFile(path)
+	if err != nil {
+		return segmentInfo{}, err
+	}
+
+	defer f.Close()
+
+	return w.readSegment(f, segmentID)
+}
+
+// newSegmentReader creates a SegmentReader which decrypts entries, reads
+// unknown entries as RawEntry and reuses its entries, if the WAL was configured
+// to do so.
+func (w *WAL) newSegmentReader(f io.Reader) (*SegmentReader, error) {
+	r, err := NewSegmentReader(f, w.registry)
 	if err != nil {
-		return 0, fmt.Errorf("failed to create WAL segment reader: %w", err)
+		return nil, err
 	}
 
-	return r.SeekEnd()
+	r.encryption = w.crypt
+	r.raw = w.raw
+	r.SetReuseEntries(w.reuse)
+	return r, nil
 }
 
+// readSegment reads through the entire segment to determine its offsets as
+// well as its logical end, i.e. the position at which the next record must be
+// written. All entries are checked for corruption along the way.
+//
+// If the segment ends with an incomplete or corrupted record, we assume that
+// the process crashed in the middle of writing it. Such a record is not
+// considered an error because it was never acknowledged to the writer.
+// Instead, the returned end points to the start of the record, so it will be
+// overwritten with the next write. It is an error though, if there are any
+// more valid records after the corrupted one.
+func (w *WAL) readSegment(f io.Reader, segmentID int) (info segmentInfo, err error) {
+	r, err := w.newSegmentReader(f)
+	if err != nil {
+		return info, fmt.Errorf("failed to create WAL segment reader: %w", err)
+	}
+
+	// The entries are never decoded, so we can skip the payloads of all records
+	// which store their length and only compute their checksum.
+	r.SetReuseEntries(true)
+	r.SetVerifyOnSeek(true)
+
+	if h, ok := r.Header(); ok {
+		if h.SegmentID != uint32(segmentID) {
+			return info, fmt.Errorf("segment header has unexpected segment ID %d", h.SegmentID)
+		}
+
+		info.firstOffset = h.FirstOffset
+		info.lastOffset = h.FirstOffset - 1
+		info.version = h.Version
+		info.chained = h.Chained
+		info.head = h.Anchor
+		info.end = r.r.pos
+		info.known = true
+	}
+
+	// The error of each record is reset when reading the next record, so we
+	// keep the reason why the first incomplete record was discarded.
+	var torn error
+	for r.next(skipAll) {
+		if err := r.Err(); err != nil || !r.validChecksum() {
+			if torn == nil {
+				torn = err
+			}
+
+			if torn == nil {
+				torn = fmt.Errorf("checksum mismatch at WAL offset %d", r.Offset())
+			}
+
+			continue
+		}
+
+		if torn != nil {
+			return info, fmt.Errorf("detected WAL Entry corruption before WAL offset %d", r.Offset())
+		}
+
+		if !info.known {
+			info.firstOffset = r.Offset()
+			info.known = true
+		}
+
+		info.lastOffset = r.Offset()
+		info.end = r.r.pos
+		if r.chained {
+			info.head = r.hash
+		}
+
+		if r.timestamp != 0 {
+			if info.firstTimestamp == 0 {
+				info.firstTimestamp = r.timestamp
+			}
+
+			info.lastTimestamp = r.timestamp
+		}
+	}
+
+	err = r.Err()
+	if err != nil && torn == nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return info, err
+	}
+
+	if torn == nil {
+		torn = err
+	}
+
+	if torn != nil {
+		w.logger.Warn("Discarding incomplete record at the end of the WAL segment",
+			zap.Int("segment_id", segmentID),
+			zap.Uint32("last_offset", info.lastOffset),
+			zap.Int64("position", info.end),
+			zap.NamedError("reason", torn),
+		)
+	}
+
+	return info, nil
+}
+
+// Write appends the Entry to the WAL and waits until it was synced to disk. It
+// returns the offset of the new entry.
 func (w *WAL) Write(e Entry) (offset uint32, err error) {
+	return w.WriteWithHeaders(e)
+}
+
+// WriteWithHeaders works like Write(…) but additionally stores the given
+// headers in the metadata of the record. The headers can be read via
+// SegmentReader.Headers() without decoding the entry.
+func (w *WAL) WriteWithHeaders(e Entry, headers ...Header) (offset uint32, err error) {
+	var encodedHeaders []byte
+	if len(headers) > 0 {
+		encodedHeaders, err = appendHeaders(nil, headers)
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	// TODO: limit how many concurrent encodings can be in flight.  Since we can only
 	//	     write one at a time to disk, a slow disk can cause the allocations below
 	//	     to increase quickly.  If we're backed up, wait until others have completed.
@@ -155,10 +646,54 @@ func (w *WAL) Write(e Entry) (offset uint32, err error) {
 	// single write operation to disk.
 	payloadBufferPtr := w.buffers.Get().(*[]byte)
 	payloadBuffer := *payloadBufferPtr
-	entryPayload := e.EncodePayload(payloadBuffer)
+	rec := record{
+		typ:     e.Type(),
+		version: entryVersion(e),
+		headers: encodedHeaders,
+		sized:   w.conf.RecordLengths,
+	}
 
-	// Calculate checksum of the payload to enable detecting WAL entry corruption.
-	entryChecksum := crc32.ChecksumIEEE(entryPayload)
+	if enc, ok := e.(EntryEncoder); ok {
+		rec.payload, err = enc.TryEncodePayload(payloadBuffer)
+		if err != nil {
+			w.buffers.Put(payloadBufferPtr)
+			return 0, fmt.Errorf("encoding WAL entry: %w", err)
+		}
+	} else {
+		rec.payload = e.EncodePayload(payloadBuffer)
+	}
+
+	// Optionally compress the payload into a second buffer. The compressed
+	// payload is only used if it is actually smaller than the original.
+	var compressedBufferPtr *[]byte
+	if w.codec != nil && len(rec.payload) >= w.conf.CompressionThreshold {
+		compressedBufferPtr = w.buffers.Get().(*[]byte)
+		compressed, err := w.codec.Compress((*compressedBufferPtr)[:0], rec.payload)
+		*compressedBufferPtr = compressed[:0]
+
+		switch {
+		case err != nil:
+			*payloadBufferPtr = payloadBuffer
+			w.buffers.Put(payloadBufferPtr)
+			w.buffers.Put(compressedBufferPtr)
+			return 0, fmt.Errorf("compressing WAL entry: %w", err)
+		case len(compressed) < len(rec.payload):
+			rec.payload = compressed
+			rec.codec = w.codec.ID()
+		}
+	}
+
+	// The (compressed) payload is encrypted into a third buffer once its
+	// offset is known. We must not reuse the compressed buffer since it might
+	// still be the destination.
+	var encryptedBufferPtr *[]byte
+	if w.crypt != nil {
+		encryptedBufferPtr = w.buffers.Get().(*[]byte)
+		rec.encrypted = true
+	} else {
+		// Calculate checksum of the payload to enable detecting WAL entry corruption.
+		rec.checksum = crc32.ChecksumIEEE(rec.payload)
+	}
 
 	// Create a channel that will later receive the result from concurrently
 	// syncing the WAL. The channel must be buffered because the reader of the
@@ -167,7 +702,7 @@ func (w *WAL) Write(e Entry) (offset uint32, err error) {
 	// block when delivering the sync results.
 	syncResult := make(chan error, 1)
 
-	offset, err = w.write(e.Type(), entryPayload, entryChecksum, syncResult)
+	offset, err = w.write(rec, encryptedBufferPtr, syncResult)
 
 	// First, put back the buffer. We don't have to clean it because it is
 	// completely overwritten, the next time it is used.
@@ -180,6 +715,12 @@ func (w *WAL) Write(e Entry) (offset uint32, err error) {
 	// heap, and overwrite and return that.
 	*payloadBufferPtr = payloadBuffer
 	w.buffers.Put(payloadBufferPtr)
+	if compressedBufferPtr != nil {
+		w.buffers.Put(compressedBufferPtr)
+	}
+	if encryptedBufferPtr != nil {
+		w.buffers.Put(encryptedBufferPtr)
+	}
 
 	// Now check the error from writing. We can return immediately if it failed.
 	if err != nil {
@@ -190,7 +731,9 @@ func (w *WAL) Write(e Entry) (offset uint32, err error) {
 	return offset, <-syncResult
 }
 
-func (w *WAL) write(typ EntryType, payload []byte, checksum uint32, syncResult chan<- error) (offset uint32, err error) {
+// write appends the record to the current segment. If the record must be
+// encrypted, its payload is sealed into the given buffer first.
+func (w *WAL) write(rec record, encrypted *[]byte, syncResult chan<- error) (offset uint32, err error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
@@ -199,41 +742,103 @@ func (w *WAL) write(typ EntryType, payload []byte, checksum uint32, syncResult c
 		return 0, errors.New("WAL is already closed")
 	}
 
+	if w.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	if w.err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrFailed, w.err)
+	}
+
+	if w.conf.RecordTimestamps {
+		rec.timestamp = w.timestamp()
+	}
+
 	// First check if we need to roll over to a new segment because the current
 	// one is full. It might also be that we do not yet have a segment file at
 	// all, because this is the very first write to the WAL. In this case this
 	// function is going to set up the segment writer for us now.
-	err = w.rollSegment()
+	err = w.rollSegment(rec)
 	if err != nil {
-		return 0, fmt.Errorf("failed to roll WAL segment: %w", err)
+		err = fmt.Errorf("failed to roll WAL segment: %w", err)
+		if !errors.Is(err, ErrLogFull) {
+			w.fail(err)
+		}
+
+		return 0, err
 	}
 
 	offset = w.lastOffset + 1
+	if rec.encrypted {
+		// The offset and the metadata are authenticated together with the
+		// payload, so it can only be encrypted once both are known.
+		var sealed []byte
+		sealed, rec.keyID, err = w.crypt.seal((*encrypted)[:0], offset, rec)
+		*encrypted = sealed[:0]
+		if err != nil {
+			return 0, fmt.Errorf("encrypting WAL entry: %w", err)
+		}
+
+		rec.payload = sealed
+		rec.checksum = crc32.ChecksumIEEE(rec.payload)
+	}
+
+	// The timestamp is only known now, so the checksum of the metadata must be
+	// added while holding the lock.
+	rec.checksum = rec.metadataChecksum(rec.checksum)
+
+	if w.chain != nil {
+		rec.chained = true
+		rec.hash = w.chain.link(offset, rec)
+	}
 
 	w.logger.Debug("Writing WAL entry",
 		zap.Int("segment_id", w.segmentID),
 		zap.Uint32("offset", offset),
-		zap.Uint32("crc32", checksum),
+		zap.Uint32("crc32", rec.checksum),
 	)
 
-	err = w.segment.Write(offset, typ, checksum, payload)
+	err = w.segment.writeRecord(offset, rec)
 	if err != nil {
+		// All unsynced entries might be discarded, so we must notify their
+		// writers immediately.
+		err = w.handleWriteError(err)
+		w.notifySyncWaiters(err)
 		return 0, err
 	}
 
 	w.lastOffset = offset
+	if w.chain != nil {
+		w.chain.head = rec.hash
+	}
+
+	if rec.timestamp != 0 {
+		w.currentTimes.add(rec.timestamp)
+	}
 
 	err = w.scheduleSync(syncResult)
 	return offset, err
 }
 
-func (w *WAL) rollSegment() error {
-	if w.segment != nil && w.segment.size < w.conf.MaxSegmentSize {
+func (w *WAL) rollSegment(rec record) error {
+	// Segments that have been created by older versions of this library might
+	// not support extended records, so we must start a new segment for them.
+	// Similarly, all records of a segment must either be hash chained or not.
+	if w.segment != nil && w.segment.size < w.conf.MaxSegmentSize &&
+		(w.segment.extended || !rec.extended()) && w.segment.chained == (w.chain != nil) {
 		return nil
 	}
 
+	if err := w.ensureCapacity(); err != nil {
+		return err
+	}
+
 	if err := w.newSegmentFile(); err != nil {
-		return fmt.Errorf("error opening new segment file for wal (2): %v", err)
+		if isDiskFull(err) && w.err == nil {
+			err = fmt.Errorf("%w: %w", ErrLogFull, err)
+		}
+
+		return fmt.Errorf("error opening new segment file for wal (2): %w", err)
 	}
 
 	return nil
@@ -245,26 +850,110 @@ func (w *WAL) newSegmentFile() error {
 	if w.segment != nil {
 		// Sync all waiting writes to the old segment and then close it.
 		w.sync()
+		if w.err != nil {
+			return w.err
+		}
 
 		if err := w.segment.Close(); err != nil {
 			return err
 		}
+
+		w.queueSegmentCompression(w.segmentPath(w.segmentID - 1))
+		w.indexSegmentTimes(w.segmentID - 1)
+	}
+
+	fileName := w.segmentPath(w.segmentID)
+	header := SegmentHeader{
+		SegmentID:   uint32(w.segmentID),
+		FirstOffset: w.lastOffset + 1,
+	}
+
+	if w.chain != nil {
+		header.Chained = true
+		header.Signed = w.chain.signed
+		header.Anchor = w.chain.head
+	}
+
+	var err error
+	if len(w.recycled) > 0 {
+		w.segment, err = w.reuseSegmentFile(fileName, header)
+	} else {
+		w.segment, err = w.createSegmentFile(fileName, header)
 	}
 
-	fileName := filepath.Join(w.path, fmt.Sprintf("%d.wal", w.segmentID))
-	fd, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, 0666)
 	if err != nil {
+		// Any partially created segment file has already been removed, so we
+		// can try again with the same segment ID on the next write.
+		w.segment = nil
+		w.segmentID--
 		return err
 	}
 
+	w.firstOffset = header.FirstOffset
+	w.syncedSize = w.segment.size
+	w.syncedOffset = w.lastOffset
+	w.syncedTimes = w.currentTimes
+
+	return nil
+}
+
+// createSegmentFile creates a new segment file and writes its header.
+func (w *WAL) createSegmentFile(path string, header SegmentHeader) (*SegmentWriter, error) {
+	fd, err := w.fs.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	sw, err := w.initSegmentFile(fd, path, header)
+	if err != nil {
+		// Do not leave a half-initialized segment behind, e.g. if the disk is full.
+		_ = fd.Close()
+		if removeErr := w.fs.Remove(path); removeErr != nil {
+			return nil, fmt.Errorf("%w (failed to remove segment file: %v)", err, removeErr)
+		}
+
+		return nil, err
+	}
+
+	return sw, nil
+}
+
+// initSegmentFile preallocates a newly created segment file and writes its
+// header.
+func (w *WAL) initSegmentFile(fd File, path string, header SegmentHeader) (*SegmentWriter, error) {
+	// Make sure the new file is not lost if we crash after writing to it.
+	if err := w.fs.SyncDir(w.path); err != nil {
+		return nil, err
+	}
+
+	if w.conf.PreallocateSegments {
+		if err := preallocate(fd, int64(w.conf.MaxSegmentSize)); err != nil {
+			return nil, fmt.Errorf("preallocating segment: %w", err)
+		}
+	}
+
 	w.logger.Debug("Starting new WAL segment",
 		zap.Int("segment_id", w.segmentID),
-		zap.String("path", fileName),
+		zap.String("path", path),
 	)
 
-	w.segment = NewSegmentWriterSize(fd, w.conf.WriteBufferSize)
+	// The header is synced immediately, so we never have to discard it when
+	// rolling back unsynced entries.
+	sw := NewSegmentWriterSize(fd, w.conf.WriteBufferSize)
+	if err := sw.WriteHeader(header); err != nil {
+		return nil, err
+	}
 
-	return nil
+	if err := sw.Sync(); err != nil {
+		return nil, err
+	}
+
+	return sw, nil
+}
+
+// segmentPath returns the path of the segment file with the given ID.
+func (w *WAL) segmentPath(segmentID int) string {
+	return filepath.Join(w.path, fmt.Sprintf("%d.wal", segmentID))
 }
 
 // sync the segment writer and then notify all goroutines that currently wait
@@ -276,8 +965,24 @@ func (w *WAL) sync() {
 		return
 	}
 
+	// After a failed fsync, the state of the data in the page cache is
+	// undefined and a later fsync might succeed without actually persisting
+	// the data. Thus, we never try to sync again once the WAL has failed.
+	err := w.err
 	start := time.Now()
-	err := w.segment.Sync()
+	if err == nil {
+		err = w.segment.Sync()
+		if err == nil {
+			w.syncedSize = w.segment.size
+			w.syncedOffset = w.lastOffset
+			w.syncedTimes = w.currentTimes
+			if w.chain != nil {
+				w.chain.synced = w.chain.head
+			}
+		} else {
+			err = w.handleWriteError(err)
+		}
+	}
 	took := time.Since(start)
 
 	if len(w.syncWaiters) == 0 {
@@ -290,6 +995,13 @@ func (w *WAL) sync() {
 		zap.Int("waiting_inserts", len(w.syncWaiters)),
 	)
 
+	w.notifySyncWaiters(err)
+}
+
+// notifySyncWaiters sends the result of a sync to all goroutines that are
+// currently waiting for it.
+// The caller must ensure the WAL is write-locked before calling this function.
+func (w *WAL) notifySyncWaiters(err error) {
 	for _, resultChan := range w.syncWaiters {
 		resultChan <- err
 	}
@@ -297,6 +1009,31 @@ func (w *WAL) sync() {
 	w.syncWaiters = nil
 }
 
+// fail puts the WAL into the failed state if err is not nil. All subsequent
+// writes are rejected because we can no longer know which data actually made
+// it to disk. Only the first error is recorded.
+// The caller must ensure the WAL is write-locked before calling this function.
+func (w *WAL) fail(err error) {
+	if err == nil || w.err != nil {
+		return
+	}
+
+	w.logger.Error("WAL has failed and rejects all further writes", zap.Error(err))
+	w.err = err
+}
+
+// Err returns the write or sync error that put the WAL into the failed state or
+// nil if the WAL is healthy. It can be used as a health check. Once the WAL has
+// failed, all calls to WAL.Write(…) return an error wrapping ErrFailed and the
+// original cause. To recover, the WAL must be closed and opened again, which
+// discards any incomplete records that were not acknowledged.
+func (w *WAL) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.err
+}
+
 // Register the given syncResult channel and then schedule an asynchronous WAL
 // sync.
 // The caller must ensure the WAL is write-locked before calling this function.
@@ -343,24 +1080,46 @@ func (w *WAL) scheduleSync(syncResult chan<- error) error {
 // writes are completed and synced to disk before then closing the WAL segment file.
 // Any future writes after the WAL has been closed will lead to an error.
 func (w *WAL) Close() error {
+	err := w.close()
+
+	// Background goroutines might need the lock to finish, so we must wait for
+	// them after it was released.
+	w.background.Wait()
+
+	return err
+}
+
+func (w *WAL) close() error {
 	// First squire the lock, so we know that no writes happen at the moment and
 	// no new syncs can be scheduled.
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
+	if w.isClosed() {
+		return nil
+	}
+
 	w.logger.Info("Closing WAL")
 
+	// Stop sync goroutine and sync all waiting writes if there are any.
+	close(w.closing)
+
 	if w.segment == nil {
 		// We never got a single write, so we can return immediately.
 		return nil
 	}
 
-	// Stop sync goroutine and sync all waiting writes if there are any.
-	close(w.closing)
 	w.sync()
 
-	// Shutdown the segment writer.
-	err := w.segment.Close()
+	// Shutdown the segment writer. If the WAL has failed, we must not try to
+	// flush or sync any buffered data but only close the file.
+	var err error
+	if w.err != nil {
+		err = w.segment.closer.Close()
+	} else {
+		err = w.segment.Close()
+	}
+
 	w.segment = nil
 
 	return err
@@ -390,3 +1149,77 @@ func (w *WAL) Offset() uint32 {
 
 	return w.lastOffset
 }
+
+// Replay reads all entries of the WAL in order, starting at the given offset,
+// and passes each decoded Entry to the provided callback function. Replay stops
+// and returns the first error that occurs, including errors returned by fn.
+//
+// Only entries that have been written before Replay was called are passed to
+// the callback. It is safe to call Replay concurrently with WAL.Write(…).
+//
+// If the WAL was opened with the WithReusedEntries() option, each Entry is only
+// valid until fn returns.
+func (w *WAL) Replay(fromOffset uint32, fn func(offset uint32, e Entry) error) error {
+	w.mu.Lock()
+	if !w.isClosed() {
+		w.sync() // make sure all written entries are visible to the segment reader
+	}
+	lastOffset := w.lastOffset
+	w.mu.Unlock()
+
+	if lastOffset < fromOffset {
+		return nil
+	}
+
+	segments, err := segmentFileNames(w.fs, w.path)
+	if err != nil {
+		return fmt.Errorf("checking existing segment files: %w", err)
+	}
+
+	for _, path := range segments {
+		done, err := w.replaySegment(path, fromOffset, lastOffset, fn)
+		if err != nil {
+			return fmt.Errorf("replaying segment %q: %w", path, err)
+		}
+
+		if done {
+			break
+		}
+	}
+
+	return nil
+}
+
+// replaySegment passes all entries of a single segment file within the given
+// offset range to fn. It returns true if the last offset has been reached.
+func (w *WAL) replaySegment(path string, fromOffset, lastOffset uint32, fn func(uint32, Entry) error) (done bool, err error) {
+	f, err := w.openSegmentFile(path)
+	if err != nil {
+		return false, err
+	}
+
+	defer f.Close()
+
+	r, err := w.newSegmentReader(f)
+	if err != nil {
+		return false, err
+	}
+
+	for ok := r.SeekOffset(fromOffset); ok; ok = r.ReadNext() {
+		offset := r.Offset()
+		if offset > lastOffset {
+			return true, nil
+		}
+
+		entry, err := r.Decode()
+		if err != nil {
+			return false, err
+		}
+
+		if err := fn(offset, entry); err != nil {
+			return false, err
+		}
+	}
+
+	return false, r.Err()
+}
@@ -1,8 +1,11 @@
 package wal_test
 
 import (
+	"bytes"
+	"errors"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -102,11 +105,11 @@ func TestWAL(t *testing.T) {
 }
 
 func TestWAL_Insert_Concurrent(t *testing.T) {
-	path := t.TempDir()
+	fs := waltest.NewMemFS()
 	conf := wal.DefaultConfiguration()
 	conf.SyncDelay = 10 * time.Millisecond
 
-	w, err := wal.New(path, conf, waltest.ExampleEntries, zaptest.Logger(t))
+	w, err := wal.New("/wal", conf, waltest.ExampleEntries, zaptest.Logger(t), wal.WithFS(fs))
 	require.NoError(t, err)
 
 	n := 100
@@ -158,3 +161,419 @@ func TestWAL_Offset(t *testing.T) {
 	assert.EqualValues(t, 2, w.Offset())
 	assert.Equal(t, writeOffset, w.Offset())
 }
+
+func TestOpen_ReadOnly(t *testing.T) {
+	path := t.TempDir()
+	logger := zaptest.Logger(t)
+
+	w, err := wal.New(path, wal.DefaultConfiguration(), waltest.ExampleEntries, logger)
+	require.NoError(t, err)
+
+	inserts := []wal.Entry{
+		&waltest.ExampleEntry1{ID: 1, Point: []float32{1, 2}},
+		&waltest.ExampleEntry2{Test: true, Name: "foo"},
+		&waltest.ExampleEntry1{ID: 3, Point: []float32{5, 6}},
+	}
+
+	for _, e := range inserts {
+		_, err := w.Write(e)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, w.Close())
+
+	segments, err := wal.SegmentFileNames(path)
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+
+	before, err := os.Stat(segments[0])
+	require.NoError(t, err)
+
+	w, err = wal.Open(path, waltest.ExampleEntries, logger, wal.ReadOnly())
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, w.Offset())
+
+	_, err = w.Write(&waltest.ExampleEntry1{ID: 4})
+	assert.ErrorIs(t, err, wal.ErrReadOnly)
+
+	var replayed []wal.Entry
+	err = w.Replay(0, func(offset uint32, e wal.Entry) error {
+		assert.EqualValues(t, len(replayed)+1, offset)
+		replayed = append(replayed, e)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, inserts, replayed)
+	require.NoError(t, w.Close())
+
+	after, err := os.Stat(segments[0])
+	require.NoError(t, err)
+	assert.Equal(t, before.Size(), after.Size())
+	assert.Equal(t, before.ModTime(), after.ModTime())
+}
+
+func TestOpen_ReadOnly_MissingDir(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "does-not-exist")
+
+	_, err := wal.Open(path, waltest.ExampleEntries, zaptest.Logger(t), wal.ReadOnly())
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "read-only WAL must not create its directory")
+}
+
+func TestWAL_Replay(t *testing.T) {
+	path := t.TempDir()
+	conf := wal.DefaultConfiguration()
+	conf.MaxSegmentSize = 64 // force multiple segments
+	logger := zaptest.Logger(t)
+
+	w, err := wal.New(path, conf, waltest.ExampleEntries, logger)
+	require.NoError(t, err)
+
+	var inserts []*waltest.ExampleEntry1
+	for i := 1; i <= 12; i++ {
+		e := &waltest.ExampleEntry1{ID: uint32(i), Point: []float32{float32(i), 1}}
+		inserts = append(inserts, e)
+
+		_, err := w.Write(e)
+		require.NoError(t, err)
+	}
+
+	segments, err := wal.SegmentFileNames(path)
+	require.NoError(t, err)
+	require.Greater(t, len(segments), 1)
+
+	var replayed []wal.Entry
+	err = w.Replay(5, func(offset uint32, e wal.Entry) error {
+		assert.EqualValues(t, len(replayed)+5, offset)
+		replayed = append(replayed, e)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, replayed, 8)
+	for i, e := range replayed {
+		assert.Equal(t, inserts[i+4], e)
+	}
+
+	t.Log("Errors from the callback should abort the replay")
+	errStop := errors.New("stop")
+	err = w.Replay(0, func(uint32, wal.Entry) error { return errStop })
+	assert.ErrorIs(t, err, errStop)
+
+	require.NoError(t, w.Close())
+}
+
+func TestWAL_Replay_ReusedEntries(t *testing.T) {
+	fs := waltest.NewMemFS()
+	w, err := wal.Open("/wal", waltest.ExampleEntries, zaptest.Logger(t), wal.WithFS(fs), wal.WithReusedEntries())
+	require.NoError(t, err)
+
+	var inserts []*waltest.ExampleEntry1
+	for i := 1; i <= 12; i++ {
+		e := &waltest.ExampleEntry1{ID: uint32(i), Point: []float32{float32(i), 1}}
+		inserts = append(inserts, e)
+
+		_, err := w.Write(e)
+		require.NoError(t, err)
+	}
+
+	t.Log("Each entry should be valid until the callback returns")
+	var instances []wal.Entry
+	err = w.Replay(1, func(offset uint32, e wal.Entry) error {
+		assert.Equal(t, inserts[offset-1], e)
+		instances = append(instances, e)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, instances, 12)
+
+	t.Log("All entries of the same type should share a single instance")
+	for _, e := range instances {
+		assert.Same(t, instances[0], e)
+	}
+
+	require.NoError(t, w.Close())
+}
+
+func TestWAL_Reopen_MultipleSegments(t *testing.T) {
+	path := t.TempDir()
+	conf := wal.DefaultConfiguration()
+	conf.MaxSegmentSize = 16 // one entry per segment
+	logger := zaptest.Logger(t)
+
+	var expected []wal.Entry
+	for i := 0; i < 3; i++ {
+		w, err := wal.New(path, conf, waltest.ExampleEntries, logger)
+		require.NoError(t, err)
+
+		for j := 0; j < 4; j++ {
+			e := &waltest.ExampleEntry1{ID: uint32(len(expected) + 1), Point: []float32{1, 2}}
+			expected = append(expected, e)
+
+			offset, err := w.Write(e)
+			require.NoError(t, err)
+			assert.EqualValues(t, len(expected), offset)
+		}
+
+		require.NoError(t, w.Close())
+	}
+
+	segments, err := wal.SegmentFileNames(path)
+	require.NoError(t, err)
+	require.Len(t, segments, len(expected))
+	assert.Equal(t, filepath.Join(path, "10.wal"), segments[9], "segments must be sorted numerically")
+
+	w, err := wal.Open(path, waltest.ExampleEntries, logger, wal.ReadOnly())
+	require.NoError(t, err)
+
+	var actual []wal.Entry
+	err = w.Replay(0, func(_ uint32, e wal.Entry) error {
+		actual = append(actual, e)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+func TestWAL_PreallocateSegments(t *testing.T) {
+	path := t.TempDir()
+	conf := wal.DefaultConfiguration()
+	conf.MaxSegmentSize = 1024
+	conf.PreallocateSegments = true
+	logger := zaptest.Logger(t)
+
+	w, err := wal.New(path, conf, waltest.ExampleEntries, logger)
+	require.NoError(t, err)
+
+	var expected []wal.Entry
+	write := func(n int) {
+		for i := 0; i < n; i++ {
+			e := &waltest.ExampleEntry1{ID: uint32(len(expected) + 1), Point: []float32{1, 2}}
+			expected = append(expected, e)
+
+			offset, err := w.Write(e)
+			require.NoError(t, err)
+			assert.EqualValues(t, len(expected), offset)
+		}
+	}
+
+	write(3)
+
+	segments, err := wal.SegmentFileNames(path)
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+
+	info, err := os.Stat(segments[0])
+	require.NoError(t, err)
+	assert.EqualValues(t, conf.MaxSegmentSize, info.Size())
+
+	t.Log("Re-opening the WAL should resume at the logical end of the segment")
+	require.NoError(t, w.Close())
+	w, err = wal.New(path, conf, waltest.ExampleEntries, logger)
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, w.Offset())
+
+	write(50) // enough to roll over into new segments
+
+	var actual []wal.Entry
+	err = w.Replay(0, func(_ uint32, e wal.Entry) error {
+		actual = append(actual, e)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+	require.NoError(t, w.Close())
+}
+
+func TestWAL_TornWrite(t *testing.T) {
+	path := t.TempDir()
+	conf := wal.DefaultConfiguration()
+	logger := zaptest.Logger(t)
+
+	w, err := wal.New(path, conf, waltest.ExampleEntries, logger)
+	require.NoError(t, err)
+
+	e1 := &waltest.ExampleEntry1{ID: 1, Point: []float32{1, 2}}
+	_, err = w.Write(e1)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	segments, err := wal.SegmentFileNames(path)
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+
+	content, err := os.ReadFile(segments[0])
+	require.NoError(t, err)
+
+	t.Log("Simulating a crash in the middle of writing the second entry")
+	torn := append(content, content[:len(content)-3]...)
+	torn[len(content)+3] = 2 // offset of the second entry
+	require.NoError(t, os.WriteFile(segments[0], torn, 0666))
+
+	w, err = wal.New(path, conf, waltest.ExampleEntries, logger)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, w.Offset())
+
+	e2 := &waltest.ExampleEntry1{ID: 2, Point: []float32{3, 4}}
+	offset, err := w.Write(e2)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, offset)
+
+	var actual []wal.Entry
+	err = w.Replay(0, func(_ uint32, e wal.Entry) error {
+		actual = append(actual, e)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []wal.Entry{e1, e2}, actual)
+	require.NoError(t, w.Close())
+}
+
+func TestWAL_CorruptedSegment(t *testing.T) {
+	path := t.TempDir()
+	conf := wal.DefaultConfiguration()
+	logger := zaptest.Logger(t)
+
+	w, err := wal.New(path, conf, waltest.ExampleEntries, logger)
+	require.NoError(t, err)
+
+	for i := 1; i <= 3; i++ {
+		_, err = w.Write(&waltest.ExampleEntry1{ID: uint32(i), Point: []float32{1, 2}})
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+
+	segments, err := wal.SegmentFileNames(path)
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(segments[0])
+	require.NoError(t, err)
+
+	recordSize := 4 + 1 + 4 + 4 + 2 + 2*4        // Offset + Type + CRC + Payload
+	content[len(content)-2*recordSize+9] ^= 0xFF // flip bits in the payload of the second entry
+	require.NoError(t, os.WriteFile(segments[0], content, 0666))
+
+	_, err = wal.New(path, conf, waltest.ExampleEntries, logger)
+	assert.EqualError(t, err, "failed to load WAL: opening last segment: detected WAL Entry corruption before WAL offset 3")
+}
+
+func TestWAL_CorruptedSegment_ZeroedHeader(t *testing.T) {
+	path := t.TempDir()
+	conf := wal.DefaultConfiguration()
+	conf.PreallocateSegments = true
+	logger := zaptest.Logger(t)
+
+	w, err := wal.New(path, conf, waltest.ExampleEntries, logger)
+	require.NoError(t, err)
+
+	for i := 1; i <= 4; i++ {
+		_, err = w.Write(&waltest.ExampleEntry1{ID: uint32(i), Point: []float32{1, 2}})
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+
+	segments, err := wal.SegmentFileNames(path)
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(segments[0])
+	require.NoError(t, err)
+
+	t.Log("A zeroed record header must not be mistaken for the end of the segment")
+	recordSize := 4 + 1 + 4 + 4 + 2 + 2*4 // Offset + Type + CRC + Payload
+	second := bytes.Index(content, []byte{0, 0, 0, 2})
+	require.Positive(t, second)
+	copy(content[second:second+9], make([]byte, 9))
+	require.NoError(t, os.WriteFile(segments[0], content, 0666))
+
+	_, err = wal.New(path, conf, waltest.ExampleEntries, logger)
+	assert.EqualError(t, err, "failed to load WAL: opening last segment: detected WAL Entry corruption before WAL offset 3")
+
+	t.Log("The segment must not be truncated")
+	actual, err := os.ReadFile(segments[0])
+	require.NoError(t, err)
+	assert.Equal(t, content, actual)
+
+	t.Log("A zeroed header of the last record is indistinguishable from an incomplete write")
+	copy(content[second:second+3*recordSize], make([]byte, 3*recordSize))
+	require.NoError(t, os.WriteFile(segments[0], content, 0666))
+
+	w, err = wal.New(path, conf, waltest.ExampleEntries, logger)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, w.Offset())
+	require.NoError(t, w.Close())
+}
+
+func TestWAL_CorruptedSegment_RecordLengths(t *testing.T) {
+	fs := waltest.NewMemFS()
+	conf := wal.DefaultConfiguration()
+	conf.RecordLengths = true
+	opts := []wal.Option{wal.WithFS(fs), wal.WithConfiguration(conf)}
+
+	w, err := wal.Open("/wal", waltest.ExampleEntries, zaptest.Logger(t), opts...)
+	require.NoError(t, err)
+
+	for i := 1; i <= 3; i++ {
+		_, err = w.Write(&waltest.ExampleEntry1{ID: uint32(i), Point: []float32{1, 2}})
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+
+	content, err := fs.ReadFile("/wal/1.wal")
+	require.NoError(t, err)
+
+	t.Log("Skipped payloads should still be verified when the WAL is opened")
+	recordSize := 4 + 1 + 4 + 1 + 1 + 4 + 4 + 2 + 2*4 // Offset + 0xFF + CRC + Flags + Type + Length + Payload
+	content[len(content)-recordSize-1] ^= 0xFF        // flip bits in the payload of the second entry
+	require.NoError(t, fs.WriteFile("/wal/1.wal", content))
+
+	_, err = wal.Open("/wal", waltest.ExampleEntries, zaptest.Logger(t), opts...)
+	assert.EqualError(t, err, "failed to load WAL: opening last segment: detected WAL Entry corruption before WAL offset 3")
+}
+
+func TestWAL_Failed(t *testing.T) {
+	for _, op := range []waltest.Op{waltest.OpWrite, waltest.OpSync} {
+		t.Run(string(op), func(t *testing.T) {
+			fs := waltest.NewFaultFS(waltest.NewMemFS())
+			w, err := wal.Open("/wal", waltest.ExampleEntries, zaptest.Logger(t), wal.WithFS(fs))
+			require.NoError(t, err)
+
+			_, err = w.Write(&waltest.ExampleEntry1{ID: 1})
+			require.NoError(t, err)
+			require.NoError(t, w.Err())
+
+			t.Log("Injecting a single fault")
+			fs.Inject(waltest.Fault{Op: op})
+			_, err = w.Write(&waltest.ExampleEntry1{ID: 2})
+			assert.ErrorIs(t, err, waltest.ErrInjected)
+			assert.ErrorIs(t, w.Err(), waltest.ErrInjected)
+
+			t.Log("All further writes should be rejected with the original cause")
+			_, err = w.Write(&waltest.ExampleEntry1{ID: 3})
+			assert.ErrorIs(t, err, wal.ErrFailed)
+			assert.ErrorIs(t, err, waltest.ErrInjected)
+			assert.Equal(t, uint32(2), w.Offset())
+
+			require.NoError(t, w.Close())
+
+			t.Log("Re-opening the WAL should recover from the failed state")
+			w, err = wal.Open("/wal", waltest.ExampleEntries, zaptest.Logger(t), wal.WithFS(fs))
+			require.NoError(t, err)
+			assert.NoError(t, w.Err())
+
+			offset, err := w.Write(&waltest.ExampleEntry1{ID: 4})
+			require.NoError(t, err)
+			assert.Greater(t, offset, uint32(1))
+
+			var ids []uint32
+			err = w.Replay(0, func(_ uint32, e wal.Entry) error {
+				ids = append(ids, e.(*waltest.ExampleEntry1).ID)
+				return nil
+			})
+			require.NoError(t, err)
+			assert.Equal(t, uint32(1), ids[0])
+			assert.Equal(t, uint32(4), ids[len(ids)-1])
+			assert.NoError(t, w.Close())
+		})
+	}
+}
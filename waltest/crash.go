@@ -0,0 +1,171 @@
+package waltest
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/fgrosse/wal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// CrashTest is a test harness which verifies the durability guarantees of the
+// WAL. Each iteration runs a workload of concurrent writes against a WAL that
+// uses a FaultFS on top of a MemFS. At a random point in time, the FaultFS
+// simulates a crash which drops all data that was not synced yet. Afterwards,
+// the WAL is opened again and the harness asserts that every entry for which
+// WAL.Write(…) returned successfully has survived the crash.
+type CrashTest struct {
+	Configuration wal.Configuration // configuration of the WAL under test
+	Options       []wal.Option      // additional options for opening the WAL (e.g. compression)
+	Iterations    int               // number of simulated crashes (default 100)
+	Writers       int               // number of concurrent writers (default 4)
+	Entries       int               // maximum number of entries written per iteration (default 100)
+	Seed          int64             // seed for the random number generator
+	Logger        *zap.Logger       // logger of the WAL (default no-op logger)
+}
+
+// Run executes the crash test.
+func (c CrashTest) Run(t testing.TB) {
+	if c.Iterations <= 0 {
+		c.Iterations = 100
+	}
+
+	if c.Writers <= 0 {
+		c.Writers = 4
+	}
+
+	if c.Entries <= 0 {
+		c.Entries = 100
+	}
+
+	if c.Logger == nil {
+		c.Logger = zap.NewNop()
+	}
+
+	rng := rand.New(rand.NewSource(c.Seed))
+	for i := 0; i < c.Iterations; i++ {
+		crashAfter := rng.Intn(4 * c.Entries) // roughly the number of operations of a workload
+		c.runIteration(t, rng.Int63(), crashAfter)
+		if t.Failed() {
+			t.Logf("Crash test failed in iteration %d (seed=%d, crash_after=%d)", i, c.Seed, crashAfter)
+			return
+		}
+	}
+}
+
+func (c CrashTest) runIteration(t testing.TB, seed int64, crashAfter int) {
+	const path = "/crash-test/wal"
+
+	mem := NewMemFS()
+	fs := NewFaultFS(mem)
+	fs.CrashAfter(crashAfter)
+
+	opts := append([]wal.Option{wal.WithConfiguration(c.Configuration), wal.WithFS(fs)}, c.Options...)
+	acknowledged := c.runWorkload(path, seed, opts)
+
+	// Crash now if the workload completed before the scheduled crash.
+	fs.Crash()
+
+	opts = append([]wal.Option{wal.WithConfiguration(c.Configuration), wal.WithFS(mem)}, c.Options...)
+	w, err := wal.Open(path, ExampleEntries, c.Logger, opts...)
+	if len(acknowledged) == 0 && err != nil {
+		// We might have crashed before the WAL directory was created.
+		return
+	}
+	require.NoError(t, err, "failed to open WAL after crash")
+
+	recovered := map[uint32]wal.Entry{}
+	var lastOffset uint32
+	err = w.Replay(0, func(offset uint32, e wal.Entry) error {
+		if lastOffset != 0 && offset != lastOffset+1 {
+			return fmt.Errorf("replayed offset %d after offset %d", offset, lastOffset)
+		}
+
+		recovered[offset] = e
+		lastOffset = offset
+		return nil
+	})
+	require.NoError(t, err, "failed to replay WAL after crash")
+	assert.Equal(t, lastOffset, w.Offset())
+
+	for offset, expected := range acknowledged {
+		actual, ok := recovered[offset]
+		if assert.True(t, ok, "acknowledged entry at offset %d was lost", offset) {
+			assert.Equal(t, expected, actual, "acknowledged entry at offset %d was modified", offset)
+		}
+	}
+
+	// The recovered WAL must continue to accept writes.
+	offset, err := w.Write(&ExampleEntry1{ID: 1})
+	require.NoError(t, err, "failed to write to WAL after crash")
+	assert.Equal(t, lastOffset+1, offset)
+	require.NoError(t, w.Close())
+}
+
+// runWorkload writes random entries to the WAL using concurrent writers until
+// the first error occurs. It returns all entries that were acknowledged by the
+// WAL, mapped to their offsets.
+func (c CrashTest) runWorkload(path string, seed int64, opts []wal.Option) map[uint32]wal.Entry {
+	acknowledged := map[uint32]wal.Entry{}
+
+	w, err := wal.Open(path, ExampleEntries, c.Logger, opts...)
+	if err != nil {
+		return acknowledged
+	}
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		entries = make(chan wal.Entry)
+	)
+
+	for i := 0; i < c.Writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range entries {
+				offset, err := w.Write(e)
+				if err != nil {
+					continue
+				}
+
+				mu.Lock()
+				acknowledged[offset] = e
+				mu.Unlock()
+			}
+		}()
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	for i := 0; i < c.Entries; i++ {
+		entries <- randomEntry(rng)
+	}
+
+	close(entries)
+	wg.Wait()
+	_ = w.Close()
+
+	return acknowledged
+}
+
+func randomEntry(rng *rand.Rand) wal.Entry {
+	if rng.Intn(2) == 0 {
+		point := make([]float32, rng.Intn(8))
+		for i := range point {
+			point[i] = rng.Float32()
+		}
+
+		return &ExampleEntry1{ID: rng.Uint32(), Point: point}
+	}
+
+	name := make([]byte, rng.Intn(64))
+	for i := range name {
+		name[i] = byte('a' + rng.Intn(26))
+	}
+
+	return &ExampleEntry2{Test: rng.Intn(2) == 0, Name: string(name)}
+}
@@ -0,0 +1,30 @@
+package waltest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fgrosse/wal"
+)
+
+func TestCrashTest(t *testing.T) {
+	t.Run("default configuration", func(t *testing.T) {
+		CrashTest{
+			Configuration: wal.DefaultConfiguration(),
+			Seed:          1,
+		}.Run(t)
+	})
+
+	t.Run("small segments", func(t *testing.T) {
+		conf := wal.DefaultConfiguration()
+		conf.MaxSegmentSize = 256
+		conf.PreallocateSegments = true
+		conf.RecycleSegments = 2
+		conf.SyncDelay = time.Millisecond
+
+		CrashTest{
+			Configuration: conf,
+			Seed:          2,
+		}.Run(t)
+	})
+}
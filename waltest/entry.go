@@ -52,25 +52,18 @@ func (e *ExampleEntry1) EncodePayload(b []byte) []byte {
 	return b[:size]
 }
 
-func (*ExampleEntry1) ReadPayload(r io.Reader) ([]byte, error) {
-	buffer := make([]byte, 6) // 4B ID + 2B Point Dimension
-	n, err := io.ReadFull(r, buffer)
-	if err == io.EOF || n != len(buffer) {
-		return nil, io.ErrUnexpectedEOF
-	}
+func (e *ExampleEntry1) ReadPayload(r io.Reader) ([]byte, error) {
+	return e.AppendPayload(nil, r)
+}
 
+func (*ExampleEntry1) AppendPayload(dst []byte, r io.Reader) ([]byte, error) {
+	dst, err := appendFull(dst, r, 6) // 4B ID + 2B Point Dimension
 	if err != nil {
-		return nil, err
-	}
-
-	dimension := binary.BigEndian.Uint16(buffer[4:6])
-	values := make([]byte, 4*dimension)
-	n, err = io.ReadFull(r, values)
-	if err == io.EOF || n != len(values) {
-		return nil, io.ErrUnexpectedEOF
+		return dst, err
 	}
 
-	return append(buffer, values...), nil
+	dimension := binary.BigEndian.Uint16(dst[len(dst)-2:])
+	return appendFull(dst, r, 4*int(dimension))
 }
 
 func (e *ExampleEntry1) DecodePayload(b []byte) error {
@@ -125,28 +118,21 @@ func (e *ExampleEntry2) EncodePayload(b []byte) []byte {
 	binary.BigEndian.PutUint16(b[1:3], nameLen) // 2 byte
 	copy(b[3:], e.Name)
 
-	return b
+	return b[:totalLen]
 }
 
-func (*ExampleEntry2) ReadPayload(r io.Reader) ([]byte, error) {
-	buffer := make([]byte, 3) // 1B e.Test + 2B len(b.Name)
-	n, err := io.ReadFull(r, buffer)
-	if err == io.EOF || n != len(buffer) {
-		return nil, io.ErrUnexpectedEOF
-	}
+func (e *ExampleEntry2) ReadPayload(r io.Reader) ([]byte, error) {
+	return e.AppendPayload(nil, r)
+}
 
+func (*ExampleEntry2) AppendPayload(dst []byte, r io.Reader) ([]byte, error) {
+	dst, err := appendFull(dst, r, 3) // 1B e.Test + 2B len(b.Name)
 	if err != nil {
-		return nil, err
+		return dst, err
 	}
 
-	nameLen := binary.BigEndian.Uint16(buffer[1:3])
-	name := make([]byte, nameLen)
-	n, err = io.ReadFull(r, name)
-	if err == io.EOF || n != len(name) {
-		return nil, io.ErrUnexpectedEOF
-	}
-
-	return append(buffer, name...), nil
+	nameLen := binary.BigEndian.Uint16(dst[len(dst)-2:])
+	return appendFull(dst, r, int(nameLen))
 }
 
 func (e *ExampleEntry2) DecodePayload(b []byte) error {
@@ -159,3 +145,14 @@ func (e *ExampleEntry2) DecodePayload(b []byte) error {
 	e.Name = string(b[3:])
 	return nil
 }
+
+// appendFull reads exactly n bytes from r and appends them to dst.
+func appendFull(dst []byte, r io.Reader, n int) ([]byte, error) {
+	start := len(dst)
+	dst = append(dst, make([]byte, n)...)
+	if _, err := io.ReadFull(r, dst[start:]); err != nil {
+		return dst[:start], io.ErrUnexpectedEOF
+	}
+
+	return dst, nil
+}
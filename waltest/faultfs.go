@@ -0,0 +1,306 @@
+package waltest
+
+import (
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/fgrosse/wal"
+)
+
+// ErrInjected is the default error that is returned by the FaultFS when it
+// injects a Fault.
+var ErrInjected = errors.New("waltest: injected fault")
+
+// ErrCrashed is returned by all operations of a FaultFS after it has simulated
+// a crash.
+var ErrCrashed = errors.New("waltest: simulated crash")
+
+// Op identifies a file system operation of a FaultFS.
+type Op string
+
+// All operations into which a FaultFS can inject faults.
+const (
+	OpMkdir    Op = "mkdir"
+	OpOpen     Op = "open"
+	OpRead     Op = "read"
+	OpWrite    Op = "write"
+	OpSync     Op = "sync"
+	OpTruncate Op = "truncate"
+	OpRemove   Op = "remove"
+	OpRename   Op = "rename"
+	OpSyncDir  Op = "syncdir"
+)
+
+// Fault describes an error that a FaultFS injects into a file system operation.
+type Fault struct {
+	Op  Op    // the operation to fail
+	N   int   // fail the Nth matching operation after the fault was injected (counting from 1)
+	Err error // the returned error (defaults to ErrInjected)
+
+	// ShortWrite makes a failing OpWrite write the first half of the data
+	// before returning the error. This simulates a torn write.
+	ShortWrite bool
+
+	// Sticky makes the fault persist, so all matching operations fail after
+	// the Nth operation.
+	Sticky bool
+
+	seen int
+}
+
+// FaultFS is a wal.FS that wraps another FS and injects faults into its
+// operations. It can be used to test how the WAL behaves if the disk is full,
+// if syncing fails or if the machine loses power at any point in time.
+//
+// To simulate a crash, the wrapped FS should be a *MemFS. When the FaultFS
+// crashes, it calls MemFS.Crash() which drops all data that has not been
+// synced and all operations of the FaultFS (including operations on files that
+// are already open) fail with ErrCrashed. The application can then "restart"
+// by opening the WAL again using the MemFS directly or a new FaultFS.
+type FaultFS struct {
+	fs wal.FS
+
+	mu         sync.Mutex
+	faults     []*Fault
+	ops        int // number of operations so far
+	crashAfter int // number of operations after which we crash, or -1
+	crashed    bool
+}
+
+// NewFaultFS creates a new FaultFS that wraps the given FS.
+func NewFaultFS(fs wal.FS) *FaultFS {
+	return &FaultFS{fs: fs, crashAfter: -1}
+}
+
+// Inject registers a new Fault. If the N field of the fault is zero, the next
+// matching operation fails.
+func (f *FaultFS) Inject(fault Fault) {
+	if fault.N <= 0 {
+		fault.N = 1
+	}
+
+	if fault.Err == nil {
+		fault.Err = ErrInjected
+	}
+
+	f.mu.Lock()
+	f.faults = append(f.faults, &fault)
+	f.mu.Unlock()
+}
+
+// CrashAfter makes the FaultFS crash when the next n operations have been
+// executed. The operation which triggers the crash also fails with ErrCrashed.
+func (f *FaultFS) CrashAfter(n int) {
+	f.mu.Lock()
+	f.crashAfter = f.ops + n
+	f.mu.Unlock()
+}
+
+// Crash simulates a crash immediately.
+func (f *FaultFS) Crash() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.crash()
+}
+
+// Crashed returns whether the FaultFS has simulated a crash.
+func (f *FaultFS) Crashed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.crashed
+}
+
+// Ops returns the number of operations that have been executed so far.
+func (f *FaultFS) Ops() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.ops
+}
+
+// crash must be called while holding the lock.
+func (f *FaultFS) crash() {
+	if f.crashed {
+		return
+	}
+
+	f.crashed = true
+	if c, ok := f.fs.(interface{ Crash() }); ok {
+		c.Crash()
+	}
+}
+
+// check counts the operation and returns the fault that must be injected, if any.
+func (f *FaultFS) check(op Op) (*Fault, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.crashed {
+		return nil, ErrCrashed
+	}
+
+	f.ops++
+	if f.crashAfter >= 0 && f.ops > f.crashAfter {
+		f.crash()
+		return nil, ErrCrashed
+	}
+
+	for i, fault := range f.faults {
+		if fault.Op != op {
+			continue
+		}
+
+		fault.seen++
+		if fault.seen < fault.N {
+			continue
+		}
+
+		if !fault.Sticky {
+			f.faults = append(f.faults[:i], f.faults[i+1:]...)
+		}
+
+		return fault, fault.Err
+	}
+
+	return nil, nil
+}
+
+// MkdirAll implements the wal.FS interface.
+func (f *FaultFS) MkdirAll(path string) error {
+	if _, err := f.check(OpMkdir); err != nil {
+		return err
+	}
+
+	return f.fs.MkdirAll(path)
+}
+
+// OpenFile implements the wal.FS interface.
+func (f *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (wal.File, error) {
+	if _, err := f.check(OpOpen); err != nil {
+		return nil, err
+	}
+
+	file, err := f.fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &faultFile{File: file, fs: f}, nil
+}
+
+// Remove implements the wal.FS interface.
+func (f *FaultFS) Remove(name string) error {
+	if _, err := f.check(OpRemove); err != nil {
+		return err
+	}
+
+	return f.fs.Remove(name)
+}
+
+// Rename implements the wal.FS interface.
+func (f *FaultFS) Rename(oldpath, newpath string) error {
+	if _, err := f.check(OpRename); err != nil {
+		return err
+	}
+
+	return f.fs.Rename(oldpath, newpath)
+}
+
+// List implements the wal.FS interface.
+func (f *FaultFS) List(dir string) ([]string, error) {
+	if _, err := f.check(OpRead); err != nil {
+		return nil, err
+	}
+
+	return f.fs.List(dir)
+}
+
+// SyncDir implements the wal.FS interface.
+func (f *FaultFS) SyncDir(dir string) error {
+	if _, err := f.check(OpSyncDir); err != nil {
+		return err
+	}
+
+	return f.fs.SyncDir(dir)
+}
+
+// faultFile is a wal.File that was opened by a FaultFS.
+type faultFile struct {
+	wal.File
+	fs *FaultFS
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if _, err := f.fs.check(OpRead); err != nil {
+		return 0, err
+	}
+
+	return f.File.Read(p)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	fault, err := f.fs.check(OpWrite)
+	if err == nil {
+		return f.File.Write(p)
+	}
+
+	if fault == nil || !fault.ShortWrite {
+		return 0, err
+	}
+
+	n, writeErr := f.File.Write(p[:len(p)/2])
+	if writeErr != nil {
+		return n, writeErr
+	}
+
+	return n, err
+}
+
+func (f *faultFile) Sync() error {
+	if _, err := f.fs.check(OpSync); err != nil {
+		return err
+	}
+
+	return f.File.Sync()
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if _, err := f.fs.check(OpTruncate); err != nil {
+		return err
+	}
+
+	return f.File.Truncate(size)
+}
+
+// Seek, Stat and Close are not counted as operations and faults cannot be
+// injected into them, but they fail after a crash like all other operations.
+
+func (f *faultFile) Seek(offset int64, whence int) (int64, error) {
+	if f.fs.Crashed() {
+		return 0, ErrCrashed
+	}
+
+	return f.File.Seek(offset, whence)
+}
+
+func (f *faultFile) Stat() (os.FileInfo, error) {
+	if f.fs.Crashed() {
+		return nil, ErrCrashed
+	}
+
+	return f.File.Stat()
+}
+
+// Close releases the underlying file even after a crash but returns
+// ErrCrashed in that case.
+func (f *faultFile) Close() error {
+	err := f.File.Close()
+	if f.fs.Crashed() {
+		return ErrCrashed
+	}
+
+	return err
+}
@@ -0,0 +1,107 @@
+package waltest
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/fgrosse/wal"
+	"github.com/fgrosse/zaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaultFS_Inject(t *testing.T) {
+	mem := NewMemFS()
+	require.NoError(t, mem.MkdirAll("/wal"))
+
+	fs := NewFaultFS(mem)
+	f, err := fs.OpenFile("/wal/1.wal", os.O_CREATE|os.O_RDWR, 0666)
+	require.NoError(t, err)
+
+	t.Log("Fail the second write with ENOSPC")
+	fs.Inject(Fault{Op: OpWrite, N: 2, Err: syscall.ENOSPC})
+
+	_, err = f.Write([]byte("foo"))
+	assert.NoError(t, err)
+	_, err = f.Write([]byte("bar"))
+	assert.ErrorIs(t, err, syscall.ENOSPC)
+	_, err = f.Write([]byte("baz"))
+	assert.NoError(t, err, "non-sticky faults should only be injected once")
+
+	t.Log("Short writes")
+	fs.Inject(Fault{Op: OpWrite, ShortWrite: true})
+	n, err := f.Write([]byte("1234"))
+	assert.ErrorIs(t, err, ErrInjected)
+	assert.Equal(t, 2, n)
+
+	content, err := mem.ReadFile("/wal/1.wal")
+	require.NoError(t, err)
+	assert.Equal(t, "foobaz12", string(content))
+
+	t.Log("Sticky faults")
+	fs.Inject(Fault{Op: OpSync, Sticky: true})
+	assert.ErrorIs(t, f.Sync(), ErrInjected)
+	assert.ErrorIs(t, f.Sync(), ErrInjected)
+}
+
+func TestFaultFS_Crash(t *testing.T) {
+	mem := NewMemFS()
+	require.NoError(t, mem.MkdirAll("/wal"))
+
+	fs := NewFaultFS(mem)
+	f, err := fs.OpenFile("/wal/1.wal", os.O_CREATE|os.O_RDWR, 0666)
+	require.NoError(t, err)
+	require.NoError(t, fs.SyncDir("/wal"))
+
+	_, err = f.Write([]byte("synced"))
+	require.NoError(t, err)
+	require.NoError(t, f.Sync())
+
+	_, err = f.Write([]byte(" not synced"))
+	require.NoError(t, err)
+
+	unsynced, err := fs.OpenFile("/wal/2.wal", os.O_CREATE|os.O_RDWR, 0666)
+	require.NoError(t, err)
+	_, err = unsynced.Write([]byte("file was never synced"))
+	require.NoError(t, err)
+	require.NoError(t, unsynced.Sync())
+
+	fs.CrashAfter(1)
+	_, err = f.Write([]byte("foo"))
+	assert.NoError(t, err)
+	_, err = f.Write([]byte("bar"))
+	assert.ErrorIs(t, err, ErrCrashed)
+	assert.True(t, fs.Crashed())
+
+	assert.ErrorIs(t, f.Sync(), ErrCrashed, "all operations should fail after a crash")
+	_, err = f.Seek(0, io.SeekStart)
+	assert.ErrorIs(t, err, ErrCrashed)
+	_, err = f.Stat()
+	assert.ErrorIs(t, err, ErrCrashed)
+	assert.ErrorIs(t, f.Close(), ErrCrashed)
+	_, err = fs.List("/wal")
+	assert.ErrorIs(t, err, ErrCrashed)
+
+	names, err := mem.List("/wal")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.wal"}, names, "files that were not synced via SyncDir should be lost")
+
+	content, err := mem.ReadFile("/wal/1.wal")
+	require.NoError(t, err)
+	assert.Equal(t, "synced", string(content))
+}
+
+func TestFaultFS_WAL(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+	w, err := wal.Open("/wal", ExampleEntries, zaptest.Logger(t), wal.WithFS(fs))
+	require.NoError(t, err)
+
+	_, err = w.Write(&ExampleEntry1{ID: 1})
+	require.NoError(t, err)
+
+	fs.Inject(Fault{Op: OpSync})
+	_, err = w.Write(&ExampleEntry1{ID: 2})
+	assert.ErrorIs(t, err, ErrInjected, "sync errors must be returned to the writer")
+}
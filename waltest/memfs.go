@@ -0,0 +1,528 @@
+package waltest
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fgrosse/wal"
+)
+
+// MemFS is an in-memory wal.FS implementation which can be used to make unit
+// tests fast and deterministic. It behaves like a file system on disk, so the
+// same MemFS can be passed to wal.Open(…) multiple times in order to re-open
+// the "same" WAL within a test and exercise its recovery logic.
+//
+// The MemFS also keeps track of which data has been synced to "disk". This way,
+// it can simulate a crash via MemFS.Crash() which drops all data that has not
+// been synced via File.Sync() or FS.SyncDir(…).
+//
+// Additionally, the capacity of the MemFS can be limited via SetCapacity(…) in
+// order to test how the WAL behaves when the disk is full.
+//
+// The zero value is not usable. Use NewMemFS() to create a new MemFS instead.
+type MemFS struct {
+	mu      sync.Mutex
+	dirs    map[string]bool
+	files   map[string]*memNode
+	durable map[string]*memNode // directory entries as of the last SyncDir
+
+	used     atomic.Int64 // total size of all files in bytes
+	capacity atomic.Int64 // maximum total size of all files or zero if unlimited
+}
+
+// memNode contains the data of a single file. Like on a real file system, the
+// data stays available to open file handles when the file is removed or renamed.
+type memNode struct {
+	fs      *MemFS
+	mu      sync.Mutex
+	data    []byte
+	synced  []byte // data as of the last call to Sync
+	dirty   int64  // position of the first byte that was modified since the last call to Sync
+	modTime time.Time
+}
+
+// NewMemFS creates a new and empty MemFS.
+func NewMemFS() *MemFS {
+	return &MemFS{
+		dirs:    map[string]bool{string(filepath.Separator): true, ".": true},
+		files:   map[string]*memNode{},
+		durable: map[string]*memNode{},
+	}
+}
+
+// Crash simulates a power loss by dropping all data that has not been synced
+// yet. Files which have been created, renamed or removed since the last call
+// to SyncDir(…) are reverted to their last synced state.
+//
+// File handles which have been opened before the crash must not be used anymore.
+func (m *MemFS) Crash() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.files = make(map[string]*memNode, len(m.durable))
+	for name, node := range m.durable {
+		m.files[name] = node
+	}
+
+	var used int64
+	for _, node := range m.files {
+		node.mu.Lock()
+		node.data = append(node.data[:0], node.synced...)
+		node.dirty = int64(len(node.data))
+		used += int64(len(node.data))
+		node.mu.Unlock()
+	}
+
+	m.used.Store(used)
+}
+
+// SetCapacity limits the total size of all files in the MemFS. All writes that
+// would exceed the capacity fail with a syscall.ENOSPC error. The default value
+// 0 means that the capacity is unlimited.
+func (m *MemFS) SetCapacity(bytes int64) {
+	m.capacity.Store(bytes)
+}
+
+// FreeSpace implements the wal.FreeSpaceFS interface. If the capacity of the
+// MemFS is unlimited, FreeSpace returns math.MaxInt64.
+func (m *MemFS) FreeSpace(string) (int64, error) {
+	capacity := m.capacity.Load()
+	if capacity == 0 {
+		return math.MaxInt64, nil
+	}
+
+	free := capacity - m.used.Load()
+	if free < 0 {
+		free = 0
+	}
+
+	return free, nil
+}
+
+// MkdirAll implements the wal.FS interface.
+func (m *MemFS) MkdirAll(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path = filepath.Clean(path)
+	if _, ok := m.files[path]; ok {
+		return &fs.PathError{Op: "mkdir", Path: path, Err: errors.New("not a directory")}
+	}
+
+	for p := path; !m.dirs[p]; p = filepath.Dir(p) {
+		m.dirs[p] = true
+	}
+
+	return nil
+}
+
+// OpenFile implements the wal.FS interface.
+func (m *MemFS) OpenFile(name string, flag int, _ os.FileMode) (wal.File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if !m.dirs[filepath.Dir(name)] {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	if m.dirs[name] {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	}
+
+	node, ok := m.files[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !ok:
+		node = &memNode{fs: m, modTime: time.Now()}
+		m.files[name] = node
+	}
+
+	f := &memFile{name: name, node: node, flag: flag}
+	if flag&os.O_TRUNC != 0 && f.writable() {
+		node.mu.Lock()
+		node.resize(0)
+		node.markDirty(0)
+		node.modTime = time.Now()
+		node.mu.Unlock()
+	}
+
+	return f, nil
+}
+
+// Remove implements the wal.FS interface.
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if _, ok := m.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+
+	m.release(m.files[name])
+	delete(m.files, name)
+	return nil
+}
+
+// Rename implements the wal.FS interface.
+func (m *MemFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	node, ok := m.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+
+	if !m.dirs[filepath.Dir(newpath)] || m.dirs[newpath] {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrInvalid}
+	}
+
+	if replaced, ok := m.files[newpath]; ok && replaced != node {
+		m.release(replaced)
+	}
+
+	delete(m.files, oldpath)
+	m.files[newpath] = node
+
+	return nil
+}
+
+// release is called when a node is no longer part of the MemFS in order to
+// free up its capacity. The caller must hold the lock of the MemFS.
+func (m *MemFS) release(node *memNode) {
+	node.mu.Lock()
+	m.used.Add(-int64(len(node.data)))
+	node.mu.Unlock()
+}
+
+// List implements the wal.FS interface.
+func (m *MemFS) List(dir string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir = filepath.Clean(dir)
+	if !m.dirs[dir] {
+		return nil, &fs.PathError{Op: "open", Path: dir, Err: fs.ErrNotExist}
+	}
+
+	var names []string
+	for name := range m.files {
+		if filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// SyncDir implements the wal.FS interface.
+func (m *MemFS) SyncDir(dir string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir = filepath.Clean(dir)
+	if !m.dirs[dir] {
+		return &fs.PathError{Op: "sync", Path: dir, Err: fs.ErrNotExist}
+	}
+
+	for name := range m.durable {
+		if _, ok := m.files[name]; !ok && filepath.Dir(name) == dir {
+			delete(m.durable, name)
+		}
+	}
+
+	for name, node := range m.files {
+		if filepath.Dir(name) == dir {
+			m.durable[name] = node
+		}
+	}
+
+	return nil
+}
+
+// ReadFile returns a copy of the contents of the named file. This is useful to
+// make assertions about the data that the WAL has written.
+func (m *MemFS) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	node, ok := m.files[filepath.Clean(name)]
+	m.mu.Unlock()
+
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	return append([]byte(nil), node.data...), nil
+}
+
+// WriteFile replaces the contents of the named file and creates it if it does
+// not exist yet. The new contents are synced immediately. This is useful to
+// simulate corrupted segment files in tests.
+func (m *MemFS) WriteFile(name string, data []byte) error {
+	f, err := m.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+
+	if err = f.Sync(); err != nil {
+		return err
+	}
+
+	return m.SyncDir(filepath.Dir(name))
+}
+
+// memFile is an open file handle of the MemFS.
+type memFile struct {
+	name   string
+	node   *memNode
+	flag   int
+	pos    int64
+	closed bool
+}
+
+func (f *memFile) readable() bool {
+	return f.flag&(os.O_WRONLY|os.O_RDWR) != os.O_WRONLY
+}
+
+func (f *memFile) writable() bool {
+	return f.flag&(os.O_WRONLY|os.O_RDWR) != 0
+}
+
+func (f *memFile) check(op string, allowed bool) error {
+	if f.closed {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrClosed}
+	}
+
+	if !allowed {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrPermission}
+	}
+
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if err := f.check("read", f.readable()); err != nil {
+		return 0, err
+	}
+
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	if f.pos >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.node.data[f.pos:])
+	f.pos += int64(n)
+
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if err := f.check("write", f.writable()); err != nil {
+		return 0, err
+	}
+
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	if f.flag&os.O_APPEND != 0 {
+		f.pos = int64(len(f.node.data))
+	}
+
+	var err error
+	if end := f.pos + int64(len(p)); end > int64(len(f.node.data)) {
+		if free := f.node.free(); end-int64(len(f.node.data)) > free {
+			err = &fs.PathError{Op: "write", Path: f.name, Err: syscall.ENOSPC}
+			p = p[:max64(0, int64(len(f.node.data))+free-f.pos)]
+			end = f.pos + int64(len(p))
+		}
+
+		if len(p) > 0 && end > int64(len(f.node.data)) {
+			f.node.resize(end)
+		}
+	}
+
+	n := copy(f.node.data[f.pos:], p)
+	f.node.markDirty(f.pos)
+	f.pos += int64(n)
+	f.node.modTime = time.Now()
+
+	return n, err
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.check("seek", true); err != nil {
+		return 0, err
+	}
+
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = f.pos + offset
+	case io.SeekEnd:
+		pos = int64(len(f.node.data)) + offset
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+
+	if pos < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+
+	f.pos = pos
+	return pos, nil
+}
+
+func (f *memFile) Close() error {
+	if err := f.check("close", true); err != nil {
+		return err
+	}
+
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	if err := f.check("stat", true); err != nil {
+		return nil, err
+	}
+
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	return memFileInfo{
+		name:    filepath.Base(f.name),
+		size:    int64(len(f.node.data)),
+		modTime: f.node.modTime,
+	}, nil
+}
+
+func (f *memFile) Sync() error {
+	if err := f.check("sync", true); err != nil {
+		return err
+	}
+
+	// Only copy the data that was modified since the last sync, so syncing
+	// does not get slower as the file grows.
+	f.node.mu.Lock()
+	from := f.node.dirty
+	if n := int64(len(f.node.synced)); from > n {
+		from = n
+	}
+	f.node.synced = append(f.node.synced[:from], f.node.data[from:]...)
+	f.node.dirty = int64(len(f.node.data))
+	f.node.mu.Unlock()
+
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if err := f.check("truncate", f.writable()); err != nil {
+		return err
+	}
+
+	if size < 0 {
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: fs.ErrInvalid}
+	}
+
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	if size-int64(len(f.node.data)) > f.node.free() {
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: syscall.ENOSPC}
+	}
+
+	f.node.resize(size)
+	f.node.markDirty(size)
+	f.node.modTime = time.Now()
+
+	return nil
+}
+
+// resize grows or shrinks the data of the file. New data is filled with zeros.
+// The caller must hold the lock of the node.
+func (n *memNode) resize(size int64) {
+	n.fs.used.Add(size - int64(len(n.data)))
+
+	if size <= int64(len(n.data)) {
+		n.data = n.data[:size]
+		return
+	}
+
+	if size <= int64(cap(n.data)) {
+		old := len(n.data)
+		n.data = n.data[:size]
+		for i := old; i < len(n.data); i++ {
+			n.data[i] = 0
+		}
+		return
+	}
+
+	data := make([]byte, size, size*2)
+	copy(data, n.data)
+	n.data = data
+}
+
+// markDirty records that the data of the node was modified at the given
+// position. The caller must hold the lock of the node.
+func (n *memNode) markDirty(pos int64) {
+	if pos < n.dirty {
+		n.dirty = pos
+	}
+}
+
+// free returns the number of bytes by which the node can still grow.
+func (n *memNode) free() int64 {
+	free, _ := n.fs.FreeSpace("")
+	return free
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+// memFileInfo implements the os.FileInfo interface for files of the MemFS.
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) Mode() os.FileMode  { return 0666 }
+func (i memFileInfo) ModTime() time.Time { return i.modTime }
+func (i memFileInfo) IsDir() bool        { return false }
+func (i memFileInfo) Sys() any           { return nil }
@@ -0,0 +1,155 @@
+package waltest
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/fgrosse/wal"
+	"github.com/fgrosse/zaptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemFS(t *testing.T) {
+	fs := NewMemFS()
+
+	_, err := fs.List("/wal")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = fs.OpenFile("/wal/1.wal", os.O_CREATE|os.O_RDWR, 0666)
+	assert.ErrorIs(t, err, os.ErrNotExist, "parent directory must exist")
+
+	require.NoError(t, fs.MkdirAll("/wal"))
+
+	f, err := fs.OpenFile("/wal/1.wal", os.O_CREATE|os.O_EXCL|os.O_RDWR, 0666)
+	require.NoError(t, err)
+
+	_, err = fs.OpenFile("/wal/1.wal", os.O_CREATE|os.O_EXCL|os.O_RDWR, 0666)
+	assert.ErrorIs(t, err, os.ErrExist)
+
+	_, err = f.Write([]byte("hello world"))
+	require.NoError(t, err)
+	require.NoError(t, f.Sync())
+
+	t.Log("Seeking and reading")
+	_, err = f.Seek(6, io.SeekStart)
+	require.NoError(t, err)
+	b, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "world", string(b))
+
+	t.Log("Writing after the end of the file should fill the gap with zeros")
+	_, err = f.Seek(13, io.SeekStart)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("!"))
+	require.NoError(t, err)
+
+	content, err := fs.ReadFile("/wal/1.wal")
+	require.NoError(t, err)
+	assert.Equal(t, "hello world\x00\x00!", string(content))
+
+	t.Log("Truncating the file")
+	require.NoError(t, f.Truncate(5))
+	info, err := f.Stat()
+	require.NoError(t, err)
+	assert.EqualValues(t, 5, info.Size())
+	assert.Equal(t, "1.wal", info.Name())
+	require.NoError(t, f.Close())
+
+	_, err = f.Write([]byte("foo"))
+	assert.ErrorIs(t, err, os.ErrClosed)
+
+	t.Log("Read-only files cannot be written to")
+	f, err = fs.OpenFile("/wal/1.wal", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("foo"))
+	assert.ErrorIs(t, err, os.ErrPermission)
+
+	t.Log("Renaming and removing files")
+	require.NoError(t, fs.WriteFile("/wal/2.wal", []byte("bar")))
+	require.NoError(t, fs.Rename("/wal/1.wal", "/wal/3.wal"))
+	require.NoError(t, fs.SyncDir("/wal"))
+
+	names, err := fs.List("/wal")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2.wal", "3.wal"}, names)
+
+	require.NoError(t, fs.Remove("/wal/2.wal"))
+	assert.ErrorIs(t, fs.Remove("/wal/2.wal"), os.ErrNotExist)
+
+	b, err = io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b), "open files should still be readable after they have been renamed")
+}
+
+func TestMemFS_Capacity(t *testing.T) {
+	fs := NewMemFS()
+	require.NoError(t, fs.MkdirAll("/wal"))
+	fs.SetCapacity(10)
+
+	f, err := fs.OpenFile("/wal/1.wal", os.O_CREATE|os.O_RDWR, 0666)
+	require.NoError(t, err)
+
+	_, err = f.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	free, err := fs.FreeSpace("/wal")
+	require.NoError(t, err)
+	assert.EqualValues(t, 5, free)
+
+	n, err := f.Write([]byte("hello world"))
+	assert.ErrorIs(t, err, syscall.ENOSPC)
+	assert.Equal(t, 5, n, "should write as much as possible")
+	assert.ErrorIs(t, f.Truncate(20), syscall.ENOSPC)
+
+	t.Log("Removing files should free up space")
+	require.NoError(t, fs.Remove("/wal/1.wal"))
+	free, err = fs.FreeSpace("/wal")
+	require.NoError(t, err)
+	assert.EqualValues(t, 10, free)
+}
+
+func TestMemFS_WAL(t *testing.T) {
+	fs := NewMemFS()
+	conf := wal.DefaultConfiguration()
+	conf.MaxSegmentSize = 100
+	conf.PreallocateSegments = true
+	logger := zaptest.Logger(t)
+
+	open := func() *wal.WAL {
+		w, err := wal.New("/data/wal", conf, ExampleEntries, logger, wal.WithFS(fs))
+		require.NoError(t, err)
+		return w
+	}
+
+	var expected []wal.Entry
+	for i := 0; i < 3; i++ {
+		w := open()
+		for j := 0; j < 5; j++ {
+			e := &ExampleEntry1{ID: uint32(len(expected) + 1), Point: []float32{1, 2}}
+			expected = append(expected, e)
+
+			offset, err := w.Write(e)
+			require.NoError(t, err)
+			assert.EqualValues(t, len(expected), offset)
+		}
+		require.NoError(t, w.Close())
+	}
+
+	names, err := fs.List("/data/wal")
+	require.NoError(t, err)
+	assert.Greater(t, len(names), 1, "WAL should have rolled over to new segments")
+
+	w, err := wal.Open("/data/wal", ExampleEntries, logger, wal.WithFS(fs), wal.ReadOnly())
+	require.NoError(t, err)
+
+	var actual []wal.Entry
+	err = w.Replay(0, func(_ uint32, e wal.Entry) error {
+		actual = append(actual, e)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+}